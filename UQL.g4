@@ -12,10 +12,13 @@ LT:            '<';
 GT:            '>';
 LT_EQ:         '<=';
 GT_EQ:         '>=';
+MATCH:         '~';
+NOT_MATCH:     '!~';
 
 LPAREN:        '(';
 RPAREN:        ')';
 COMMA:         ',';
+SEMICOLON:     ';';
 
 AND:           'and';
 OR:            'or';
@@ -31,40 +34,73 @@ AFTER:         'after';
 AGGREGATE:     'aggregate';
 APPEND:        'append';
 AS:            'as';
+AT:            'at';
 AVERAGE:       'avg';
 BASED:         'based';
 BEGIN:         'begin';
+BETWEEN:       'between';
 BY:            'by';
+CASE:          'case';
 CHUNKING:      'chunking';
 CLOCK:         'clock';
+CMS:           'cms';
+COLLECT_LIST:  'collect_list';
+COLLECT_SET:   'collect_set';
 CONTINUOUSLY:  'continuously';
+CORR:          'corr';
 COUNT:         'count';
+COVARIANCE:    'covariance';
+COVAR_POP:     'covar_pop';
+DELTA:         'delta';
+DERIV:         'deriv';
 DISTINCTCOUNT: 'distinctcount';
+ELSE:          'else';
 END:           'end';
 EVERY:         'every';
 EXCLUSIVE:     'exclusive';
 EXPIRE:        'expire';
 FALSE:         'false';
+FILTER:        'filter';
 FIRST:         'first';
+FORMAT:        'format';
 FROM:          'from';
 GROUP:         'group';
+HLL:           'hll';
+IF:            'if';
+IN:            'in';
 INCLUSIVE:     'inclusive';
+INCREASE:      'increase';
+KURTOSIS:      'kurtosis';
 LAST:          'last';
+LIKE:          'like';
 MAXIMUM:       'max';
 MEAN:          'mean';
+MEDIAN:        'median';
 MINIMUM:       'min';
 ON:            'on';
 OF:            'of';
 ORDER:         'order';
+PERCENTILE:    'percentile';
+QUANTILES:     'quantiles';
+RATE:          'rate';
 REASON:        'reason';
 SESSION:       'session';
+SKEWNESS:      'skewness';
 SLICE:         'slice';
 SLIDE:         'slide';
+STDDEV:        'stddev';
+STDDEV_POP:    'stddev_pop';
 SUM:           'sum';
+THEN:          'then';
 TO:            'to';
+TOPK:          'topk';
 TRUE:          'true';
+UNION:         'union';
 UNIQUE:        'uniq';
+UNIQUE_MERGE:  'uniq_merge';
 USER:          'user';
+VARIANCE:      'variance';
+VAR_POP:       'var_pop';
 WALL:          'wall';
 WHEN:          'when';
 WHERE:         'where';
@@ -79,12 +115,21 @@ DQ_STRING:     '"' (~('"' | '\\' | '\r' | '\n') | '\\' ('"' | '\\'))* '"';
 SQ_STRING:     '\'' (~('\'' | '\\' | '\r' | '\n') | '\\' ('\'' | '\\'))* '\'';
 BOOLEAN:       FALSE | TRUE;
 
-fieldName:      NAME;
-groupName:      NAME;
-projectionName: NAME;
+fieldName:      identifier;
+groupName:      identifier;
+projectionName: identifier;
 tableName:      NAME;
 
-start: queryClause EOF;
+// The names of aggregate functions are keywords only before "(", so they can also name fields.
+identifier: NAME | functionKeyword;
+functionKeyword
+  : AVERAGE | CMS | COLLECT_LIST | COLLECT_SET | CORR | COUNT | COVARIANCE | COVAR_POP | DELTA
+  | DERIV | DISTINCTCOUNT | FIRST | HLL | INCREASE | KURTOSIS | LAST | MAXIMUM | MEAN | MEDIAN
+  | MINIMUM | PERCENTILE | QUANTILES | RATE | REASON | SKEWNESS | STDDEV | STDDEV_POP | SUM | TOPK
+  | UNIQUE | UNIQUE_MERGE | VARIANCE | VAR_POP
+  ;
+
+start: (queryClause SEMICOLON?)+ EOF;
 
 queryClause:
   fromClause
@@ -97,30 +142,39 @@ queryClause:
   projectWhereClause?
   toClause;
 
-fromClause:           FROM xxx = tableName;
+fromClause:           FROM tableName ((COMMA | UNION) tableName)*;
 groupClause:          GROUP BY groups;
 windowClause:         WINDOW (sliceWindow | slideWindow | sessionWindow);
 aggregateClause:      AGGREGATE aggregations;
 appendClause:         APPEND projections;
-toClause:             TO tableName;
+toClause:             TO sinks;
 
 ingressWhereClause:   whereClause;
 aggregateWhereClause: whereClause;
 projectWhereClause:   whereClause;
+sinkWhereClause:      whereClause;
 whereClause:          WHERE expression;
 
 expression
   : left = term op = (LT | LT_EQ | EQ | NOT_EQ | GT_EQ | GT) right = term  # Equation
+  | term NOT? LIKE pattern = DQ_STRING                                     # Like
+  | term op = (MATCH | NOT_MATCH) pattern = DQ_STRING                      # RegexMatch
+  | term NOT? IN LPAREN term (COMMA term)* RPAREN                          # In
+  | term NOT? BETWEEN low = term AND high = term                           # Between
   | NOT LPAREN expression RPAREN                                           # Negation
   | left = expression op = (AND | OR) right = expression                   # Connection
+  | term                                                                   # Predicate
   ;
 
 term
-  : duration                          # IgnoreMeDuration
-  | atom                              # IgnoreMeBasic
-  | term op = (MUL | DIV | MOD) term  # MulDivMod
-  | term op = (ADD | SUB) term        # AddSub
-  | LPAREN term RPAREN                # Parenthesis
+  : duration                                                        # IgnoreMeDuration
+  | atom                                                            # IgnoreMeBasic
+  | functionCall                                                    # IgnoreMeFunctionCall
+  | CASE (WHEN expression THEN term)+ (ELSE otherwise = term)? END  # CaseWhen
+  | IF LPAREN expression COMMA term COMMA term RPAREN               # If
+  | term op = (MUL | DIV | MOD) term                                # MulDivMod
+  | term op = (ADD | SUB) term                                      # AddSub
+  | LPAREN term RPAREN                                              # Parenthesis
   ;
 
 atom
@@ -128,9 +182,14 @@ atom
   | INTEGER    # Integer
   | DQ_STRING  # String
   | SQ_STRING  # Timestamp
-  | NAME       # Variable
+  | identifier # Variable
+  | TRUE       # True
+  | FALSE      # False
   ;
 
+// "format", "seconds", and "minutes" are keywords as well as function names.
+functionCall: fn = (NAME | FORMAT | SECONDS | MINUTES) LPAREN (term (COMMA term)*)? RPAREN;
+
 duration: amount = INTEGER unit = (MILLISECONDS | SECONDS | MINUTES);
 distance: amount = INTEGER unit = ROWS;
 
@@ -142,23 +201,52 @@ sessionWindow: SESSION BEGIN WHEN open = sessionOpen END WHEN close = sessionClo
 sessionOpen:   expression;
 sessionClose:  expression clusivity = (EXCLUSIVE | INCLUSIVE);
 
-groups:        groupName      (COMMA groupName)*;
-projections:   projectionName (COMMA projectionName)*;
+groups:        groupKey       (COMMA groupKey)*;
+projections:   projection     (COMMA projection)*;
 aggregations:  aggregation    (COMMA aggregation)*;
-aggregation:   aggregate AS fieldName;
+sinks:         sink           (COMMA sink)*;
+aggregation:   aggregate (FILTER LPAREN WHERE expression RPAREN)? AS fieldName;
+projection:    (term AS)? projectionName;
+groupKey:      (term AS)? groupName;
+
+sink:          tableName (FORMAT format = NAME)? (AT location = DQ_STRING)? sinkWhereClause?;
 
 aggregate
-  : AVERAGE LPAREN fieldName RPAREN        # aggregateAverage
-  | COUNT LPAREN fieldName RPAREN          # aggregateCount
-  | COUNT LPAREN RPAREN                    # aggregateCountWithoutAsterisk
-  | DISTINCTCOUNT LPAREN fieldName RPAREN  # aggregateDistinctCount
-  | FIRST LPAREN fieldName RPAREN          # aggregateFirst
-  | GROUP LPAREN fieldName RPAREN          # aggregateGroup
-  | LAST LPAREN fieldName RPAREN           # aggregateLast
-  | MAXIMUM LPAREN fieldName RPAREN        # aggregateMaximum
-  | MEAN LPAREN fieldName RPAREN           # aggregateMean
-  | MINIMUM LPAREN fieldName RPAREN        # aggregateMinimum
-  | SUM LPAREN fieldName RPAREN            # aggregateSum
-  | UNIQUE LPAREN fieldName RPAREN         # aggregateUnique
-  | REASON LPAREN RPAREN                   # aggregateReasonForWindowClose
+  : AVERAGE LPAREN term RPAREN                                                              # aggregateAverage
+  | CMS LPAREN term (COMMA epsilon = FLOAT COMMA delta = FLOAT)? RPAREN                     # aggregateCountMinSketch
+  | COLLECT_LIST LPAREN term COMMA limit = INTEGER RPAREN                                   # aggregateCollectList
+  | COLLECT_SET LPAREN term RPAREN                                                          # aggregateCollectSet
+  | CORR LPAREN term COMMA term RPAREN                                                      # aggregateCorrelation
+  | COUNT LPAREN fieldName RPAREN                                                           # aggregateCount
+  | COUNT LPAREN RPAREN                                                                     # aggregateCountWithoutAsterisk
+  | COUNT LPAREN expression RPAREN                                                          # aggregateCountIf
+  | COVARIANCE LPAREN term COMMA term RPAREN                                                # aggregateCovariance
+  | COVAR_POP LPAREN term COMMA term RPAREN                                                 # aggregateCovariancePopulation
+  | DELTA LPAREN term RPAREN                                                                # aggregateDelta
+  | DERIV LPAREN term RPAREN                                                                # aggregateDerivative
+  | DISTINCTCOUNT LPAREN term (COMMA limit = INTEGER (COMMA precision = INTEGER)?)? RPAREN # aggregateDistinctCount
+  | FIRST LPAREN term RPAREN                                                                # aggregateFirst
+  | GROUP LPAREN fieldName RPAREN                                                           # aggregateGroup
+  | HLL LPAREN term (COMMA precision = INTEGER)? RPAREN                                     # aggregateHyperLogLog
+  | INCREASE LPAREN term RPAREN                                                             # aggregateIncrease
+  | KURTOSIS LPAREN term RPAREN                                                             # aggregateKurtosis
+  | LAST LPAREN term RPAREN                                                                 # aggregateLast
+  | MAXIMUM LPAREN term RPAREN                                                              # aggregateMaximum
+  | MEAN LPAREN term RPAREN                                                                 # aggregateMean
+  | MEDIAN LPAREN term (COMMA compression = INTEGER)? RPAREN                                # aggregateMedian
+  | MINIMUM LPAREN term RPAREN                                                              # aggregateMinimum
+  | PERCENTILE LPAREN term COMMA quantile = FLOAT (COMMA compression = INTEGER)? RPAREN     # aggregatePercentile
+  | QUANTILES LPAREN term (COMMA FLOAT)+ (COMMA compression = INTEGER)? RPAREN              # aggregateQuantiles
+  | RATE LPAREN term RPAREN                                                                 # aggregateRate
+  | SKEWNESS LPAREN term RPAREN                                                             # aggregateSkewness
+  | STDDEV LPAREN term RPAREN                                                               # aggregateStandardDeviation
+  | STDDEV_POP LPAREN term RPAREN                                                           # aggregateStandardDeviationPopulation
+  | SUM LPAREN term RPAREN                                                                  # aggregateSum
+  | TOPK LPAREN term COMMA k = INTEGER (COMMA epsilon = FLOAT COMMA delta = FLOAT)? RPAREN  # aggregateTopK
+  | UNIQUE LPAREN term (COMMA precision = INTEGER)? RPAREN                                  # aggregateUnique
+  | UNIQUE_MERGE LPAREN term RPAREN                                                         # aggregateUniqueMerge
+  | VARIANCE LPAREN term RPAREN                                                             # aggregateVariance
+  | VAR_POP LPAREN term RPAREN                                                              # aggregateVariancePopulation
+  | REASON LPAREN RPAREN                                                                    # aggregateReasonForWindowClose
+  | NAME LPAREN term RPAREN                                                                 # aggregateUserDefined
   ;
@@ -1,40 +1,82 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/xsnout/grizzly/pkg/catalog"
+	"github.com/xsnout/grizzly/pkg/utility"
 )
 
 func main() {
-	args := os.Args
-	if len(args) != 7 {
-		err := fmt.Errorf("missing arguments")
-		fmt.Println(err)
-		return
-	} else if args[1] != "-i" && args[3] != "-o" && args[5] != "-t" {
-		err := fmt.Errorf("must specify input and output and CSV template file path")
-		fmt.Println(err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "infer":
+			infer(os.Args[2:])
+			return
+		case "validate":
+			validate(os.Args[2:])
+			return
+		case "list", "describe", "add-table", "remove-table", "rename-table", "add-field", "remove-field", "rename-field", "set-type", "set-usage":
+			edit(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	inputFormat := flag.String("i", "json", "input format: json, capnp, or example")
+	outputFormat := flag.String("o", "capnp", "output format: json or capnp")
+	csvTemplateFilePath := flag.String("t", utility.Getenv("GRIZZLY_CSV_TEMPLATES", ""), "directory for the CSV template files of the tables, written with capnp output; empty for none (env GRIZZLY_CSV_TEMPLATES)")
+	inputPath := flag.String("in", utility.Getenv("GRIZZLY_CATALOG_IN", "-"), "input catalog file, - for stdin (env GRIZZLY_CATALOG_IN)")
+	outputPath := flag.String("out", utility.Getenv("GRIZZLY_CATALOG_OUT", "-"), "output catalog file, - for stdout (env GRIZZLY_CATALOG_OUT)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: catalog [flags]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       catalog infer [flags]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       catalog validate [flags]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       catalog list|describe|add-table|remove-table|rename-table|add-field|remove-field|rename-field|set-type|set-usage [flags] args...\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Converts a catalog between its JSON and binary Cap'n Proto formats, infers a table from sample data, checks a JSON catalog, or edits it.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *inputFormat != "json" && *inputFormat != "capnp" && *inputFormat != "example" {
+		fmt.Fprintf(os.Stderr, "unknown input format: %s\n", *inputFormat)
+		os.Exit(2)
+	}
+	if *outputFormat != "json" && *outputFormat != "capnp" {
+		fmt.Fprintf(os.Stderr, "unknown output format: %s\n", *outputFormat)
+		os.Exit(2)
+	}
+
+	if *inputFormat == "example" {
+		catalog.Example()
 		return
 	}
 
-	c := catalog.NewCatalog(os.Stdin, os.Stdout)
+	input := utility.OpenInput(*inputPath)
+	defer input.Close()
+	output := utility.CreateOutput(*outputPath)
+	defer output.Close()
 
-	switch args[2] {
+	c := catalog.NewCatalog(input, output)
+
+	switch *inputFormat {
 	case "capnp":
 		c.ReadCapnp()
 	case "json":
 		c.ReadJson()
-	case "example":
-		catalog.Example()
 	}
 
-	csvTemplateFilePath := args[6]
-
-	switch args[4] {
+	switch *outputFormat {
 	case "capnp":
-		c.WriteCapnp(csvTemplateFilePath)
+		c.WriteCapnp(*csvTemplateFilePath)
 	case "json":
 		c.WriteJson()
 	}
@@ -60,3 +102,273 @@ func main() {
 	// 	catalog.Example()
 	// }
 }
+
+// Guesses a table from sample rows and prints it, or adds it to a JSON catalog.
+func infer(args []string) {
+	flags := flag.NewFlagSet("infer", flag.ExitOnError)
+	format := flags.String("f", catalog.InferFormatCsv, "input format: csv, jsonl, or syslog")
+	rows := flags.Int("n", 100, "number of rows to sample")
+	inputPath := flags.String("in", "-", "sample data file, - for stdin")
+	catalogPath := flags.String("catalog", "", "JSON catalog to add the table to; empty to print the table")
+	tableName := flags.String("table", "", "name of the table; system.database.schema.table with -catalog")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: catalog infer [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Guesses the fields of a table from sample data: names from a header or the JSON keys, types, and a time field.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || *rows < 1 || *catalogPath != "" && *tableName == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	input := utility.OpenInput(*inputPath)
+	defer input.Close()
+
+	var table catalog.Table
+	var err error
+	if table, err = catalog.InferTable(input, *format, *rows); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *catalogPath == "" {
+		table.Name = *tableName
+		var content []byte
+		if content, err = json.MarshalIndent(table, "", "  "); err != nil {
+			panic(err)
+		}
+		fmt.Println(string(content))
+		return
+	}
+
+	var content []byte
+	if content, err = os.ReadFile(*catalogPath); err != nil {
+		panic(err)
+	}
+	var buffer bytes.Buffer
+	c := catalog.NewCatalog(bytes.NewReader(content), &buffer)
+	c.ReadJson()
+	if err = c.RegisterTable(*tableName, table); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c.WriteJson()
+	writeJsonFile(*catalogPath, buffer.Bytes())
+}
+
+// Prints all problems of a JSON catalog and fails if any of them is an error.
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	inputPath := flags.String("in", utility.Getenv("GRIZZLY_CATALOG_IN", "-"), "JSON catalog file, - for stdin (env GRIZZLY_CATALOG_IN)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: catalog validate [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Reports names, types, and usages in a JSON catalog that the compiler cannot handle.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	input := utility.OpenInput(*inputPath)
+	defer input.Close()
+
+	c := catalog.NewCatalog(input, nil)
+	c.ReadJson()
+	problems := c.Validate()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if catalog.HasErrors(problems) {
+		os.Exit(1)
+	}
+}
+
+// Arguments of the editing commands after the flags
+var editUsages = map[string]string{
+	"list":         "[system[.database[.schema]]]",
+	"describe":     "system.database.schema.table",
+	"add-table":    "system.database.schema.table name:type[:usage]...",
+	"remove-table": "system.database.schema.table",
+	"rename-table": "system.database.schema.table new-name",
+	"add-field":    "system.database.schema.table name type [usage]",
+	"remove-field": "system.database.schema.table name",
+	"rename-field": "system.database.schema.table name new-name",
+	"set-type":     "system.database.schema.table name type",
+	"set-usage":    "system.database.schema.table name usage",
+}
+
+// Reads the JSON catalog, runs one editing command, and writes back the JSON and binary catalogs
+// unless the command only reads.
+func edit(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	catalogJsonPath := flags.String("catalog-json", utility.Getenv("GRIZZLY_CATALOG_JSON", "_out/catalog.json"), "JSON catalog file (env GRIZZLY_CATALOG_JSON)")
+	catalogPath := flags.String("catalog", utility.Getenv("GRIZZLY_CATALOG", "_out/catalog.bin"), "binary catalog file written after a change (env GRIZZLY_CATALOG)")
+	csvTemplateFilePath := flags.String("t", utility.Getenv("GRIZZLY_CSV_TEMPLATES", ""), "directory for the CSV template files of the tables; empty for none (env GRIZZLY_CSV_TEMPLATES)")
+	force := flags.Bool("force", false, "change the fields even if existing data or queries no longer fit the table")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: catalog %s [flags] %s\n\n", command, editUsages[command])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+
+	usageError := func() {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if command == "list" && len(args) > 1 || command != "list" && len(args) == 0 {
+		usageError()
+	}
+
+	var content []byte
+	var err error
+	if content, err = os.ReadFile(*catalogJsonPath); err != nil {
+		panic(err)
+	}
+	var buffer bytes.Buffer
+	c := catalog.NewCatalog(bytes.NewReader(content), &buffer)
+	c.ReadJson()
+
+	// Changes of the fields make a new version of the table.
+	changesFields := strings.HasSuffix(command, "-field") || strings.HasPrefix(command, "set-")
+	var oldFields []catalog.Field
+	if changesFields {
+		var table *catalog.Table
+		if table, err = c.Table(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		oldFields = append(oldFields, table.Fields...)
+	}
+
+	switch command {
+	case "list":
+		path := ""
+		if len(args) == 1 {
+			path = args[0]
+		}
+		var names []string
+		if names, err = c.List(path); err == nil {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		}
+	case "describe":
+		var table *catalog.Table
+		if len(args) != 1 {
+			usageError()
+		}
+		if table, err = c.Table(args[0]); err == nil {
+			fmt.Printf("version %d\n", table.Version)
+			fmt.Printf("%-20s %-10s %-8s %s\n", "FIELD", "TYPE", "USAGE", "DESCRIPTION")
+			for _, f := range table.Fields {
+				fmt.Printf("%-20s %-10s %-8s %s\n", f.Name, f.Type, f.Usage, f.Description)
+			}
+		}
+	case "add-table":
+		var table catalog.Table
+		for _, arg := range args[1:] {
+			parts := strings.Split(arg, ":")
+			if len(parts) < 2 || len(parts) > 3 {
+				usageError()
+			}
+			f := catalog.Field{Type: parts[1], Usage: "data"}
+			f.Name = parts[0]
+			if len(parts) == 3 {
+				f.Usage = parts[2]
+			}
+			table.Fields = append(table.Fields, f)
+		}
+		err = c.AddTable(args[0], table)
+	case "remove-table":
+		if len(args) != 1 {
+			usageError()
+		}
+		err = c.RemoveTable(args[0])
+	case "rename-table":
+		if len(args) != 2 {
+			usageError()
+		}
+		err = c.RenameTable(args[0], args[1])
+	case "add-field":
+		if len(args) != 3 && len(args) != 4 {
+			usageError()
+		}
+		f := catalog.Field{Type: args[2], Usage: "data"}
+		f.Name = args[1]
+		if len(args) == 4 {
+			f.Usage = args[3]
+		}
+		err = c.AddField(args[0], f)
+	case "remove-field":
+		if len(args) != 2 {
+			usageError()
+		}
+		err = c.RemoveField(args[0], args[1])
+	case "rename-field":
+		if len(args) != 3 {
+			usageError()
+		}
+		err = c.RenameField(args[0], args[1], args[2])
+	case "set-type":
+		if len(args) != 3 {
+			usageError()
+		}
+		err = c.SetField(args[0], args[1], args[2], "")
+	case "set-usage":
+		if len(args) != 3 {
+			usageError()
+		}
+		err = c.SetField(args[0], args[1], "", args[2])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if command == "list" || command == "describe" {
+		return
+	}
+
+	if changesFields {
+		table, _ := c.Table(args[0])
+		if err = catalog.CheckEvolution(oldFields, table.Fields); err != nil && !*force {
+			fmt.Fprintf(os.Stderr, "incompatible change of table %s: %v; use -force to change it anyway\n", args[0], err)
+			os.Exit(1)
+		}
+		table.Version++
+	}
+
+	// Don't write a catalog that the compiler would choke on.
+	problems := c.Validate()
+	if catalog.HasErrors(problems) {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		os.Exit(1)
+	}
+
+	c.WriteJson()
+	writeJsonFile(*catalogJsonPath, buffer.Bytes())
+	buffer.Reset()
+	c.WriteCapnp(*csvTemplateFilePath)
+	if err = os.WriteFile(*catalogPath, buffer.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+}
+
+// Writes the catalog indented since people edit the JSON file by hand as well.
+func writeJsonFile(path string, content []byte) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, content, "", "  "); err != nil {
+		panic(err)
+	}
+	indented.WriteByte('\n')
+	if err := os.WriteFile(path, indented.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+}
@@ -2,15 +2,36 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 
 	_ "net/http/pprof"
 
+	"github.com/xsnout/grizzly/pkg/catalog"
 	engine "github.com/xsnout/grizzly/pkg/engine"
+	"github.com/xsnout/grizzly/pkg/utility"
 )
 
+// Repeatable flag with values like "table=location"
+type tableLocations [][2]string
+
+func (t *tableLocations) String() string {
+	return fmt.Sprintf("%v", *t)
+}
+
+func (t *tableLocations) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("must have the form table=location: %s", value)
+	}
+	*t = append(*t, [2]string{parts[0], parts[1]})
+	return nil
+}
+
 func main() {
 	/*
 		  go func() {
@@ -32,40 +53,76 @@ func main() {
 			}()
 	*/
 
-	args := os.Args
 	var err error
-	if len(args) != 5 {
-		err = fmt.Errorf("missing arguments")
-		fmt.Println(err)
-		return
-	} else if args[1] != "-p" {
-		err = fmt.Errorf("must specify binary input plan file")
-		fmt.Println(err)
-		return
-	} else if args[3] != "-x" {
-		err = fmt.Errorf("must specify integer number of seconds")
-		fmt.Println(err)
-		return
+	var exitAfterSecondsDefault int
+	if exitAfterSecondsDefault, err = strconv.Atoi(utility.Getenv("GRIZZLY_EXIT_AFTER_SECONDS", "3600")); err != nil {
+		panic(err)
 	}
 
-	planFilePath := args[2]
-	var planFile *os.File
+	var sources, sinks tableLocations
+	planFilePath := flag.String("p", utility.Getenv("GRIZZLY_PLAN", "_out/plan.bin"), "binary plan file (env GRIZZLY_PLAN)")
+	exitAfterSeconds := flag.Int("x", exitAfterSecondsDefault, "exit after this many seconds (env GRIZZLY_EXIT_AFTER_SECONDS)")
+	inputPath := flag.String("i", utility.Getenv("GRIZZLY_INPUT", "-"), "input of a query that reads from a single table (env GRIZZLY_INPUT)")
+	catalogFilePath := flag.String("catalog", utility.Getenv("GRIZZLY_CATALOG", ""), "binary catalog to check the versions of the source tables against at startup; empty for no check (env GRIZZLY_CATALOG)")
+	flag.Var(&sources, "s", "input of a source table for queries like \"from a, b\" as table=location, where table is the full name in the catalog; repeatable")
+	flag.Var(&sinks, "o", "output of a sink in the \"to\" clause as table=location; repeatable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: grizzly [flags]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Runs a query plan created by grizzlyc.  A location is a file path, - for stdin or stdout,\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "tcp://host:port, or unix:///path/to/socket.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	if planFile, err = os.Open(planFilePath); err != nil {
-		panic(err)
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
+
+	planFile := utility.OpenInput(*planFilePath)
 	defer planFile.Close()
 	planReader := bufio.NewReader(planFile)
 
-	var exitAfterSeconds int
-	if exitAfterSeconds, err = strconv.Atoi(args[4]); err != nil {
+	var input io.ReadCloser
+	if input, err = engine.OpenSource(*inputPath); err != nil {
 		panic(err)
 	}
-
-	//reader := bufio.NewReader(csvFile)
-	dataReader := bufio.NewReader(os.Stdin)
+	defer input.Close()
+	dataReader := bufio.NewReader(input)
 	dataWriter := os.Stdout
 
-	e := engine.NewEngine(dataReader, dataWriter, planReader, exitAfterSeconds)
+	e := engine.NewEngine(dataReader, dataWriter, planReader, *exitAfterSeconds)
+
+	if *catalogFilePath != "" {
+		var index *catalog.Index
+		if index, err = catalog.LoadIndex(*catalogFilePath); err != nil {
+			panic(err)
+		}
+		if err = e.CheckCatalog(index); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// Inputs of the source tables for queries like "from a, b": -s table=location
+	for _, s := range sources {
+		var source io.ReadCloser
+		if source, err = engine.OpenSource(s[1]); err != nil {
+			panic(err)
+		}
+		defer source.Close()
+		e.AddSource(s[0], bufio.NewReader(source))
+	}
+
+	// Outputs of the sinks in the "to" clause that override their locations: -o table=location
+	for _, s := range sinks {
+		var sink io.WriteCloser
+		if sink, err = engine.OpenSink(s[1]); err != nil {
+			panic(err)
+		}
+		defer sink.Close()
+		e.AddSink(s[0], sink)
+	}
+
 	e.Run()
 }
@@ -5,7 +5,7 @@
 //
 //   2. A binary Cap'n Proto query plan file according to the grizzly schema (grizzly.capnp)
 //
-// There are 2 different parameters:
+// There are 2 different commands:
 //
 //   1. compile:  Given a UQL query, generate the binary query plan
 //
@@ -22,16 +22,21 @@
 //   echo "from table1 where x >= 5 project a, b" | ./compiler compile > ./plan.bin
 //   cat ./plan.bin | ./compiler show | jq . | tee ./plan_pretty.json
 //
+// The paths of the catalog and of the generated files are relative to the working directory by
+// default.  They can be set with flags or environment variables; see "grizzlyc --help".
+//
 
 package main
 
 import (
-	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/rs/zerolog"
 
+	"github.com/xsnout/grizzly/pkg/codegen"
 	_ "github.com/xsnout/grizzly/pkg/plan"
 	"github.com/xsnout/grizzly/pkg/utility"
 
@@ -42,27 +47,53 @@ func main() {
 	log := zerolog.New(os.Stderr).With().Caller().Logger()
 	log.Info().Msg("Compiler says welcome!")
 
-	err := errors.New("unknown or missing argument\nusage: grizzlyc [compile|show]")
-
-	if len(os.Args) != 2 {
+	registerTablesDefault, err := strconv.ParseBool(utility.Getenv("GRIZZLY_REGISTER", "false"))
+	if err != nil {
 		panic(err)
 	}
 
-	cmdArgs := os.Args[1]
+	flag.StringVar(&compiler.CatalogFilePath, "catalog", utility.Getenv("GRIZZLY_CATALOG", compiler.CatalogFilePath), "binary catalog file (env GRIZZLY_CATALOG)")
+	flag.StringVar(&compiler.CatalogJsonFilePath, "catalog-json", utility.Getenv("GRIZZLY_CATALOG_JSON", compiler.CatalogJsonFilePath), "JSON catalog file that receives the output tables (env GRIZZLY_CATALOG_JSON)")
+	flag.BoolVar(&compiler.RegisterTables, "register", registerTablesDefault, "add the to tables with full names to both catalog files, or check their fields (env GRIZZLY_REGISTER)")
+	flag.StringVar(&compiler.CsvTemplatesDirPath, "t", utility.Getenv("GRIZZLY_CSV_TEMPLATES", ""), "directory for the CSV template files of the tables when -register writes the catalog; empty for none (env GRIZZLY_CSV_TEMPLATES)")
+	flag.StringVar(&compiler.Namespace, "namespace", utility.Getenv("GRIZZLY_NAMESPACE", ""), "system, database, or schema like sys.db.schema that short table names are looked up in first (env GRIZZLY_NAMESPACE)")
+	flag.StringVar(&codegen.GoCodeFilePath, "go-out", utility.Getenv("GRIZZLY_GO_OUT", codegen.GoCodeFilePath), "generated Go file with the filter functions (env GRIZZLY_GO_OUT)")
+	flag.StringVar(&codegen.CapnpCodeFilePath, "capnp-out", utility.Getenv("GRIZZLY_CAPNP_OUT", codegen.CapnpCodeFilePath), "generated Cap'n Proto file with the row schemas (env GRIZZLY_CAPNP_OUT)")
+	queryPath := flag.String("query", utility.Getenv("GRIZZLY_QUERY", "-"), "UQL query file, - for stdin (env GRIZZLY_QUERY)")
+	planPath := flag.String("plan", utility.Getenv("GRIZZLY_PLAN", "-"), "binary plan file, - for stdout (compile) or stdin (show) (env GRIZZLY_PLAN)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: grizzlyc [flags] compile|show\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  compile  translate a UQL query into a binary query plan\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  show     print a binary query plan as JSON\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmdArgs := flag.Arg(0)
 
 	log.Info().Msgf("command used: %s", cmdArgs)
 
 	compiler.Init()
 	switch cmdArgs {
 	case "compile":
-		compiler.Compile()
+		query := utility.OpenInput(*queryPath)
+		defer query.Close()
+		plan := utility.CreateOutput(*planPath)
+		defer plan.Close()
+		compiler.Compile(query, plan)
 	case "show":
-		utility.ShowPlan()
+		plan := utility.OpenInput(*planPath)
+		defer plan.Close()
+		utility.ShowPlan(plan)
 	default:
-		err := errors.New("unknown or missing argument/nusage: z [compile|show]")
-		fmt.Print(err)
-		log.Error().Err(err)
-		os.Exit(0)
+		log.Error().Msgf("unknown command: %s", cmdArgs)
+		flag.Usage()
+		os.Exit(2)
 	}
 
 	log.Info().Msg("Compiler says good-bye!")
@@ -1,10 +1,8 @@
 package catalog
 
 import (
-	"bufio"
 	"encoding/csv"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -34,9 +32,16 @@ type Catalog struct {
 
 // Used to print a JSON version of the catalog
 type CatalogNode struct {
-	Id          int64  `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	Id          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Properties  []Property `json:"properties,omitempty"`
+}
+
+// Property is a key-value pair that every level of the catalog can have.
+type Property struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 type System struct {
@@ -51,21 +56,41 @@ type Database struct {
 
 type Schema struct {
 	CatalogNode
-	Tables []Table `json:"tables"`
+	Tables    []Table    `json:"tables"`
+	Functions []Function `json:"functions,omitempty"`
 }
 
 type Table struct {
 	CatalogNode
-	Fields []Field `json:"fields"`
+	Version int64   `json:"version,omitempty"` // Incremented by every change of the fields
+	Format  string  `json:"format,omitempty"`  // Input format the table was inferred from, e.g., csv
+	Fields  []Field `json:"fields"`
 }
 
 type Field struct {
 	CatalogNode
-	Type        string `json:"type"`
-	Description string `json:"description"`
-	Usage       string `json:"usage"`
+	Type   string `json:"type"`
+	Usage  string `json:"usage"`
+	Format string `json:"format,omitempty"` // Layout of a timestamp, in Go's time.Parse notation
 }
 
+type Function struct {
+	CatalogNode
+	IsAggregate bool     `json:"isAggregate"`
+	IsBuiltIn   bool     `json:"isBuiltIn"`
+	InputTypes  []string `json:"inputTypes"`
+	OutputType  string   `json:"outputType"`
+	OutputName  string   `json:"outputName,omitempty"`
+	LibraryPath string   `json:"libraryPath,omitempty"`
+}
+
+// Cap'n Proto has no timestamp type and no formats, so the binary catalog keeps them as reserved
+// properties that ReadCapnp turns back into the JSON attributes.
+const (
+	typeProperty   = "grizzly.type"
+	formatProperty = "grizzly.format"
+)
+
 func Example() {
 	catalog := NewCatalog(os.Stdin, os.Stdout)
 	catalog.ReadJson()
@@ -112,70 +137,188 @@ func (c *Catalog) ReadCapnp() {
 	if err != nil {
 		panic(err)
 	}
-	c.root.Id = system.Id()
-	if c.root.Name, err = system.Name(); err != nil {
-		panic(err)
-	}
+	c.root = System{CatalogNode: readNode(system, system.Properties)}
 
 	databases, err := system.Databases()
 	if err != nil {
 		panic(err)
 	}
-
 	for i := 0; i < databases.Len(); i++ {
-		var d Database
-		d.Id = databases.At(i).Id()
-		if d.Name, err = databases.At(i).Name(); err != nil {
-			panic(err)
-		}
-		schemas, err := databases.At(i).Schemas()
+		database := databases.At(i)
+		d := Database{CatalogNode: readNode(database, database.Properties)}
+
+		schemas, err := database.Schemas()
 		if err != nil {
 			panic(err)
 		}
-
 		for j := 0; j < schemas.Len(); j++ {
-			var s Schema
-			s.Id = schemas.At(j).Id()
-			if s.Name, err = schemas.At(j).Name(); err != nil {
-				panic(err)
-			}
-			tables, err := schemas.At(j).Tables()
+			schema := schemas.At(j)
+			s := Schema{CatalogNode: readNode(schema, schema.Properties)}
+
+			tables, err := schema.Tables()
 			if err != nil {
 				panic(err)
 			}
-
 			for k := 0; k < tables.Len(); k++ {
-				var t Table
-				t.Id = tables.At(k).Id()
-				if t.Name, err = tables.At(k).Name(); err != nil {
-					panic(err)
-				}
-				fields, err := tables.At(k).Fields()
+				table := tables.At(k)
+				t := Table{CatalogNode: readNode(table, table.Properties)}
+				t.Version = table.Version()
+				t.Properties, t.Format = takeProperty(t.Properties, formatProperty)
+
+				fields, err := table.Fields()
 				if err != nil {
 					panic(err)
 				}
-
-				for l := 0; l < fields.Len(); l++ {
-					var f Field
-					if f.Name, err = fields.At(l).Name(); err != nil {
-						panic(err)
-					}
-					f.Type = fields.At(l).Type().String()
-					if f.Description, err = fields.At(l).Description(); err != nil {
-						panic(err)
-					}
-					f.Usage = fields.At(l).Usage().String()
-
-					t.Fields = append(t.Fields, f)
-				}
+				t.Fields = ReadFields(fields)
 				s.Tables = append(s.Tables, t)
 			}
+
+			functions, err := schema.Functions()
+			if err != nil {
+				panic(err)
+			}
+			for k := 0; k < functions.Len(); k++ {
+				s.Functions = append(s.Functions, readFunction(functions.At(k)))
+			}
 			d.Schemas = append(d.Schemas, s)
 		}
 		c.root.Databases = append(c.root.Databases, d)
 	}
 }
 
+// ReadFields converts the fields of a binary catalog or a plan.
+func ReadFields(fields capnp.StructList[grizzly.Field]) (result []Field) {
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.At(i)
+		f := Field{CatalogNode: readNode(field, field.Properties)}
+		f.Type = field.Type().String()
+		f.Usage = field.Usage().String()
+		var typ string
+		if f.Properties, typ = takeProperty(f.Properties, typeProperty); typ != "" {
+			f.Type = typ
+		}
+		f.Properties, f.Format = takeProperty(f.Properties, formatProperty)
+		result = append(result, f)
+	}
+	return
+}
+
+func readFunction(function grizzly.Function) (f Function) {
+	var err error
+	f.CatalogNode = readNode(function, function.Properties)
+	f.IsAggregate = function.IsAggregate()
+	f.IsBuiltIn = function.IsBuiltIn()
+	var inputTypes capnp.EnumList[grizzly.FieldType]
+	if inputTypes, err = function.InputTypes(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < inputTypes.Len(); i++ {
+		f.InputTypes = append(f.InputTypes, inputTypes.At(i).String())
+	}
+	f.OutputType = function.OutputType().String()
+	if f.OutputName, err = function.OutputName(); err != nil {
+		panic(err)
+	}
+	if f.LibraryPath, err = function.LibraryPath(); err != nil {
+		panic(err)
+	}
+	return
+}
+
+// The attributes that all levels of the Cap'n Proto catalog have
+type capnpNode interface {
+	Id() int64
+	Name() (string, error)
+	Description() (string, error)
+}
+
+type capnpNodeSetter interface {
+	SetId(int64)
+	SetName(string) error
+	SetDescription(string) error
+}
+
+// Each level has its own property struct with the same fields.
+type capnpProperty interface {
+	~capnp.StructKind
+	Key() (string, error)
+	Value() (string, error)
+	SetKey(string) error
+	SetValue(string) error
+}
+
+func readNode[T capnpProperty](n capnpNode, properties func() (capnp.StructList[T], error)) (node CatalogNode) {
+	var err error
+	node.Id = n.Id()
+	if node.Name, err = n.Name(); err != nil {
+		panic(err)
+	}
+	if node.Description, err = n.Description(); err != nil {
+		panic(err)
+	}
+	var list capnp.StructList[T]
+	if list, err = properties(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < list.Len(); i++ {
+		var p Property
+		if p.Key, err = list.At(i).Key(); err != nil {
+			panic(err)
+		}
+		if p.Value, err = list.At(i).Value(); err != nil {
+			panic(err)
+		}
+		node.Properties = append(node.Properties, p)
+	}
+	return
+}
+
+func writeNode[T capnpProperty](n capnpNodeSetter, newProperties func(int32) (capnp.StructList[T], error), node CatalogNode) {
+	var err error
+	n.SetId(node.Id)
+	if err = n.SetName(node.Name); err != nil {
+		panic(err)
+	}
+	if err = n.SetDescription(node.Description); err != nil {
+		panic(err)
+	}
+	if len(node.Properties) == 0 {
+		return
+	}
+	var list capnp.StructList[T]
+	if list, err = newProperties(int32(len(node.Properties))); err != nil {
+		panic(err)
+	}
+	for i, p := range node.Properties {
+		if err = list.At(i).SetKey(p.Key); err != nil {
+			panic(err)
+		}
+		if err = list.At(i).SetValue(p.Value); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Removes the reserved property from the list and returns its value.
+func takeProperty(properties []Property, key string) (rest []Property, value string) {
+	for _, p := range properties {
+		if p.Key == key {
+			value = p.Value
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	return
+}
+
+// Returns a copy of the properties with the reserved property added unless its value is empty.
+func withProperty(properties []Property, key string, value string) []Property {
+	if value == "" {
+		return properties
+	}
+	return append(append([]Property(nil), properties...), Property{Key: key, Value: value})
+}
+
 func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
 	if err != nil {
@@ -188,9 +331,7 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 	if err != nil {
 		panic(err)
 	}
-	system.SetId(sys.Id)
-	system.SetName(sys.Name)
-	system.SetDescription(sys.Description)
+	writeNode(system, system.NewProperties, sys.CatalogNode)
 
 	databases, err := system.NewDatabases(int32(len(sys.Databases)))
 	if err != nil {
@@ -198,20 +339,15 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 	}
 	for di, d := range sys.Databases {
 		database := databases.At(di)
-		database.SetId(d.Id)
-		database.SetName(d.Name)
-		database.SetDescription(d.Description)
+		writeNode(database, database.NewProperties, d.CatalogNode)
 
 		var schemas capnp.StructList[grizzly.Schema]
 		if schemas, err = database.NewSchemas(int32(len(d.Schemas))); err != nil {
 			panic(err)
 		}
 		for si, s := range d.Schemas {
-
 			schema := schemas.At(si)
-			schema.SetId(s.Id)
-			schema.SetName(s.Name)
-			schema.SetDescription(s.Description)
+			writeNode(schema, schema.NewProperties, s.CatalogNode)
 
 			var tables capnp.StructList[grizzly.Table]
 			if tables, err = schema.NewTables(int32(len(s.Tables))); err != nil {
@@ -219,9 +355,10 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 			}
 			for ti, t := range s.Tables {
 				table := tables.At(ti)
-				table.SetId(t.Id)
-				table.SetName(t.Name)
-				table.SetDescription(t.Description)
+				tableNode := t.CatalogNode
+				tableNode.Properties = withProperty(t.Properties, formatProperty, t.Format)
+				writeNode(table, table.NewProperties, tableNode)
+				table.SetVersion(t.Version)
 
 				var fields capnp.StructList[grizzly.Field]
 				if fields, err = table.NewFields(int32(len(t.Fields))); err != nil {
@@ -234,34 +371,33 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 				csvTypes = append(csvTypes, "#")
 				for fi, f := range t.Fields {
 					field := fields.At(fi)
-
-					if field.SetName(f.Name); err != nil {
-						panic(err)
-					}
-					if field.SetType(typeToCapnpType(f.Type)); err != nil {
-						panic(err)
-					}
-					if field.SetDescription(f.Description); err != nil {
-						panic(err)
-					}
-					if field.SetUsage(usageToCapnpUsage(f.Usage)); err != nil {
-						panic(err)
-					}
-
-					if err = fields.Set(fi, field); err != nil {
-						panic(err)
+					fieldNode := f.CatalogNode
+					if f.Type == "timestamp" {
+						fieldNode.Properties = withProperty(fieldNode.Properties, typeProperty, f.Type)
 					}
+					fieldNode.Properties = withProperty(fieldNode.Properties, formatProperty, f.Format)
+					writeNode(field, field.NewProperties, fieldNode)
+					field.SetType(typeToCapnpType(f.Type))
+					field.SetUsage(usageToCapnpUsage(f.Usage))
 
 					csvFields = append(csvFields, f.Name)
 					csvTypes = append(csvTypes, f.Type)
 				}
 
-				if err = table.SetFields(fields); err != nil {
-					panic(err)
+				if csvTemplateFilePath != "" { // Empty if the caller doesn't need the templates
+					csvTemplateFileName := sys.Name + "_" + d.Name + "_" + s.Name + "_" + t.Name + ".csv"
+					WriteCsvTemplateFile(csvTemplateFilePath+"/"+csvTemplateFileName, csvFields, csvTypes)
 				}
+			}
 
-				csvTemplateFileName := sys.Name + "_" + d.Name + "_" + s.Name + "_" + t.Name + ".csv"
-				WriteCsvTemplateFile(csvTemplateFilePath+"/"+csvTemplateFileName, csvFields, csvTypes)
+			if len(s.Functions) > 0 {
+				var functions capnp.StructList[grizzly.Function]
+				if functions, err = schema.NewFunctions(int32(len(s.Functions))); err != nil {
+					panic(err)
+				}
+				for fi, f := range s.Functions {
+					writeFunction(functions.At(fi), f)
+				}
 			}
 		}
 	}
@@ -272,6 +408,101 @@ func (c *Catalog) WriteCapnp(csvTemplateFilePath string) {
 	}
 }
 
+func writeFunction(function grizzly.Function, f Function) {
+	var err error
+	writeNode(function, function.NewProperties, f.CatalogNode)
+	function.SetIsAggregate(f.IsAggregate)
+	function.SetIsBuiltIn(f.IsBuiltIn)
+	var inputTypes capnp.EnumList[grizzly.FieldType]
+	if inputTypes, err = function.NewInputTypes(int32(len(f.InputTypes))); err != nil {
+		panic(err)
+	}
+	for i, t := range f.InputTypes {
+		inputTypes.Set(i, typeToCapnpType(t))
+	}
+	function.SetOutputType(typeToCapnpType(f.OutputType))
+	if err = function.SetOutputName(f.OutputName); err != nil {
+		panic(err)
+	}
+	if err = function.SetLibraryPath(f.LibraryPath); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterTable adds a table like "system.database.schema.table" to the catalog, including the
+// database and schema if they are missing.  If the catalog has the table already, both must have
+// the same field names and types, or the new fields must be a compatible evolution of the old
+// ones, which then replace them in a new version of the table.
+func (c *Catalog) RegisterTable(fullTableName string, table Table) (err error) {
+	parts := strings.Split(fullTableName, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("table name %s must have the form system.database.schema.table", fullTableName)
+	}
+	if parts[0] != c.root.Name {
+		return fmt.Errorf("cannot find system %s of table %s", parts[0], fullTableName)
+	}
+	table.Name = parts[3]
+
+	var d *Database
+	for i := range c.root.Databases {
+		if c.root.Databases[i].Name == parts[1] {
+			d = &c.root.Databases[i]
+		}
+	}
+	if d == nil {
+		c.root.Databases = append(c.root.Databases, Database{CatalogNode: CatalogNode{Id: int64(len(c.root.Databases)) + 1, Name: parts[1]}})
+		d = &c.root.Databases[len(c.root.Databases)-1]
+	}
+
+	var s *Schema
+	for i := range d.Schemas {
+		if d.Schemas[i].Name == parts[2] {
+			s = &d.Schemas[i]
+		}
+	}
+	if s == nil {
+		d.Schemas = append(d.Schemas, Schema{CatalogNode: CatalogNode{Id: int64(len(d.Schemas)) + 1, Name: parts[2]}})
+		s = &d.Schemas[len(d.Schemas)-1]
+	}
+
+	var maxId int64
+	for i, t := range s.Tables {
+		if t.Name == table.Name {
+			if err = compareFields(fullTableName, t.Fields, table.Fields); err == nil {
+				return
+			}
+			if CheckEvolution(t.Fields, table.Fields) != nil {
+				return
+			}
+			log.Info().Msgf("table %s evolves to version %d", fullTableName, t.Version+1)
+			s.Tables[i].Fields = table.Fields
+			s.Tables[i].Version++
+			return nil
+		}
+		if t.Id > maxId {
+			maxId = t.Id
+		}
+	}
+	table.Id = maxId + 1
+	s.Tables = append(s.Tables, table)
+	return
+}
+
+func compareFields(fullTableName string, fields []Field, otherFields []Field) error {
+	if len(fields) != len(otherFields) {
+		return fmt.Errorf("table %s has %d fields in the catalog but %d in the query", fullTableName, len(fields), len(otherFields))
+	}
+	for i := range fields {
+		if fields[i].Name != otherFields[i].Name {
+			return fmt.Errorf("field %d of table %s is %s in the catalog but %s in the query", i, fullTableName, fields[i].Name, otherFields[i].Name)
+		}
+		if typeToCapnpType(fields[i].Type) != typeToCapnpType(otherFields[i].Type) {
+			return fmt.Errorf("field %s of table %s has type %s in the catalog but %s in the query", fields[i].Name, fullTableName, fields[i].Type, otherFields[i].Type)
+		}
+	}
+	return nil
+}
+
 func WriteCsvTemplateFile(filePath string, fieldNames []string, fieldType []string) {
 	var f *os.File
 	var err error
@@ -315,108 +546,3 @@ func usageToCapnpUsage(u string) grizzly.FieldUsage {
 	}
 	panic(fmt.Errorf("unknown usage: %v", u))
 }
-
-// func (c catalog) findTable(msg *capnp.Message, fullTableName string) (table grizzly.Table) {
-func FindTable(path string, fullTableName string) (msg *capnp.Message, table grizzly.Table, err error) {
-	parts := strings.Split(fullTableName, ".")
-
-	systemName := parts[0]
-	databaseName := parts[1]
-	schemaName := parts[2]
-	tableName := parts[3]
-
-	var file *os.File
-	if file, err = os.Open(path); err != nil {
-		panic(err)
-	}
-	in := bufio.NewReader(file)
-	if msg, err = capnp.NewDecoder(in).Decode(); err != nil {
-		panic(err)
-	}
-
-	// Extract the root struct from the message.
-	var y System
-	var system grizzly.System
-	if system, err = grizzly.ReadRootSystem(msg); err != nil {
-		panic(err)
-	}
-	if y.Name, err = system.Name(); err != nil {
-		panic(err)
-	}
-	if y.Name != systemName {
-		err = errors.New("cannot find system name")
-		return
-	}
-
-	var databases capnp.StructList[grizzly.Database]
-	if databases, err = system.Databases(); err != nil {
-		panic(err)
-	}
-
-	for i := 0; i < databases.Len(); i++ {
-		var d Database
-		if d.Name, err = databases.At(i).Name(); err != nil {
-			panic(err)
-		}
-		if d.Name != databaseName {
-			continue
-		}
-
-		var schemas capnp.StructList[grizzly.Schema]
-		if schemas, err = databases.At(i).Schemas(); err != nil {
-			panic(err)
-		}
-
-		for j := 0; j < schemas.Len(); j++ {
-			var s Schema
-			if s.Name, err = schemas.At(j).Name(); err != nil {
-				panic(err)
-			}
-			if s.Name != schemaName {
-				continue
-			}
-
-			var tables capnp.StructList[grizzly.Table]
-			if tables, err = schemas.At(j).Tables(); err != nil {
-				panic(err)
-			}
-
-			for k := 0; k < tables.Len(); k++ {
-				var t Table
-				if t.Name, err = tables.At(k).Name(); err != nil {
-					panic(err)
-				}
-				if t.Name == tableName {
-					return msg, tables.At(k), nil
-				}
-			}
-		}
-	}
-
-	err = errors.New("cannot find table")
-	return
-}
-
-func FindField(path string, fullTableName string, fieldName string) (msg *capnp.Message, field grizzly.Field, err error) {
-	var table grizzly.Table
-	if msg, table, err = FindTable(path, fullTableName); err != nil {
-		return
-	}
-
-	var fields grizzly.Field_List
-	if fields, err = table.Fields(); err != nil {
-		return
-	}
-
-	for i := 0; i < fields.Len(); i++ {
-		field = fields.At(i)
-		var name string
-		if name, err = field.Name(); err != nil {
-			panic(err)
-		}
-		if name == fieldName {
-			return
-		}
-	}
-	return
-}
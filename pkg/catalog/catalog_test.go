@@ -0,0 +1,71 @@
+package catalog
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// JSON -> Cap'n Proto -> JSON must keep everything, including properties, formats, and functions.
+func TestRoundTrip(t *testing.T) {
+	content, err := os.ReadFile("../../data/catalogs/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var capnpCatalog bytes.Buffer
+	original := NewCatalog(bytes.NewReader(content), &capnpCatalog)
+	original.ReadJson()
+	original.WriteCapnp("")
+	binary := append([]byte(nil), capnpCatalog.Bytes()...)
+
+	var jsonCatalog bytes.Buffer
+	roundTripped := NewCatalog(&capnpCatalog, &jsonCatalog)
+	roundTripped.ReadCapnp()
+	if !reflect.DeepEqual(original.root, roundTripped.root) {
+		t.Errorf("catalog changed in the round trip:\n%+v\n%+v", original.root, roundTripped.root)
+	}
+
+	// And back again to the same binary catalog
+	var again bytes.Buffer
+	roundTripped.writer = &again
+	roundTripped.WriteCapnp("")
+	if !bytes.Equal(binary, again.Bytes()) {
+		t.Errorf("binary catalog changed in the round trip")
+	}
+}
+
+// The compiler finds the aggregates that schemas declare, e.g., the "spread" plugin.
+func TestIndexResolvesFunction(t *testing.T) {
+	file, err := os.Open("../../data/catalogs/catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	index, err := ReadIndexJson(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullName, err := index.ResolveFunction("spread", "instance1.database1.schema1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullName != "instance1.database1.schema1.spread" {
+		t.Errorf("spread resolves to %s", fullName)
+	}
+	function, err := index.Function(fullName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if libraryPath, _ := function.LibraryPath(); !function.IsAggregate() || libraryPath != "_out/plugins/spread.so" {
+		t.Errorf("spread is aggregate %v with library %s", function.IsAggregate(), libraryPath)
+	}
+
+	var notFound *FunctionNotFoundError
+	if _, err = index.ResolveFunction("nosuchfunction", ""); !errors.As(err, &notFound) {
+		t.Errorf("unknown function gives %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// List returns the names of the children of a catalog node: the system for an empty path, the
+// databases of "system", the schemas of "system.database", or the tables of
+// "system.database.schema".
+func (c *Catalog) List(path string) (names []string, err error) {
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, ".")
+	}
+	if len(parts) == 0 {
+		return []string{c.root.Name}, nil
+	}
+	if parts[0] != c.root.Name {
+		return nil, fmt.Errorf("cannot find system %s", parts[0])
+	}
+
+	switch len(parts) {
+	case 1:
+		for _, d := range c.root.Databases {
+			names = append(names, d.Name)
+		}
+	case 2:
+		var d *Database
+		if d, err = c.database(parts); err != nil {
+			return
+		}
+		for _, s := range d.Schemas {
+			names = append(names, s.Name)
+		}
+	case 3:
+		var s *Schema
+		if s, err = c.schema(parts); err != nil {
+			return
+		}
+		for _, t := range s.Tables {
+			names = append(names, t.Name)
+		}
+	default:
+		err = fmt.Errorf("%s is not a system, database, or schema", path)
+	}
+	return
+}
+
+// Table returns a pointer to the table "system.database.schema.table" so that callers can read or
+// change it in place.
+func (c *Catalog) Table(fullTableName string) (*Table, error) {
+	parts := strings.Split(fullTableName, ".")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("table name %s must have the form system.database.schema.table", fullTableName)
+	}
+	s, err := c.schema(parts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range s.Tables {
+		if s.Tables[i].Name == parts[3] {
+			return &s.Tables[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find table %s", fullTableName)
+}
+
+func (c *Catalog) database(parts []string) (*Database, error) {
+	if parts[0] != c.root.Name {
+		return nil, fmt.Errorf("cannot find system %s", parts[0])
+	}
+	for i := range c.root.Databases {
+		if c.root.Databases[i].Name == parts[1] {
+			return &c.root.Databases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find database %s", strings.Join(parts[:2], "."))
+}
+
+func (c *Catalog) schema(parts []string) (*Schema, error) {
+	d, err := c.database(parts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range d.Schemas {
+		if d.Schemas[i].Name == parts[2] {
+			return &d.Schemas[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find schema %s", strings.Join(parts[:3], "."))
+}
+
+// AddTable adds a new table like RegisterTable but fails if the table exists already.
+func (c *Catalog) AddTable(fullTableName string, table Table) error {
+	if _, err := c.Table(fullTableName); err == nil {
+		return fmt.Errorf("table %s exists already", fullTableName)
+	}
+	for i := range table.Fields {
+		table.Fields[i].Id = int64(i)
+	}
+	return c.RegisterTable(fullTableName, table)
+}
+
+func (c *Catalog) RemoveTable(fullTableName string) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	s, _ := c.schema(strings.Split(fullTableName, "."))
+	for i := range s.Tables {
+		if &s.Tables[i] == t {
+			s.Tables = append(s.Tables[:i], s.Tables[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// RenameTable gives a table a new name in the same schema.
+func (c *Catalog) RenameTable(fullTableName string, newName string) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(fullTableName, ".")
+	if _, err = c.Table(strings.Join(append(parts[:3:3], newName), ".")); err == nil {
+		return fmt.Errorf("schema %s has a table %s already", strings.Join(parts[:3], "."), newName)
+	}
+	t.Name = newName
+	return nil
+}
+
+// AddField appends a field to a table.
+func (c *Catalog) AddField(fullTableName string, field Field) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	if _, err = t.field(field.Name); err == nil {
+		return fmt.Errorf("table %s has a field %s already", fullTableName, field.Name)
+	}
+	if err = checkTypeAndUsage(field.Type, field.Usage); err != nil {
+		return err
+	}
+	var maxId int64 = -1
+	for _, f := range t.Fields {
+		if f.Id > maxId {
+			maxId = f.Id
+		}
+	}
+	field.Id = maxId + 1
+	t.Fields = append(t.Fields, field)
+	return nil
+}
+
+func (c *Catalog) RemoveField(fullTableName string, fieldName string) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	for i := range t.Fields {
+		if t.Fields[i].Name == fieldName {
+			t.Fields = append(t.Fields[:i], t.Fields[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("table %s has no field %s", fullTableName, fieldName)
+}
+
+func (c *Catalog) RenameField(fullTableName string, fieldName string, newName string) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	if _, err = t.field(newName); err == nil {
+		return fmt.Errorf("table %s has a field %s already", fullTableName, newName)
+	}
+	var f *Field
+	if f, err = t.field(fieldName); err != nil {
+		return fmt.Errorf("table %s has no field %s", fullTableName, fieldName)
+	}
+	f.Name = newName
+	return nil
+}
+
+// SetField changes the type and usage of a field; an empty type or usage keeps the current one.
+func (c *Catalog) SetField(fullTableName string, fieldName string, fieldType string, usage string) error {
+	t, err := c.Table(fullTableName)
+	if err != nil {
+		return err
+	}
+	var f *Field
+	if f, err = t.field(fieldName); err != nil {
+		return fmt.Errorf("table %s has no field %s", fullTableName, fieldName)
+	}
+	if fieldType == "" {
+		fieldType = f.Type
+	}
+	if usage == "" {
+		usage = f.Usage
+	}
+	if err = checkTypeAndUsage(fieldType, usage); err != nil {
+		return err
+	}
+	f.Type = fieldType
+	f.Usage = usage
+	return nil
+}
+
+func (t *Table) field(name string) (*Field, error) {
+	for i := range t.Fields {
+		if t.Fields[i].Name == name {
+			return &t.Fields[i], nil
+		}
+	}
+	return nil, fmt.Errorf("table %s has no field %s", t.Name, name)
+}
+
+func checkTypeAndUsage(fieldType string, usage string) error {
+	if !fieldTypes[fieldType] {
+		return fmt.Errorf("unknown field type %s", fieldType)
+	}
+	if !fieldUsages[usage] {
+		return fmt.Errorf("unknown field usage %s", usage)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"capnproto.org/go/capnp/v3"
+	"github.com/xsnout/grizzly/capnp/grizzly"
+)
+
+// TableNotFoundError means that no table in the catalog has the name.
+type TableNotFoundError struct {
+	Name string
+}
+
+func (e *TableNotFoundError) Error() string {
+	return fmt.Sprintf("cannot find table %s", e.Name)
+}
+
+// AmbiguousTableError means that a short table name matches several tables.
+type AmbiguousTableError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousTableError) Error() string {
+	return fmt.Sprintf("table name %s is ambiguous, it matches %s; use a longer name or set the namespace", e.Name, strings.Join(e.Candidates, ", "))
+}
+
+// FieldNotFoundError means that the table has no field with the name.
+type FieldNotFoundError struct {
+	Table string
+	Field string
+}
+
+func (e *FieldNotFoundError) Error() string {
+	return fmt.Sprintf("table %s has no field %s", e.Table, e.Field)
+}
+
+// FunctionNotFoundError means that no schema in the catalog declares the function.
+type FunctionNotFoundError struct {
+	Name string
+}
+
+func (e *FunctionNotFoundError) Error() string {
+	return fmt.Sprintf("cannot find function %s", e.Name)
+}
+
+// Index is a read-only catalog in memory with its tables and functions by full name.  The compiler
+// loads it once instead of reading the catalog file for every lookup.
+type Index struct {
+	msg               *capnp.Message // Owns the tables and functions
+	fullNames         []string       // In catalog order
+	tables            map[string]grizzly.Table
+	functionFullNames []string
+	functions         map[string]grizzly.Function
+}
+
+// LoadIndex reads a binary catalog file.
+func LoadIndex(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadIndex(bufio.NewReader(file))
+}
+
+// ReadIndex reads a binary catalog.
+func ReadIndex(reader io.Reader) (*Index, error) {
+	msg, err := capnp.NewDecoder(reader).Decode()
+	if err != nil {
+		return nil, err
+	}
+	return NewIndex(msg)
+}
+
+// ReadIndexJson reads a JSON catalog.
+func ReadIndexJson(reader io.Reader) (*Index, error) {
+	var capnpCatalog bytes.Buffer
+	c := NewCatalog(reader, &capnpCatalog)
+	c.ReadJson()
+	c.WriteCapnp("")
+	return ReadIndex(&capnpCatalog)
+}
+
+// NewIndex indexes the catalog in the message.
+func NewIndex(msg *capnp.Message) (x *Index, err error) {
+	x = &Index{msg: msg, tables: make(map[string]grizzly.Table), functions: make(map[string]grizzly.Function)}
+
+	var system grizzly.System
+	if system, err = grizzly.ReadRootSystem(msg); err != nil {
+		return
+	}
+	var systemName string
+	if systemName, err = system.Name(); err != nil {
+		return
+	}
+	var databases capnp.StructList[grizzly.Database]
+	if databases, err = system.Databases(); err != nil {
+		return
+	}
+	for i := 0; i < databases.Len(); i++ {
+		var databaseName string
+		if databaseName, err = databases.At(i).Name(); err != nil {
+			return
+		}
+		var schemas capnp.StructList[grizzly.Schema]
+		if schemas, err = databases.At(i).Schemas(); err != nil {
+			return
+		}
+		for j := 0; j < schemas.Len(); j++ {
+			var schemaName string
+			if schemaName, err = schemas.At(j).Name(); err != nil {
+				return
+			}
+			var tables capnp.StructList[grizzly.Table]
+			if tables, err = schemas.At(j).Tables(); err != nil {
+				return
+			}
+			for k := 0; k < tables.Len(); k++ {
+				var tableName string
+				if tableName, err = tables.At(k).Name(); err != nil {
+					return
+				}
+				fullName := strings.Join([]string{systemName, databaseName, schemaName, tableName}, ".")
+				x.fullNames = append(x.fullNames, fullName)
+				x.tables[fullName] = tables.At(k)
+			}
+			var functions capnp.StructList[grizzly.Function]
+			if functions, err = schemas.At(j).Functions(); err != nil {
+				return
+			}
+			for k := 0; k < functions.Len(); k++ {
+				var functionName string
+				if functionName, err = functions.At(k).Name(); err != nil {
+					return
+				}
+				fullName := strings.Join([]string{systemName, databaseName, schemaName, functionName}, ".")
+				x.functionFullNames = append(x.functionFullNames, fullName)
+				x.functions[fullName] = functions.At(k)
+			}
+		}
+	}
+	return
+}
+
+// Resolve returns the full name "system.database.schema.table" of a table named by its last one to
+// four parts, e.g., "foo" or "schema.foo".  If several tables match, the one in the namespace wins,
+// e.g., "system.database"; it's an error if that still leaves more than one.
+func (x *Index) Resolve(tableName string, namespace string) (string, error) {
+	if len(strings.Split(tableName, ".")) > 4 {
+		return "", fmt.Errorf("table name %s has more than four parts", tableName)
+	}
+
+	matches := matchSuffix(x.fullNames, tableName, namespace)
+	switch len(matches) {
+	case 0:
+		return "", &TableNotFoundError{Name: tableName}
+	case 1:
+		return matches[0], nil
+	default:
+		return "", &AmbiguousTableError{Name: tableName, Candidates: matches}
+	}
+}
+
+// ResolveFunction is like Resolve for the functions that schemas declare.  The namespace is
+// typically the schema of the table that the query reads.
+func (x *Index) ResolveFunction(functionName string, namespace string) (string, error) {
+	matches := matchSuffix(x.functionFullNames, functionName, namespace)
+	switch len(matches) {
+	case 0:
+		return "", &FunctionNotFoundError{Name: functionName}
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("function name %s is ambiguous, it matches %s", functionName, strings.Join(matches, ", "))
+	}
+}
+
+func matchSuffix(fullNames []string, name string, namespace string) (matches []string) {
+	for _, fullName := range fullNames {
+		if fullName == name || strings.HasSuffix(fullName, "."+name) {
+			matches = append(matches, fullName)
+		}
+	}
+	if len(matches) > 1 && namespace != "" {
+		var inNamespace []string
+		for _, match := range matches {
+			if strings.HasPrefix(match, namespace+".") {
+				inNamespace = append(inNamespace, match)
+			}
+		}
+		if len(inNamespace) > 0 {
+			matches = inNamespace
+		}
+	}
+	return
+}
+
+// Table returns the table with the full name.
+func (x *Index) Table(fullTableName string) (table grizzly.Table, err error) {
+	var found bool
+	if table, found = x.tables[fullTableName]; !found {
+		err = &TableNotFoundError{Name: fullTableName}
+	}
+	return
+}
+
+// Field returns the field of the table with the full name.
+func (x *Index) Field(fullTableName string, fieldName string) (field grizzly.Field, err error) {
+	var table grizzly.Table
+	if table, err = x.Table(fullTableName); err != nil {
+		return
+	}
+	var fields grizzly.Field_List
+	if fields, err = table.Fields(); err != nil {
+		return
+	}
+	for i := 0; i < fields.Len(); i++ {
+		var name string
+		if name, err = fields.At(i).Name(); err != nil {
+			return
+		}
+		if name == fieldName {
+			return fields.At(i), nil
+		}
+	}
+	return grizzly.Field{}, &FieldNotFoundError{Table: fullTableName, Field: fieldName}
+}
+
+// Function returns the function with the full name "system.database.schema.function".
+func (x *Index) Function(fullFunctionName string) (function grizzly.Function, err error) {
+	var found bool
+	if function, found = x.functions[fullFunctionName]; !found {
+		err = &FunctionNotFoundError{Name: fullFunctionName}
+	}
+	return
+}
@@ -0,0 +1,361 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xsnout/grizzly/pkg/common"
+	"github.com/xsnout/grizzly/pkg/utility"
+)
+
+// Input formats that InferTable understands
+const (
+	InferFormatCsv       = "csv"
+	InferFormatJsonLines = "jsonl"
+	InferFormatSyslog    = "syslog"
+)
+
+// Timestamp layouts that InferTable recognizes, most specific first.  The engine reads timestamps
+// in RFC 3339 only, so the other ones become text that a query can parse with the layout.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+	"02/Jan/2006:15:04:05 -0700", // Common Log Format
+	time.Stamp,                   // syslog, e.g., "Jan  2 15:04:05"
+}
+
+// Preferred names of the time field if there are several timestamps
+var timeFieldNames = []string{"t", "time", "timestamp", "ts", "@timestamp", "datetime", "date"}
+
+var (
+	fieldNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// Separators of the words of an input name, e.g., in "status_code" or "@timestamp"
+	nameSeparatorPattern = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+)
+
+// A sampled column of the input
+type column struct {
+	name   string
+	values []string
+	quoted []bool // A JSON string is never a number or Boolean, even if it looks like one.
+}
+
+// InferTable samples up to maxRows rows of the input and guesses the fields of a table: their names
+// from a header line or the JSON keys in camel case, their types, and a likely time field.
+// Timestamps get the detected layout as their format.
+func InferTable(reader io.Reader, format string, maxRows int) (table Table, err error) {
+	var columns []column
+	switch format {
+	case InferFormatCsv:
+		columns, err = sampleCsv(reader, maxRows)
+	case InferFormatJsonLines:
+		columns, err = sampleJsonLines(reader, maxRows)
+	case InferFormatSyslog:
+		columns, err = sampleSyslog(reader, maxRows)
+	default:
+		err = fmt.Errorf("unknown input format %s; must be %s, %s, or %s", format, InferFormatCsv, InferFormatJsonLines, InferFormatSyslog)
+	}
+	if err != nil {
+		return
+	}
+	if len(columns) == 0 {
+		err = fmt.Errorf("cannot infer fields from empty input")
+		return
+	}
+
+	table.Format = format
+	timeField := -1
+	names := make(map[string]bool)
+	for i, c := range columns {
+		var f Field
+		f.Id = int64(i)
+		f.Name = inferFieldName(c.name, i, names)
+		f.Type, f.Format = inferType(c)
+		if f.Type == "timestamp" && f.Format != time.RFC3339Nano {
+			f.Description = fmt.Sprintf("timestamp with layout %q; parse it with timestamp(%s, %q)", f.Format, f.Name, f.Format)
+			f.Type, f.Format = "text", ""
+		}
+		f.Usage = common.FieldUsageData
+		table.Fields = append(table.Fields, f)
+
+		if f.Type == "timestamp" && (timeField < 0 || isTimeFieldName(c.name) && !isTimeFieldName(columns[timeField].name)) {
+			timeField = i
+		}
+	}
+	if timeField >= 0 {
+		table.Fields[timeField].Usage = common.FieldUsageTime
+	}
+	return
+}
+
+// inferFieldName turns the name of a column into a valid and unique field name in camel case, e.g.,
+// "status_code" into "statusCode" and "@timestamp" into "timestamp".
+func inferFieldName(name string, i int, names map[string]bool) string {
+	var words []string
+	for _, word := range nameSeparatorPattern.Split(name, -1) {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	var result string
+	for j, word := range words {
+		if j == 0 {
+			result = strings.ToLower(word[:1]) + word[1:]
+		} else {
+			result += utility.UpcaseFirstLetter(word)
+		}
+	}
+
+	switch {
+	case result == "":
+		result = "field" + strconv.Itoa(i+1)
+	case result[0] >= '0' && result[0] <= '9':
+		result = "field" + result
+	case uqlKeywords[result]:
+		result += "Field"
+	}
+	unique := result
+	for n := 2; names[unique]; n++ {
+		unique = result + strconv.Itoa(n)
+	}
+	names[unique] = true
+	return unique
+}
+
+func isTimeFieldName(name string) bool {
+	for _, n := range timeFieldNames {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the narrowest type that fits all values, and the layout if it's a timestamp.
+func inferType(c column) (typ string, format string) {
+	isBoolean, isInteger, isFloat := true, true, true
+	layouts := timestampLayouts
+	empty := true
+	for i, value := range c.values {
+		if value == "" {
+			continue
+		}
+		empty = false
+		if c.quoted[i] {
+			isBoolean, isInteger, isFloat = false, false, false
+		}
+		if value != "true" && value != "false" {
+			isBoolean = false
+		}
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			isInteger = false
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			isFloat = false
+		}
+		var matching []string
+		for _, layout := range layouts {
+			if _, err := time.Parse(layout, value); err == nil {
+				matching = append(matching, layout)
+			}
+		}
+		layouts = matching
+	}
+
+	switch {
+	case empty:
+		return "text", ""
+	case isBoolean:
+		return "boolean", ""
+	case isInteger:
+		return "integer64", ""
+	case isFloat:
+		return "float64", ""
+	case len(layouts) > 0:
+		return "timestamp", layouts[0]
+	default:
+		return "text", ""
+	}
+}
+
+// CSV with the separator of the engine.  A first line like "#|a|b" (as in the CSV templates) or a
+// first row whose values are all field names but not all of the following rows' values are is a
+// header; otherwise the fields are named field1, field2, etc.
+func sampleCsv(reader io.Reader, maxRows int) (columns []column, err error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = common.CsvSeparator
+	csvReader.FieldsPerRecord = -1
+
+	var header []string
+	var rows [][]string
+	for len(rows) < maxRows {
+		var record []string
+		if record, err = csvReader.Read(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if strings.HasPrefix(record[0], "#") {
+			if header == nil && len(rows) == 0 && record[0] == "#" {
+				header = record[1:]
+			}
+			continue // The engine skips comments as well.
+		}
+		rows = append(rows, record)
+	}
+
+	if header == nil && len(rows) > 1 && looksLikeHeader(rows[0], rows[1:]) {
+		header, rows = rows[0], rows[1:]
+	}
+	if header == nil && len(rows) > 0 {
+		for i := range rows[0] {
+			header = append(header, "field"+strconv.Itoa(i+1))
+		}
+	}
+
+	for i, name := range header {
+		c := column{name: name}
+		for _, row := range rows {
+			if i < len(row) {
+				c.values = append(c.values, row[i])
+				c.quoted = append(c.quoted, false)
+			}
+		}
+		columns = append(columns, c)
+	}
+	return
+}
+
+func looksLikeHeader(first []string, rest [][]string) bool {
+	for _, value := range first {
+		if !fieldNamePattern.MatchString(value) {
+			return false
+		}
+	}
+	// If the other rows are all names as well, the first row is probably data.
+	for _, row := range rest {
+		for _, value := range row {
+			if !fieldNamePattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JSON Lines with one flat object per line.  The fields are in the order of their first appearance;
+// nested objects and arrays become text.
+func sampleJsonLines(reader io.Reader, maxRows int) (columns []column, err error) {
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for rows := 0; rows < maxRows && scanner.Scan(); {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rows++
+
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		var token json.Token
+		if token, err = decoder.Token(); err != nil {
+			return
+		} else if token != json.Delim('{') {
+			err = fmt.Errorf("line %d is not a JSON object", rows)
+			return
+		}
+		for decoder.More() {
+			if token, err = decoder.Token(); err != nil {
+				return
+			}
+			key := token.(string)
+			var raw json.RawMessage
+			if err = decoder.Decode(&raw); err != nil {
+				return
+			}
+
+			i, found := index[key]
+			if !found {
+				i = len(columns)
+				index[key] = i
+				columns = append(columns, column{name: key})
+			}
+			value, quoted := jsonValue(raw)
+			columns[i].values = append(columns[i].values, value)
+			columns[i].quoted = append(columns[i].quoted, quoted)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func jsonValue(raw json.RawMessage) (value string, quoted bool) {
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &value); err == nil {
+			return value, true
+		}
+	}
+	if string(raw) == "null" {
+		return "", false
+	}
+	if len(raw) > 0 && (raw[0] == '{' || raw[0] == '[') {
+		return string(raw), true
+	}
+	return string(raw), false
+}
+
+var (
+	// RFC 5424, e.g., "<34>1 2003-10-11T22:14:15.003Z host app 1234 ID47 - message"
+	syslog5424Pattern = regexp.MustCompile(`^<\d{1,3}>\d (\S+) (\S+) (\S+) (\S+) \S+ (?:-|\[.*?\]) ?(.*)$`)
+
+	// RFC 3164, e.g., "<34>Oct 11 22:14:15 host su[1234]: message"
+	syslog3164Pattern = regexp.MustCompile(`^(?:<\d{1,3}>)?([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (\S+) ([^\s\[:]+)(?:\[(\d+)\])?: ?(.*)$`)
+)
+
+// Syslog lines in RFC 5424 or RFC 3164 format.  The fields are always t, host, program, pid, and
+// message; the samples only determine the layout of the timestamp and the type of the pid.
+func sampleSyslog(reader io.Reader, maxRows int) (columns []column, err error) {
+	columns = []column{{name: "t"}, {name: "host"}, {name: "program"}, {name: "pid"}, {name: "message"}}
+	scanner := bufio.NewScanner(reader)
+	for rows := 0; rows < maxRows && scanner.Scan(); {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		rows++
+
+		var matches []string
+		if matches = syslog5424Pattern.FindStringSubmatch(line); matches == nil {
+			if matches = syslog3164Pattern.FindStringSubmatch(line); matches == nil {
+				err = fmt.Errorf("line %d is not a syslog message: %s", rows, line)
+				return
+			}
+		}
+		for i := range columns {
+			value := matches[i+1]
+			if value == "-" { // RFC 5424 nil value
+				value = ""
+			}
+			columns[i].values = append(columns[i].values, value)
+			columns[i].quoted = append(columns[i].quoted, i != 3)
+		}
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,92 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xsnout/grizzly/pkg/common"
+)
+
+// inferTable infers a table and checks that the catalog can use it without edits.
+func inferTable(t *testing.T, input string, format string) Table {
+	t.Helper()
+	table, err := InferTable(strings.NewReader(input), format, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateFields("$", table); HasErrors(problems) {
+		t.Errorf("inferred table is not valid: %v", problems)
+	}
+	return table
+}
+
+func checkField(t *testing.T, field Field, name string, typ string, usage string) {
+	t.Helper()
+	if field.Name != name || field.Type != typ || field.Usage != usage {
+		t.Errorf("field is %s %s %s, expected %s %s %s", field.Name, field.Type, field.Usage, name, typ, usage)
+	}
+}
+
+func TestInferCsv(t *testing.T) {
+	table := inferTable(t, `#|status_code|@timestamp|host|latency-ms|ok
+200|2024-01-02T15:04:05Z|a|1.5|true
+503|2024-01-02T15:04:06.5Z|b|2|false
+`, InferFormatCsv)
+
+	if len(table.Fields) != 5 {
+		t.Fatalf("fields: %+v", table.Fields)
+	}
+	checkField(t, table.Fields[0], "statusCode", "integer64", common.FieldUsageData)
+	checkField(t, table.Fields[1], "timestamp", "timestamp", common.FieldUsageTime)
+	checkField(t, table.Fields[2], "host", "text", common.FieldUsageData)
+	checkField(t, table.Fields[3], "latencyMs", "float64", common.FieldUsageData)
+	checkField(t, table.Fields[4], "ok", "boolean", common.FieldUsageData)
+	if table.Fields[1].Format != time.RFC3339Nano {
+		t.Errorf("timestamp has format %s", table.Fields[1].Format)
+	}
+}
+
+func TestInferJsonLines(t *testing.T) {
+	table := inferTable(t, `{"t": "2024-01-02T15:04:05Z", "from": 3, "user.name": "alice"}
+{"t": "2024-01-02T15:04:06Z", "from": 4, "user.name": "bob", "2xx": "1"}
+`, InferFormatJsonLines)
+
+	checkField(t, table.Fields[0], "t", "timestamp", common.FieldUsageTime)
+	checkField(t, table.Fields[1], "fromField", "integer64", common.FieldUsageData)
+	checkField(t, table.Fields[2], "userName", "text", common.FieldUsageData)
+	checkField(t, table.Fields[3], "field2xx", "text", common.FieldUsageData)
+}
+
+// The engine reads RFC 3339 timestamps only, so RFC 3164 timestamps stay text.
+func TestInferSyslog(t *testing.T) {
+	table := inferTable(t, "<34>Oct 11 22:14:15 host1 su[1234]: 'su root' failed\n", InferFormatSyslog)
+	checkField(t, table.Fields[0], "t", "text", common.FieldUsageData)
+	if table.Fields[0].Format != "" || !strings.Contains(table.Fields[0].Description, `timestamp(t, "Jan _2 15:04:05")`) {
+		t.Errorf("RFC 3164 timestamp: %+v", table.Fields[0])
+	}
+	checkField(t, table.Fields[3], "pid", "integer64", common.FieldUsageData)
+
+	table = inferTable(t, "<34>1 2003-10-11T22:14:15.003Z host1 su 1234 ID47 - failed\n", InferFormatSyslog)
+	checkField(t, table.Fields[0], "t", "timestamp", common.FieldUsageTime)
+}
+
+func TestInferFieldName(t *testing.T) {
+	names := make(map[string]bool)
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"status_code", "statusCode"},
+		{"Host", "host"},
+		{"from", "fromField"},
+		{"@", "field4"},
+		{"statusCode", "statusCode2"},
+		{"status-code", "statusCode3"},
+	}
+	for i, test := range tests {
+		if actual := inferFieldName(test.name, i, names); actual != test.expected {
+			t.Errorf("%q becomes %q, expected %q", test.name, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package catalog
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/xsnout/grizzly/pkg/_out/query/parser"
+	"github.com/xsnout/grizzly/pkg/common"
+	"github.com/xsnout/grizzly/pkg/utility"
+)
+
+// Keywords of UQL that cannot be field names because the parser never takes them as identifiers
+var uqlKeywords = lexerKeywords(false)
+
+// Keywords of UQL that cannot be function names, including the names of aggregate functions
+var uqlFunctionKeywords = lexerKeywords(true)
+
+var fieldTypes = map[string]bool{"boolean": true, "float64": true, "integer64": true, "text": true, "timestamp": true}
+
+var fieldUsages = map[string]bool{
+	common.FieldUsageData: true, common.FieldUsageTime: true, common.FieldUsageGroup: true, common.FieldUsageSequence: true,
+}
+
+var (
+	// Systems, databases, schemas, and tables are parts of a dotted full table name.
+	nodeNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// Fields become Cap'n Proto fields, which must be camel case, and Go methods.
+	capnpFieldNamePattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+)
+
+// CheckFieldName tells whether a name can be a field in the generated Cap'n Proto schema, e.g., the
+// alias of a term in a query.
+func CheckFieldName(name string) error {
+	if !capnpFieldNamePattern.MatchString(name) {
+		return fmt.Errorf("field name %q must start with a lowercase letter and contain only letters and digits", name)
+	}
+	return nil
+}
+
+// lexerKeywords returns the literal tokens of the generated UQL lexer that look like names, e.g.,
+// "and" or "collect_list", so that the keywords follow the grammar. Unless withFunctionNames is set,
+// the names of aggregate functions, e.g., "rate", are left out because the grammar accepts them as
+// identifiers outside of calls.
+func lexerKeywords(withFunctionNames bool) map[string]bool {
+	keywords := make(map[string]bool)
+	lexer := parser.NewUQLLexer(antlr.NewInputStream(""))
+	functionKeyword := reflect.TypeOf(&parser.FunctionKeywordContext{})
+	for i, literal := range lexer.LiteralNames {
+		if _, ok := functionKeyword.MethodByName(lexer.SymbolicNames[i]); ok && !withFunctionNames {
+			continue
+		}
+		if keyword := strings.Trim(literal, "'"); nodeNamePattern.MatchString(keyword) {
+			keywords[keyword] = true
+		}
+	}
+	return keywords
+}
+
+// Problem is a mistake in the catalog at a JSON path like "$.databases[0].schemas[1].tables[2]".
+// A warning doesn't stop the compiler but is probably not what the author meant.
+type Problem struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return p.Path + ": warning: " + p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// HasErrors tells whether any of the problems is more than a warning.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the whole catalog and returns all problems found, or none if the compiler and
+// the code generator can use it.
+func (c *Catalog) Validate() (problems []Problem) {
+	report := func(path string, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	checkNode := func(path string, kind string, name string) {
+		if name == "" {
+			report(path, "%s has no name", kind)
+		} else if !nodeNamePattern.MatchString(name) {
+			report(path+".name", "%s name %q must be letters, digits, and underscores and must not start with a digit", kind, name)
+		}
+	}
+
+	checkDuplicates := func(path string, kind string, names []string) {
+		seen := make(map[string]int)
+		for i, name := range names {
+			if name == "" {
+				continue
+			}
+			if j, found := seen[name]; found {
+				report(fmt.Sprintf("%s[%d].name", path, i), "%s %s is a duplicate of %s[%d]", kind, name, path, j)
+			} else {
+				seen[name] = i
+			}
+		}
+	}
+
+	checkNode("$", "system", c.root.Name)
+	var databaseNames []string
+	for d, database := range c.root.Databases {
+		databasePath := fmt.Sprintf("$.databases[%d]", d)
+		checkNode(databasePath, "database", database.Name)
+		databaseNames = append(databaseNames, database.Name)
+
+		var schemaNames []string
+		for s, schema := range database.Schemas {
+			schemaPath := fmt.Sprintf("%s.schemas[%d]", databasePath, s)
+			checkNode(schemaPath, "schema", schema.Name)
+			schemaNames = append(schemaNames, schema.Name)
+
+			var tableNames []string
+			for t, table := range schema.Tables {
+				tablePath := fmt.Sprintf("%s.tables[%d]", schemaPath, t)
+				checkNode(tablePath, "table", table.Name)
+				tableNames = append(tableNames, table.Name)
+				problems = append(problems, validateFields(tablePath, table)...)
+			}
+			checkDuplicates(schemaPath+".tables", "table", tableNames)
+
+			var functionNames []string
+			for f, function := range schema.Functions {
+				functionPath := fmt.Sprintf("%s.functions[%d]", schemaPath, f)
+				checkNode(functionPath, "function", function.Name)
+				functionNames = append(functionNames, function.Name)
+				problems = append(problems, validateFunction(functionPath, function)...)
+			}
+			checkDuplicates(schemaPath+".functions", "function", functionNames)
+		}
+		checkDuplicates(databasePath+".schemas", "schema", schemaNames)
+	}
+	checkDuplicates("$.databases", "database", databaseNames)
+	return
+}
+
+func validateFields(tablePath string, table Table) (problems []Problem) {
+	report := func(path string, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(table.Fields) == 0 {
+		report(tablePath, "table %s has no fields", table.Name)
+	}
+
+	seen := make(map[string]int)
+	timeField := -1
+	for i, field := range table.Fields {
+		path := fmt.Sprintf("%s.fields[%d]", tablePath, i)
+		switch {
+		case field.Name == "":
+			report(path, "field has no name")
+		case strings.Contains(field.Name, "."):
+			report(path+".name", "field name %q must not contain dots", field.Name)
+		case uqlKeywords[field.Name]:
+			report(path+".name", "field name %s is a UQL keyword", field.Name)
+		default:
+			if err := CheckFieldName(field.Name); err != nil {
+				report(path+".name", "%v", err)
+			}
+		}
+
+		// Generated getters and setters upcase the first letter, so "a" and "A" collide.
+		if field.Name != "" {
+			key := utility.UpcaseFirstLetter(field.Name)
+			if j, found := seen[key]; found {
+				report(path+".name", "field %s is a duplicate of %s.fields[%d]", field.Name, tablePath, j)
+			} else {
+				seen[key] = i
+			}
+		}
+
+		if !fieldTypes[field.Type] {
+			report(path+".type", "unknown field type %q", field.Type)
+		}
+		if !fieldUsages[field.Usage] {
+			report(path+".usage", "unknown field usage %q", field.Usage)
+		}
+		if field.Usage == common.FieldUsageTime {
+			if field.Type != "timestamp" {
+				report(path+".type", "time field %s must have type timestamp, not %s", field.Name, field.Type)
+			}
+			// Expressions treat every time field as a timestamp, but only one of them can drive windows.
+			if timeField >= 0 {
+				problems = append(problems, Problem{
+					Path:    path + ".usage",
+					Message: fmt.Sprintf("field %s is a second time field after %s.fields[%d]", field.Name, tablePath, timeField),
+					Warning: true,
+				})
+			} else {
+				timeField = i
+			}
+		}
+	}
+	return
+}
+
+// validateFunction checks a function that a schema declares.  Queries call it by name, so the name
+// must not be a keyword, and the compiler checks calls against its types.
+func validateFunction(path string, function Function) (problems []Problem) {
+	report := func(path string, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if uqlFunctionKeywords[function.Name] {
+		report(path+".name", "function name %s is a UQL keyword", function.Name)
+	}
+	if !function.IsBuiltIn && !function.IsAggregate {
+		report(path+".isAggregate", "user-defined function %s must be an aggregate", function.Name)
+	}
+	if len(function.InputTypes) != 1 {
+		report(path+".inputTypes", "function %s must have exactly one input type, not %d", function.Name, len(function.InputTypes))
+	}
+	for i, t := range function.InputTypes {
+		if !fieldTypes[t] {
+			report(fmt.Sprintf("%s.inputTypes[%d]", path, i), "unknown field type %q", t)
+		}
+	}
+	if !fieldTypes[function.OutputType] {
+		report(path+".outputType", "unknown field type %q", function.OutputType)
+	}
+	if !function.IsBuiltIn && function.LibraryPath == "" {
+		// The engine can still have it registered at build time.
+		problems = append(problems, Problem{
+			Path:    path + ".libraryPath",
+			Message: fmt.Sprintf("user-defined function %s has no library path", function.Name),
+			Warning: true,
+		})
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+)
+
+// validate reads the catalog from JSON and returns its problems by path.
+func validate(t *testing.T, json string) map[string]Problem {
+	t.Helper()
+	c := NewCatalog(strings.NewReader(json), nil)
+	c.ReadJson()
+	problems := make(map[string]Problem)
+	for _, problem := range c.Validate() {
+		problems[problem.Path] = problem
+	}
+	return problems
+}
+
+func TestValidate(t *testing.T) {
+	problems := validate(t, `{
+  "name": "sys",
+  "databases": [{
+    "name": "db",
+    "schemas": [{
+      "name": "logs",
+      "tables": [{
+        "name": "web",
+        "fields": [
+          {"name": "t", "type": "timestamp", "usage": "time"},
+          {"name": "from", "type": "text", "usage": "data"},
+          {"name": "status_code", "type": "integer64", "usage": "data"},
+          {"name": "Status", "type": "integer64", "usage": "data"},
+          {"name": "status", "type": "int", "usage": "data"},
+          {"name": "received", "type": "timestamp", "usage": "time"}
+        ]
+      }, {
+        "name": "web",
+        "fields": []
+      }],
+      "functions": [{
+        "name": "sum",
+        "isAggregate": true,
+        "inputTypes": ["float64"],
+        "outputType": "float64",
+        "libraryPath": "sum.so"
+      }, {
+        "name": "spread",
+        "isAggregate": true,
+        "inputTypes": ["float64"],
+        "outputType": "float64"
+      }]
+    }]
+  }, {
+    "name": "2db"
+  }]
+}`)
+
+	tests := []struct {
+		path    string
+		message string
+		warning bool
+	}{
+		{"$.databases[0].schemas[0].tables[0].fields[1].name", "field name from is a UQL keyword", false},
+		{"$.databases[0].schemas[0].tables[0].fields[2].name", "must start with a lowercase letter", false},
+		{"$.databases[0].schemas[0].tables[0].fields[3].name", "must start with a lowercase letter", false},
+		{"$.databases[0].schemas[0].tables[0].fields[4].name", "duplicate of", false},
+		{"$.databases[0].schemas[0].tables[0].fields[4].type", `unknown field type "int"`, false},
+		{"$.databases[0].schemas[0].tables[0].fields[5].usage", "second time field", true},
+		{"$.databases[0].schemas[0].tables[1]", "has no fields", false},
+		{"$.databases[0].schemas[0].tables[1].name", "duplicate", false},
+		{"$.databases[0].schemas[0].functions[0].name", "function name sum is a UQL keyword", false},
+		{"$.databases[0].schemas[0].functions[1].libraryPath", "has no library path", true},
+		{"$.databases[1].name", "must not start with a digit", false},
+	}
+	for _, test := range tests {
+		problem, found := problems[test.path]
+		if !found {
+			t.Errorf("no problem at %s", test.path)
+			continue
+		}
+		if !strings.Contains(problem.Message, test.message) || problem.Warning != test.warning {
+			t.Errorf("%s: %s (warning %v), expected %s (warning %v)", test.path, problem.Message, problem.Warning, test.message, test.warning)
+		}
+	}
+	if len(problems) != len(tests) {
+		t.Errorf("%d problems, expected %d: %v", len(problems), len(tests), problems)
+	}
+}
+
+// The keywords come from the lexer, so they include those of every grammar rule.
+func TestKeywords(t *testing.T) {
+	for _, keyword := range []string{"and", "from", "filter", "group", "true", "milliseconds"} {
+		if !uqlKeywords[keyword] {
+			t.Errorf("%s is not a keyword", keyword)
+		}
+	}
+	for _, name := range []string{"host", "status", "rate", "count", "collect_list", "uniq_merge", "==", "("} {
+		if uqlKeywords[name] {
+			t.Errorf("%s is a keyword", name)
+		}
+	}
+	for _, keyword := range []string{"from", "count", "collect_list"} {
+		if !uqlFunctionKeywords[keyword] {
+			t.Errorf("%s is not a keyword for functions", keyword)
+		}
+	}
+}
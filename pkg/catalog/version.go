@@ -0,0 +1,38 @@
+package catalog
+
+import "fmt"
+
+// CheckEvolution tells whether a table with the new fields can still read the rows written with the
+// old fields and whether the queries on the old fields still compile.  Fields can only be appended
+// (older rows have no values for them), an integer64 field can widen to float64, and usages can
+// change.  Removing, renaming, reordering, or narrowing fields is not compatible.
+func CheckEvolution(old []Field, new []Field) error {
+	if len(new) < len(old) {
+		return fmt.Errorf("%d of %d fields were removed", len(old)-len(new), len(old))
+	}
+	for i := range old {
+		switch {
+		case old[i].Name != new[i].Name:
+			return fmt.Errorf("field %d was renamed from %s to %s", i, old[i].Name, new[i].Name)
+		case old[i].Type == new[i].Type:
+		case old[i].Type == "integer64" && new[i].Type == "float64":
+		default:
+			return fmt.Errorf("field %s changed its type from %s to %s", old[i].Name, old[i].Type, new[i].Type)
+		}
+	}
+	return nil
+}
+
+// IsAppendOnly tells whether the new fields are the old ones with the same types followed by more.
+// A plan for the old fields can read rows with the new fields by ignoring the appended values.
+func IsAppendOnly(old []Field, new []Field) bool {
+	if CheckEvolution(old, new) != nil {
+		return false
+	}
+	for i := range old {
+		if old[i].Type != new[i].Type {
+			return false
+		}
+	}
+	return true
+}
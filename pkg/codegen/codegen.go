@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -14,13 +15,34 @@ import (
 )
 
 const (
-	CapnpCodeFilePath    = "capnp/data/data.capnp"
-	GoCodeFilePath       = "pkg/_out/functions/functions.go"
 	GoCodeVariablePrefix = "p"
 )
 
+// Paths of the generated files relative to the working directory; grizzlyc can override them with flags.
+var (
+	CapnpCodeFilePath = "capnp/data/data.capnp"
+	GoCodeFilePath    = "pkg/_out/functions/functions.go"
+)
+
 type CapnpCode struct {
 	Body string
+
+	// Each query of the UQL file gets its own structs, e.g., "IngressPayload1" for the second one, so
+	// that the queries can use the same names for fields of different types.
+	Stages []CapnpStage
+}
+
+// CapnpStage has the fields of the structs of a single query.
+type CapnpStage struct {
+	GroupFields     []CapnpField
+	IngressFields   []CapnpField
+	AggregateFields []CapnpField
+	EgressFields    []CapnpField
+}
+
+type CapnpField struct {
+	Name string
+	Type grizzly.FieldType
 }
 
 type GoCode struct {
@@ -28,11 +50,25 @@ type GoCode struct {
 	Definitions     []string       // Golang code literals definitions
 	VariableCounter int
 
-	IngressFilter   goCodeItem
-	AggregateFilter goCodeItem
-	ProjectFilter   goCodeItem
-	SessionOpen     goCodeItem
-	SessionClose    goCodeItem
+	IngressFilter   GoCodeItem
+	AggregateFilter GoCodeItem
+	ProjectFilter   GoCodeItem
+	SessionOpen     GoCodeItem
+	SessionClose    GoCodeItem
+	SinkFilters     []GoCodeItem // One for each sink in the "to" clause
+	Globals         []string     // Package-level variables, e.g., regular expressions compiled once
+	UsesScalar      bool         // Whether the code calls functions of ScalarPackage
+
+	// Values that the engine computes from ingress rows, e.g., "sum(a * 8)", and from aggregate
+	// rows, e.g., "append a / b as x"
+	IngressExpressions   []GoCodeExpression
+	AggregateExpressions []GoCodeExpression
+}
+
+// GoCodeExpression is an expression whose value the engine needs, not just whether it's true.
+type GoCodeExpression struct {
+	Definitions []string
+	Value       string // Go code with the type of the output field, wrapped in an interface{}
 }
 
 type GoExpression struct {
@@ -52,7 +88,7 @@ const (
 	Variable
 )
 
-type goCodeItem struct {
+type GoCodeItem struct {
 	Imports     []string
 	Types       []string
 	Functions   []string
@@ -60,40 +96,64 @@ type goCodeItem struct {
 	Definitions []string // Any declarations needed for the Condition
 }
 
-func GoCodeCreateFile(code GoCode) {
+// GoCodeCreateFile writes the generated code of all queries in the UQL file into a single file.
+func GoCodeCreateFile(codes ...GoCode) {
 	var imports []string
-	imports = append(imports, goDefaultImports())
-	imports = append(imports, code.IngressFilter.Imports...)
-	imports = append(imports, code.AggregateFilter.Imports...)
-	imports = append(imports, code.ProjectFilter.Imports...)
-	imports = append(imports, code.SessionOpen.Imports...)
-	imports = append(imports, code.SessionClose.Imports...)
-
 	var types []string
-	types = append(types, goFilterType())
-	types = append(types, code.IngressFilter.Types...)
-	types = append(types, code.AggregateFilter.Types...)
-	types = append(types, code.ProjectFilter.Types...)
-	types = append(types, code.SessionOpen.Types...)
-	types = append(types, code.SessionClose.Types...)
-	types = removeDuplicates[string](types)
-
 	var functions []string
+	var globals []string
+	imports = append(imports, goDefaultImports())
+	types = append(types, goFilterType())
 	functions = append(functions, goInitFunction())
-	functions = append(functions, code.IngressFilter.Functions...)
-	functions = append(functions, code.AggregateFilter.Functions...)
-	functions = append(functions, code.ProjectFilter.Functions...)
-	functions = append(functions, code.SessionOpen.Functions...)
-	functions = append(functions, code.SessionClose.Functions...)
+
+	usesScalar := false
+	for _, code := range codes {
+		globals = append(globals, code.Globals...)
+		usesScalar = usesScalar || code.UsesScalar
+		imports = append(imports, code.IngressFilter.Imports...)
+		imports = append(imports, code.AggregateFilter.Imports...)
+		imports = append(imports, code.ProjectFilter.Imports...)
+		imports = append(imports, code.SessionOpen.Imports...)
+		imports = append(imports, code.SessionClose.Imports...)
+		for _, sinkFilter := range code.SinkFilters {
+			imports = append(imports, sinkFilter.Imports...)
+		}
+
+		types = append(types, code.IngressFilter.Types...)
+		types = append(types, code.AggregateFilter.Types...)
+		types = append(types, code.ProjectFilter.Types...)
+		types = append(types, code.SessionOpen.Types...)
+		types = append(types, code.SessionClose.Types...)
+		for _, sinkFilter := range code.SinkFilters {
+			types = append(types, sinkFilter.Types...)
+		}
+
+		functions = append(functions, code.IngressFilter.Functions...)
+		functions = append(functions, code.AggregateFilter.Functions...)
+		functions = append(functions, code.ProjectFilter.Functions...)
+		functions = append(functions, code.SessionOpen.Functions...)
+		functions = append(functions, code.SessionClose.Functions...)
+		for _, sinkFilter := range code.SinkFilters {
+			functions = append(functions, sinkFilter.Functions...)
+		}
+	}
+	types = removeDuplicates[string](types)
 	functions = removeDuplicates[string](functions)
 
 	imports = addTimeImportIfMissing(imports, types)
 	imports = addTimeImportIfMissing(imports, functions)
+	if usesScalar {
+		imports = append(imports, "import \""+ScalarPackage+"\"")
+	}
+	if len(globals) > 0 {
+		imports = append(imports, "import \"regexp\"")
+	}
 	imports = removeDuplicates[string](imports)
 
 	s := goPackage()
 	s += strings.Join(imports[:], "\n")
 	s += strings.Join(types[:], "\n")
+	s += strings.Join(globals[:], "\n")
 	s += strings.Join(functions[:], "\n")
 
 	bytes := []byte(s)
@@ -136,6 +196,7 @@ package functions
 
 func goDefaultImports() string {
 	return `
+import "fmt"
 import "os"
 import "github.com/xsnout/grizzly/capnp/data"
 import "github.com/rs/zerolog"
@@ -150,9 +211,14 @@ type Filterer interface {
   EvalSessionOpenFilter(row data.IngressRow) (pass bool)
   EvalSessionCloseFilter(row data.IngressRow) (pass bool)
   EvalProjectFilter(row data.EgressRow) (pass bool)
+  EvalSinkFilter(sink int, row data.EgressRow) (pass bool)
+  EvalIngressExpression(index int, row data.IngressRow) (value interface{})
+  EvalAggregateExpression(index int, row data.AggregateRow) (value interface{})
 }
 
-type Filter struct{}
+type Filter struct {
+  Stage int // Index of the query in the UQL file
+}
 `
 }
 
@@ -174,6 +240,7 @@ const (
 	IngressFilterType FilterType = iota
 	AggregateFilterType
 	ProjectFilterType
+	SinkFilterType
 )
 
 var (
@@ -186,8 +253,18 @@ func Init() {
 	log = zerolog.New(os.Stderr).With().Caller().Timestamp().Logger()
 }
 
-func GoInternalPayload(nodeName string, node *grizzly.Node, operatorType grizzly.OperatorType, rootNode *grizzly.Node) (code string) {
-	code += "type Internal" + nodeName + "Payload struct {\n"
+// StageSuffix distinguishes the generated functions and structs of the queries in a UQL file.  The
+// first query keeps the plain names, e.g., "evalIngressFilter", the second one gets
+// "evalIngressFilter1", etc.
+func StageSuffix(stage int) string {
+	if stage == 0 {
+		return ""
+	}
+	return strconv.Itoa(stage)
+}
+
+func GoInternalPayload(nodeName string, node *grizzly.Node, operatorType grizzly.OperatorType, rootNode *grizzly.Node, stage int) (code string) {
+	code += "type Internal" + nodeName + "Payload" + StageSuffix(stage) + " struct {\n"
 
 	var err error
 	var fields capnp.StructList[grizzly.Field]
@@ -216,14 +293,15 @@ func GoUnusedInternalPayload(name string) (code string) {
 	return
 }
 
-func GoTranslate(nodeName string, node *grizzly.Node, root *grizzly.Node) (code string) {
+func GoTranslate(nodeName string, node *grizzly.Node, root *grizzly.Node, stage int) (code string) {
 	var fields capnp.StructList[grizzly.Field]
 	var err error
 	if fields, err = node.Fields(); err != nil {
 		panic(err)
 	}
 
-	code += "func Translate" + nodeName + "Payload(in data." + nodeName + "Payload) (out Internal" + nodeName + "Payload) {\n"
+	suffix := StageSuffix(stage)
+	code += "func Translate" + nodeName + "Payload" + suffix + "(in data." + nodeName + "Payload" + suffix + ") (out Internal" + nodeName + "Payload" + suffix + ") {\n"
 
 	var name string
 	for i := 0; i < fields.Len(); i++ {
@@ -242,21 +320,108 @@ func GoTranslate(nodeName string, node *grizzly.Node, root *grizzly.Node) (code
 	return
 }
 
-func GoFilter(filterName string, payloadName string) (code string) {
+// GoFilter dispatches to the filter of the query given by the stage of the filter.
+func GoFilter(filterName string, payloadName string, numStages int) (code string) {
 	code += "func (f *Filter) Eval" + filterName + "Filter(row data." + payloadName + "Row) (pass bool) {\n"
-	code += "var err error\n"
-	code += "var payload data." + payloadName + "Payload\n"
-	code += "if payload, err = row.Payload(); err != nil {\n"
-	code += "panic(err)\n"
+	code += "switch f.Stage {\n"
+	for stage := 0; stage < numStages; stage++ {
+		suffix := StageSuffix(stage)
+		code += "case " + strconv.Itoa(stage) + ":\n"
+		code += goRowPayload(stage)
+		code += "pass = eval" + filterName + "Filter" + suffix + "(Translate" + payloadName + "Payload" + suffix + "(payload))\n"
+	}
+	code += "default:\n"
+	code += "panic(fmt.Errorf(\"unknown stage: %d\", f.Stage))\n"
+	code += "}\n"
+	code += "return\n"
+	code += "}\n"
+	return
+}
+
+// GoSinkFilter dispatches to the filter of each sink in the "to" clause, e.g., "evalSink0Filter".
+// The list has the number of sinks of each query.
+func GoSinkFilter(numSinks []int) (code string) {
+	code += "func (f *Filter) EvalSinkFilter(sink int, row data.EgressRow) (pass bool) {\n"
+	code += "switch f.Stage {\n"
+	for stage, n := range numSinks {
+		suffix := StageSuffix(stage)
+		code += "case " + strconv.Itoa(stage) + ":\n"
+		code += goRowPayload(stage)
+		code += "internalPayload := TranslateEgressPayload" + suffix + "(payload)\n"
+		code += "switch sink {\n"
+		for i := 0; i < n; i++ {
+			code += "case " + strconv.Itoa(i) + ":\n"
+			code += "pass = evalSink" + strconv.Itoa(i) + "Filter" + suffix + "(internalPayload)\n"
+		}
+		code += "default:\n"
+		code += "panic(fmt.Errorf(\"unknown sink: %d\", sink))\n"
+		code += "}\n"
+	}
+	code += "default:\n"
+	code += "panic(fmt.Errorf(\"unknown stage: %d\", f.Stage))\n"
+	code += "}\n"
+	code += "return\n"
+	code += "}\n"
+	return
+}
+
+// GoExpressionDispatch dispatches to the expressions of the query given by the stage of the filter.
+func GoExpressionDispatch(name string, payloadName string, numStages int) (code string) {
+	code += "func (f *Filter) Eval" + name + "Expression(index int, row data." + payloadName + "Row) (value interface{}) {\n"
+	code += "switch f.Stage {\n"
+	for stage := 0; stage < numStages; stage++ {
+		suffix := StageSuffix(stage)
+		code += "case " + strconv.Itoa(stage) + ":\n"
+		code += goRowPayload(stage)
+		code += "value = eval" + name + "Expression" + suffix + "(index, Translate" + payloadName + "Payload" + suffix + "(payload))\n"
+	}
+	code += "default:\n"
+	code += "panic(fmt.Errorf(\"unknown stage: %d\", f.Stage))\n"
 	code += "}\n"
-	code += "internalPayload := Translate" + payloadName + "Payload(payload)\n"
-	code += "pass = eval" + filterName + "Filter(internalPayload)\n"
 	code += "return\n"
 	code += "}\n"
 	return
 }
 
-func GoEval(filterName string, payloadName string, list []string, body string) (code string) {
+// goRowPayload declares the payload of the query in the row, e.g., "row.Payload1()" of the second one.
+func goRowPayload(stage int) (code string) {
+	suffix := StageSuffix(stage)
+	code += "payload, err := row.Payload" + suffix + "()\n"
+	code += "if err != nil {\n"
+	code += "panic(err)\n"
+	code += "}\n"
+	return
+}
+
+// GoEvalExpressions evaluates the expression of a query with the given index.
+func GoEvalExpressions(name string, payloadName string, stage int, expressions []GoCodeExpression) (code string) {
+	suffix := StageSuffix(stage)
+	code = "\nfunc eval" + name + "Expression" + suffix + "(index int, " + GoCodeVariablePrefix + " Internal" + payloadName + "Payload" + suffix + ") interface{} {\n"
+	if len(expressions) > 0 {
+		code += "switch index {\n"
+	}
+	for i, expression := range expressions {
+		code += "case " + strconv.Itoa(i) + ":\n"
+		for _, v := range expression.Definitions {
+			if strings.Contains(v, "err != nil") {
+				code += "var err error\n"
+				break
+			}
+		}
+		code += strings.Join(expression.Definitions, "")
+		code += "return " + expression.Value + "\n"
+	}
+	if len(expressions) > 0 {
+		code += "}\n"
+	} else {
+		code += "_ = " + GoCodeVariablePrefix + "\n"
+	}
+	code += "panic(fmt.Errorf(\"unknown expression: %d\", index))\n"
+	code += "}\n"
+	return
+}
+
+func GoEval(filterName string, payloadName string, stage int, list []string, body string) (code string) {
 	var header string
 	foundErr := false
 	for _, v := range list {
@@ -269,7 +434,8 @@ func GoEval(filterName string, payloadName string, list []string, body string) (
 		header = "var err error\n" + header
 	}
 
-	code = "\nfunc eval" + filterName + "Filter(" + GoCodeVariablePrefix + " Internal" + payloadName + "Payload) (pass bool) {\n"
+	suffix := StageSuffix(stage)
+	code = "\nfunc eval" + filterName + "Filter" + suffix + "(" + GoCodeVariablePrefix + " Internal" + payloadName + "Payload" + suffix + ") (pass bool) {\n"
 	code += header
 	code += "pass = " + body + "\n"
 	code += "return\n"
@@ -278,9 +444,10 @@ func GoEval(filterName string, payloadName string, list []string, body string) (
 	return
 }
 
-func GoPassthroughEvalFunction(filterName string, payloadName string) (code string) {
-	code += "// eval" + filterName + "Filter never blocks a row in the " + filterName + " filter.\n"
-	code += "func eval" + filterName + "Filter(payload Internal" + payloadName + "Payload) (pass bool) {\n"
+func GoPassthroughEvalFunction(filterName string, payloadName string, stage int) (code string) {
+	suffix := StageSuffix(stage)
+	code += "// eval" + filterName + "Filter" + suffix + " never blocks a row in the " + filterName + " filter.\n"
+	code += "func eval" + filterName + "Filter" + suffix + "(payload Internal" + payloadName + "Payload" + suffix + ") (pass bool) {\n"
 	code += "return true\n"
 	code += "}\n"
 	return
@@ -334,6 +501,16 @@ func GoFieldMapping(fieldName string, fieldType grizzly.FieldType, fieldUsage gr
 }
 
 func CapnpCreateDataFile(code CapnpCode) {
+	for stage, fields := range code.Stages {
+		suffix := StageSuffix(stage)
+		code.Body += CapnpStruct("Group"+suffix, fields.GroupFields)
+		code.Body += CapnpStruct("IngressPayload"+suffix, fields.IngressFields)
+		code.Body += CapnpStruct("AggregatePayload"+suffix, fields.AggregateFields)
+		code.Body += CapnpStruct("EgressPayload"+suffix, fields.EgressFields)
+	}
+	code.Body += CapnpStructRow("Ingress", len(code.Stages))
+	code.Body += CapnpStructRow("Aggregate", len(code.Stages))
+	code.Body += CapnpStructRow("Egress", len(code.Stages))
 	code.Body = CapnpDataCodePreamble() + code.Body
 	bytes := []byte(code.Body)
 	var err error
@@ -342,87 +519,43 @@ func CapnpCreateDataFile(code CapnpCode) {
 	}
 }
 
-func CapnpStructGroup(rootNode *grizzly.Node, fields capnp.StructList[grizzly.Field], fieldNames []string) (code string) {
-	code += "\nstruct Group {\n"
-	var name string
-	var err error
-	for i, fieldName := range fieldNames {
-		for j := 0; j < fields.Len(); j++ {
-			if name, err = fields.At(j).Name(); err != nil {
-				panic(err)
-			}
-			if fieldName == name {
-				theType := FindCatalogFieldType(rootNode, name, grizzly.OperatorType_ingress)
-				code += CapnpFieldDeclaration(fieldName, i, theType, 1)
-			}
-		}
-	}
-
-	code += "}\n"
-	return
-}
-
-func CapnpStructIngressRow(rootNode *grizzly.Node, fields capnp.StructList[grizzly.Field]) (code string) {
-	code += "\nstruct IngressRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :IngressPayload;\n"
-	code += "}\n"
-	code += "\nstruct IngressPayload {\n"
-	var name string
-	var err error
+// CapnpFields returns the names and types of the fields.  The names must be unique.
+func CapnpFields(fields capnp.StructList[grizzly.Field]) (capnpFields []CapnpField) {
+	names := make(map[string]bool)
 	for i := 0; i < fields.Len(); i++ {
+		var name string
+		var err error
 		if name, err = fields.At(i).Name(); err != nil {
 			panic(err)
 		}
-		catalogType := fields.At(i).Type().String()
-		log.Printf("1 %v (%v)", name, catalogType)
-		capnpType := FindCatalogFieldType(rootNode, name, grizzly.OperatorType_ingress)
-		log.Printf("2 %v (%v)", name, capnpType)
-		code += CapnpFieldDeclaration(name, i, capnpType, 1)
+		if names[name] {
+			panic(fmt.Errorf("field %s is defined twice", name))
+		}
+		names[name] = true
+		capnpFields = append(capnpFields, CapnpField{Name: name, Type: fields.At(i).Type()})
 	}
-	code += "}\n"
-
 	return
 }
 
-func CapnpStructAggregateRow(fields capnp.StructList[grizzly.Field]) (code string) {
-	code += "\nstruct AggregateRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :AggregatePayload;\n"
-	code += "}\n"
-	code += "\nstruct AggregatePayload {\n"
-	for i := 0; i < fields.Len(); i++ {
-		field := fields.At(i)
-		var name string
-		var err error
-		if name, err = field.Name(); err != nil {
-			panic(err)
-		}
-		typ := field.Type()
-		code += CapnpFieldDeclaration(name, i, typ, 1)
+func CapnpStruct(name string, fields []CapnpField) (code string) {
+	code += "\nstruct " + name + " {\n"
+	for i, field := range fields {
+		code += CapnpFieldDeclaration(field.Name, i, field.Type, 1)
 	}
 	code += "}\n"
 	return
 }
 
-func CapnpStructEgressRow(fields capnp.StructList[grizzly.Field]) (code string) {
-	code += "\nstruct EgressRow {\n"
-	code += "\tgroup @0 :Group;\n"
-	code += "\tpayload @1 :EgressPayload;\n"
-	code += "}\n"
-	code += "\nstruct EgressPayload {\n"
-	for i := 0; i < fields.Len(); i++ {
-		field := fields.At(i)
-		var name string
-		var err error
-		if name, err = field.Name(); err != nil {
-			panic(err)
-		}
-		typ := field.Type()
-		code += CapnpFieldDeclaration(name, i, typ, 1)
+// CapnpStructRow declares a row with the group and payload of each query, e.g., "group1" and
+// "payload1" of the second one.  A row only has those of the query that it belongs to.
+func CapnpStructRow(name string, numStages int) (code string) {
+	code += "\nstruct " + name + "Row {\n"
+	for stage := 0; stage < numStages; stage++ {
+		suffix := StageSuffix(stage)
+		code += "\tgroup" + suffix + " @" + strconv.Itoa(2*stage) + " :Group" + suffix + ";\n"
+		code += "\tpayload" + suffix + " @" + strconv.Itoa(2*stage+1) + " :" + name + "Payload" + suffix + ";\n"
 	}
 	code += "}\n"
-
 	return
 }
 
@@ -483,3 +616,130 @@ func FindCatalogFieldType(rootNode *grizzly.Node, name string, operatorType griz
 	}
 	panic(errors.New("cannot find desired field"))
 }
+
+// GoRegexp declares a package-level regular expression so that filters don't compile it per row.
+func GoRegexp(variable string, pattern string) string {
+	return "\nvar " + variable + " = regexp.MustCompile(" + strconv.Quote(pattern) + ")\n"
+}
+
+// LikeToRegexp translates a SQL "like" pattern into an anchored regular expression: "%" matches
+// any text, "_" any single character, and a backslash escapes the next character.
+func LikeToRegexp(like string) string {
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	escaped := false
+	for _, r := range like {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		b.WriteString(regexp.QuoteMeta("\\"))
+	}
+	b.WriteString(")$")
+	return b.String()
+}
+
+// GoType is the Go type of the values of the kind in the generated code.
+func (k Kind) GoType() string {
+	switch k {
+	case Boolean:
+		return "bool"
+	case Duration:
+		return "time.Duration"
+	case Float:
+		return "float64"
+	case Integer:
+		return "int64"
+	case String:
+		return "string"
+	case Timestamp:
+		return "time.Time"
+	default:
+		panic(fmt.Errorf("expression has no known type"))
+	}
+}
+
+// FieldType is the type and usage of a field that stores values of the kind.
+func (k Kind) FieldType() (grizzly.FieldType, grizzly.FieldUsage, error) {
+	switch k {
+	case Boolean:
+		return grizzly.FieldType_boolean, grizzly.FieldUsage_data, nil
+	case Float:
+		return grizzly.FieldType_float64, grizzly.FieldUsage_data, nil
+	case Integer:
+		return grizzly.FieldType_integer64, grizzly.FieldUsage_data, nil
+	case String:
+		return grizzly.FieldType_text, grizzly.FieldUsage_data, nil
+	case Timestamp:
+		return grizzly.FieldType_text, grizzly.FieldUsage_time, nil
+	default:
+		return 0, 0, fmt.Errorf("a %v cannot be stored in a field", k)
+	}
+}
+
+// GoValue converts an expression to the Go type that the setter of its field takes, e.g., an
+// integer literal to int64 and a timestamp to its RFC 3339 text.  The conversion of a timestamp
+// calls ScalarPackage.
+func GoValue(expression GoExpression) (code string, usesScalar bool) {
+	if expression.Kind == Timestamp {
+		return "scalar.String(" + expression.Code + ")", true
+	}
+	return expression.Kind.GoType() + "(" + expression.Code + ")", false
+}
+
+// GoConditional returns the first value whose condition is true, or the otherwise value, e.g., for
+// "case when a > 1 then 1 else 0 end".  All values must have the same kind except that integers and
+// floats make a float.  Without an otherwise value, it's the zero value of the kind.
+func GoConditional(conditions []string, values []GoExpression, otherwise *GoExpression) (conditional GoExpression, err error) {
+	all := values
+	if otherwise != nil {
+		all = append(all[:len(all):len(all)], *otherwise)
+	}
+	kind := all[0].Kind
+	for _, value := range all[1:] {
+		switch {
+		case value.Kind == kind:
+		case value.Kind == Float && kind == Integer, value.Kind == Integer && kind == Float:
+			kind = Float
+		default:
+			return conditional, fmt.Errorf("branches have different types: %v and %v", kind, value.Kind)
+		}
+	}
+	if kind == Variable {
+		return conditional, fmt.Errorf("branches have no known type")
+	}
+
+	convert := func(value GoExpression) string {
+		if value.Kind != kind {
+			return kind.GoType() + "(" + value.Code + ")"
+		}
+		return value.Code
+	}
+
+	code := "func() " + kind.GoType() + " {\n"
+	for i, condition := range conditions {
+		code += "if " + condition + " {\n"
+		code += "return " + convert(values[i]) + "\n"
+		code += "}\n"
+	}
+	if otherwise != nil {
+		code += "return " + convert(*otherwise) + "\n"
+	} else {
+		code += "var zero " + kind.GoType() + "\n"
+		code += "return zero\n"
+	}
+	code += "}()"
+
+	return GoExpression{Code: code, Kind: kind}, nil
+}
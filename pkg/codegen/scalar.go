@@ -0,0 +1,167 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScalarPackage has the implementations of the scalar functions that the generated code calls.
+const ScalarPackage = "github.com/xsnout/grizzly/pkg/scalar"
+
+// Signature is one way to call a scalar function: the kinds of the arguments, the kind of the
+// result, and the function in ScalarPackage that implements it.
+type Signature struct {
+	Inputs   []Kind
+	Variadic bool // The last input repeats, e.g., for "concat"
+	Output   Kind
+	GoName   string
+}
+
+// ScalarFunctions are the functions that expressions can call, by UQL name.  A function with
+// several signatures is overloaded on the kinds of its arguments.
+var ScalarFunctions = map[string][]Signature{
+	// Strings
+	"lower":      {{Inputs: []Kind{String}, Output: String, GoName: "Lower"}},
+	"upper":      {{Inputs: []Kind{String}, Output: String, GoName: "Upper"}},
+	"substr":     {{Inputs: []Kind{String, Integer, Integer}, Output: String, GoName: "Substr"}},
+	"length":     {{Inputs: []Kind{String}, Output: Integer, GoName: "Length"}},
+	"contains":   {{Inputs: []Kind{String, String}, Output: Boolean, GoName: "Contains"}},
+	"split_part": {{Inputs: []Kind{String, String, Integer}, Output: String, GoName: "SplitPart"}},
+	"concat":     {{Inputs: []Kind{String}, Variadic: true, Output: String, GoName: "Concat"}},
+
+	// Math
+	"abs": {
+		{Inputs: []Kind{Integer}, Output: Integer, GoName: "AbsInt"},
+		{Inputs: []Kind{Float}, Output: Float, GoName: "Abs"},
+	},
+	"round": {{Inputs: []Kind{Float}, Output: Float, GoName: "Round"}},
+	"floor": {{Inputs: []Kind{Float}, Output: Float, GoName: "Floor"}},
+	"ceil":  {{Inputs: []Kind{Float}, Output: Float, GoName: "Ceil"}},
+	"sqrt":  {{Inputs: []Kind{Float}, Output: Float, GoName: "Sqrt"}},
+	"log":   {{Inputs: []Kind{Float}, Output: Float, GoName: "Log"}},
+	"pow":   {{Inputs: []Kind{Float, Float}, Output: Float, GoName: "Pow"}},
+
+	// Time
+	"seconds": {
+		{Inputs: []Kind{Timestamp}, Output: Integer, GoName: "Seconds"},
+		{Inputs: []Kind{Duration}, Output: Float, GoName: "DurationSeconds"},
+	},
+	"minutes": {
+		{Inputs: []Kind{Timestamp}, Output: Integer, GoName: "Minutes"},
+		{Inputs: []Kind{Duration}, Output: Float, GoName: "DurationMinutes"},
+	},
+	"hour_of_day": {{Inputs: []Kind{Timestamp}, Output: Integer, GoName: "HourOfDay"}},
+	"day_of_week": {{Inputs: []Kind{Timestamp}, Output: Integer, GoName: "DayOfWeek"}},
+	"truncate":    {{Inputs: []Kind{Timestamp, Duration}, Output: Timestamp, GoName: "Truncate"}},
+	"format":      {{Inputs: []Kind{Timestamp, String}, Output: String, GoName: "Format"}},
+
+	// Conversions
+	"int": {
+		{Inputs: []Kind{Integer}, Output: Integer},
+		{Inputs: []Kind{Float}, Output: Integer, GoName: "IntOfFloat"},
+		{Inputs: []Kind{String}, Output: Integer, GoName: "IntOfString"},
+		{Inputs: []Kind{Boolean}, Output: Integer, GoName: "IntOfBool"},
+	},
+	"float": {
+		{Inputs: []Kind{Float}, Output: Float},
+		{Inputs: []Kind{Integer}, Output: Float, GoName: "FloatOfInt"},
+		{Inputs: []Kind{String}, Output: Float, GoName: "FloatOfString"},
+	},
+	"string": {
+		{Inputs: []Kind{String}, Output: String},
+		{Inputs: []Kind{Boolean}, Output: String, GoName: "String"},
+		{Inputs: []Kind{Float}, Output: String, GoName: "String"},
+		{Inputs: []Kind{Integer}, Output: String, GoName: "String"},
+		{Inputs: []Kind{Timestamp}, Output: String, GoName: "String"},
+	},
+	"timestamp": {
+		{Inputs: []Kind{String}, Output: Timestamp, GoName: "Timestamp"},
+		{Inputs: []Kind{String, String}, Output: Timestamp, GoName: "TimestampWithLayout"},
+	},
+}
+
+func (k Kind) String() string {
+	switch k {
+	case Boolean:
+		return "boolean"
+	case Duration:
+		return "duration"
+	case Float:
+		return "float64"
+	case Integer:
+		return "integer64"
+	case String:
+		return "text"
+	case Timestamp:
+		return "timestamp"
+	default:
+		return "unknown"
+	}
+}
+
+// GoScalarCall type checks a call of a scalar function and returns its Go code.  The first
+// signature that fits the arguments wins; an integer fits where a float is expected.  A signature
+// without a Go name is the identity, e.g., "int" of an integer, and doesn't call ScalarPackage.
+func GoScalarCall(name string, args []GoExpression) (call GoExpression, usesScalar bool, err error) {
+	signatures, found := ScalarFunctions[name]
+	if !found {
+		return call, false, fmt.Errorf("unknown function %s", name)
+	}
+
+	for _, widen := range []bool{false, true} {
+		for _, signature := range signatures {
+			var codes []string
+			if codes, found = matchSignature(signature, args, widen); !found {
+				continue
+			}
+			call.Kind = signature.Output
+			if signature.GoName == "" {
+				call.Code = codes[0]
+			} else {
+				call.Code = "scalar." + signature.GoName + "(" + strings.Join(codes, ", ") + ")"
+				usesScalar = true
+			}
+			return
+		}
+	}
+
+	var kinds []string
+	for _, arg := range args {
+		kinds = append(kinds, arg.Kind.String())
+	}
+	var expected []string
+	for _, signature := range signatures {
+		expected = append(expected, signatureString(name, signature))
+	}
+	return call, false, fmt.Errorf("cannot call %s(%s), expected %s", name, strings.Join(kinds, ", "), strings.Join(expected, " or "))
+}
+
+func matchSignature(signature Signature, args []GoExpression, widen bool) (codes []string, found bool) {
+	n := len(signature.Inputs)
+	if len(args) < n || (len(args) > n && !signature.Variadic) {
+		return nil, false
+	}
+	for i, arg := range args {
+		input := signature.Inputs[min(i, n-1)]
+		switch {
+		case arg.Kind == input:
+			codes = append(codes, arg.Code)
+		case widen && arg.Kind == Integer && input == Float:
+			codes = append(codes, "float64("+arg.Code+")")
+		default:
+			return nil, false
+		}
+	}
+	return codes, true
+}
+
+func signatureString(name string, signature Signature) string {
+	var inputs []string
+	for _, input := range signature.Inputs {
+		inputs = append(inputs, input.String())
+	}
+	if signature.Variadic {
+		inputs[len(inputs)-1] += "..."
+	}
+	return name + "(" + strings.Join(inputs, ", ") + ")"
+}
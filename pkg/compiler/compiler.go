@@ -47,15 +47,25 @@
 // projectFilterNode:    Optionally removes rows based on a condition
 // egressNode:           Transforms an input row into a format that can be read by the user of the query, e.g., CSV or JSON format
 //
+// A UQL file can have several queries where a later query reads from the "to" table of an earlier
+// one.  Each query is a stage with the above nodes; the egress node of the earlier stage becomes the
+// child of the ingress node of the later stage, and the root of the plan is the egress node of the
+// last query.  An earlier stage that several later stages read is a child of each of them, and the
+// engine runs it once.
+//
 
 package compiler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 
 	"capnproto.org/go/capnp/v3"
 	"github.com/antlr4-go/antlr/v4"
@@ -64,13 +74,29 @@ import (
 	"github.com/xsnout/grizzly/pkg/_out/query/parser"
 	"github.com/xsnout/grizzly/pkg/catalog"
 	"github.com/xsnout/grizzly/pkg/codegen"
+	"github.com/xsnout/grizzly/pkg/functor"
 	_ "github.com/xsnout/grizzly/pkg/plan"
 	"github.com/xsnout/grizzly/pkg/utility"
 )
 
 const (
-	functionsPath   = "_out/functions_code_snippet.cc"
-	CatalogFilePath = "_out/catalog.bin"
+	functionsPath = "_out/functions_code_snippet.cc"
+)
+
+// Paths relative to the working directory; grizzlyc can override them with flags.
+var (
+	CatalogFilePath     = "_out/catalog.bin"
+	CatalogJsonFilePath = "_out/catalog.json"
+
+	// Whether the compiler adds the "to" tables with full names to the catalog files
+	RegisterTables = false
+
+	// Directory for the CSV templates of the tables when the binary catalog is written; empty for none
+	CsvTemplatesDirPath = ""
+
+	// Preferred prefix like "system.database.schema" when a short table name matches several
+	// tables in the catalog
+	Namespace = ""
 )
 
 const (
@@ -80,6 +106,45 @@ const (
 	IntervalUnit          = "interval_unit"
 	SessionCloseInclusive = "session_close_inclusive"
 	SequenceFieldName     = "sequence_field_name"
+	SourceTables          = "source_tables"
+	TableVersions         = "table_versions" // "system.database.schema.table@version" per source table; empty for an earlier query
+	Stage                 = "stage"
+	SinkName              = "sink_name"
+	SinkFormat            = "sink_format"
+	SinkLocation          = "sink_location"
+)
+
+const (
+	// Field property with the index of the generated expression that computes the field
+	ExpressionProperty = "expression"
+
+	// Function properties of "percentile", "median", and "quantiles": the comma-separated
+	// quantiles, and the compression of the t-digest if it isn't the default
+	QuantilesProperty   = "quantiles"
+	CompressionProperty = "compression"
+
+	// Function properties of "cms" and "topk": the accuracy of the Count-Min Sketch if it isn't the
+	// default, and the number of values of "topk"
+	EpsilonProperty = "epsilon"
+	DeltaProperty   = "delta"
+	TopKProperty    = "k"
+
+	// Function property of "distinctcount" and "collect_list": the maximum number of values
+	LimitProperty = "limit"
+
+	// Function property of "uniq" and "hll": the precision of the HyperLogLog if it isn't the
+	// default
+	PrecisionProperty = "precision"
+)
+
+const (
+	SinkFormatCsv  = "csv"
+	SinkFormatJson = "json"
+)
+
+const (
+	// Virtual field added to the ingress rows if the query reads from several tables, e.g., "from a, b"
+	SourceFieldName = "source"
 )
 
 const (
@@ -96,10 +161,21 @@ var (
 type queryListener struct {
 	*parser.BaseUQLListener
 
-	queryPlan QueryPlan
+	queryPlan    QueryPlan
+	capnpCode    codegen.CapnpCode
+	catalogIndex *catalog.Index // Loaded once before the first query
 
-	capnpCode codegen.CapnpCode
-	goCode    codegen.GoCode
+	stages []stage                       // The compiled queries of the UQL file
+	tables map[string]*intermediateTable // The "to" tables of the compiled queries
+
+	queryState // The query that is being compiled
+}
+
+// The state of a single query; it is reset at the beginning of each query.
+type queryState struct {
+	stage      int
+	goCode     codegen.GoCode
+	capnpStage codegen.CapnpStage
 
 	sessionOpenTuple  codegen.GoExpression
 	sessionCloseTuple codegen.GoExpression
@@ -111,15 +187,65 @@ type queryListener struct {
 	sliceIntervalTypeIsDistance bool
 
 	inputTableFullName      string
+	sourceTableNames        []string
 	aggregateAliasFieldName string
 	sequenceFieldName       string
-	groupFieldNames         []string
+	groupFields             []grizzly.Field
+
+	filterType      codegen.FilterType
+	calls           []grizzly.Call
+	aggregationCall int // Index of the call of the aggregation that is being compiled
+	flagCalls       int // Calls for the flags of "distinctcount(x, limit)", which aren't aggregations
+	projections     []projection
+	sinks           []sink
+	upstreams       []grizzly.Node // Egress nodes of the earlier queries this query reads from
+	upstreamStages  []int          // Stages of the upstreams, each once even for "from a, b" of one query
+}
+
+type stage struct {
+	goCode codegen.GoCode
+	egress grizzly.Node
+	sinks  []sink
+	readBy int // Number of later queries that read the output of this query, e.g., 2 for a fan-out
+}
+
+// sinkNames names the query by its "to" tables, e.g., "minutely".
+func (s stage) sinkNames() string {
+	var names []string
+	for _, sink := range s.sinks {
+		names = append(names, sink.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// An intermediate table is the output of a query that a later query in the same UQL file reads
+// from.  Its fields are derived from the egress node, so it does not need to be in the catalog.
+type intermediateTable struct {
+	stage    int
+	egress   grizzly.Node
+	location string
+}
+
+// A column of the "append" clause, either a field of the aggregate row or a computed value.
+type projection struct {
+	name       string
+	fieldType  grizzly.FieldType
+	usage      grizzly.FieldUsage
+	expression int // Index into the aggregate expressions, or -1 for a field
+}
 
-	filterType codegen.FilterType
-	calls      []grizzly.Call
+// A sink is an output of the query, one for each table in the "to" clause.
+type sink struct {
+	name      string
+	format    string // csv or json
+	location  string // Empty means stdout
+	hasFilter bool
 }
 
 func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *QueryPlan) {
+	// Node ids are unique across all queries of the UQL file.
+	id := numOperators * int64(QueryPlan.stage)
+
 	var err error
 	if QueryPlan.root, err = grizzly.NewRootNode(seg); err != nil {
 		panic(err)
@@ -135,7 +261,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent = QueryPlan.root
 		parent.SetType(grizzly.OperatorType_egress)
 		parent.SetLabel("Egress")
-		parent.SetId(0)
+		parent.SetId(id)
 		if children, err = parent.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -148,7 +274,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_projectFilter)
 		this.SetLabel("Project Filter")
-		this.SetId(1)
+		this.SetId(id + 1)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -162,7 +288,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_project)
 		this.SetLabel("Project")
-		this.SetId(2)
+		this.SetId(id + 2)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -176,7 +302,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_aggregateFilter)
 		this.SetLabel("Aggregate Filter")
-		this.SetId(3)
+		this.SetId(id + 3)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -190,7 +316,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_aggregate)
 		this.SetLabel("Aggregate")
-		this.SetId(4)
+		this.SetId(id + 4)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -204,7 +330,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_window)
 		this.SetLabel("Window")
-		this.SetId(5)
+		this.SetId(id + 5)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -218,7 +344,7 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_ingressFilter)
 		this.SetLabel("Ingress Filter")
-		this.SetId(6)
+		this.SetId(id + 6)
 		if children, err = this.NewChildren(1); err != nil {
 			panic(err)
 		}
@@ -232,11 +358,17 @@ func NewQueryPlanTemplate(seg *capnp.Segment, msg *capnp.Message, QueryPlan *Que
 		parent.SetChildren(children)
 		this.SetType(grizzly.OperatorType_ingress)
 		this.SetLabel("Ingress")
-		this.SetId(7)
+		this.SetId(id + 7)
 		parent = this
 	}
 }
 
+func (l *queryListener) EnterQueryClause(ctx *parser.QueryClauseContext) {
+	l.queryState = queryState{stage: len(l.stages)}
+	l.queryPlan.stage = l.stage
+	NewQueryPlanTemplate(l.queryPlan.seg, l.queryPlan.msg, &l.queryPlan)
+}
+
 func (l *queryListener) ExitQueryClause(ctx *parser.QueryClauseContext) {
 	copyGroupFields(l.ingressNode(), l.ingressFilterNode())
 	copyGroupFields(l.ingressNode(), l.windowNode())
@@ -246,58 +378,202 @@ func (l *queryListener) ExitQueryClause(ctx *parser.QueryClauseContext) {
 	copyGroupFields(l.ingressNode(), l.projectFilterNode())
 	copyGroupFields(l.ingressNode(), l.egressNode())
 
-	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoTranslate("Ingress", l.ingressNode(), &l.queryPlan.root))
-	l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoTranslate("Aggregate", l.aggregateNode(), &l.queryPlan.root))
-	l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoTranslate("Egress", l.egressNode(), &l.queryPlan.root))
+	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoTranslate("Ingress", l.ingressNode(), &l.queryPlan.root, l.stage))
+	l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoTranslate("Aggregate", l.aggregateNode(), &l.queryPlan.root, l.stage))
+	l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoTranslate("Egress", l.egressNode(), &l.queryPlan.root, l.stage))
 
-	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoFilter("Ingress", "Ingress"))
-	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoFilter("SessionOpen", "Ingress"))
-	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoFilter("SessionClose", "Ingress"))
-	l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoFilter("Aggregate", "Aggregate"))
-	l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoFilter("Project", "Egress"))
-
-	l.goCode.IngressFilter.Types = append(l.goCode.IngressFilter.Types, codegen.GoInternalPayload("Ingress", l.ingressNode(), grizzly.OperatorType_ingress, &l.queryPlan.root))
-	l.goCode.AggregateFilter.Types = append(l.goCode.AggregateFilter.Types, codegen.GoInternalPayload("Aggregate", l.aggregateNode(), grizzly.OperatorType_aggregate, &l.queryPlan.root))
-	l.goCode.ProjectFilter.Types = append(l.goCode.ProjectFilter.Types, codegen.GoInternalPayload("Egress", l.egressNode(), grizzly.OperatorType_egress, &l.queryPlan.root))
+	l.goCode.IngressFilter.Types = append(l.goCode.IngressFilter.Types, codegen.GoInternalPayload("Ingress", l.ingressNode(), grizzly.OperatorType_ingress, &l.queryPlan.root, l.stage))
+	l.goCode.AggregateFilter.Types = append(l.goCode.AggregateFilter.Types, codegen.GoInternalPayload("Aggregate", l.aggregateNode(), grizzly.OperatorType_aggregate, &l.queryPlan.root, l.stage))
+	l.goCode.ProjectFilter.Types = append(l.goCode.ProjectFilter.Types, codegen.GoInternalPayload("Egress", l.egressNode(), grizzly.OperatorType_egress, &l.queryPlan.root, l.stage))
 
 	if l.hasIngressFilter {
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("Ingress", "Ingress", l.goCode.IngressFilter.Definitions, l.goCode.IngressFilter.Condition))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("Ingress", "Ingress", l.stage, l.goCode.IngressFilter.Definitions, l.goCode.IngressFilter.Condition))
 	} else {
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("Ingress", "Ingress"))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("Ingress", "Ingress", l.stage))
 	}
 
 	if l.hasSessionWindow {
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionOpen", "Ingress", l.goCode.IngressFilter.Definitions, l.goCode.SessionOpen.Condition))
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionClose", "Ingress", l.goCode.IngressFilter.Definitions, l.goCode.SessionClose.Condition))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionOpen", "Ingress", l.stage, l.goCode.SessionOpen.Definitions, l.goCode.SessionOpen.Condition))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEval("SessionClose", "Ingress", l.stage, l.goCode.SessionClose.Definitions, l.goCode.SessionClose.Condition))
 	} else {
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionOpen", "Ingress"))
-		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionClose", "Ingress"))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionOpen", "Ingress", l.stage))
+		l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoPassthroughEvalFunction("SessionClose", "Ingress", l.stage))
 	}
 
 	if l.hasAggregateFilter {
-		l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoEval("Aggregate", "Aggregate", l.goCode.AggregateFilter.Definitions, l.goCode.AggregateFilter.Condition))
+		l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoEval("Aggregate", "Aggregate", l.stage, l.goCode.AggregateFilter.Definitions, l.goCode.AggregateFilter.Condition))
 	} else {
-		l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoPassthroughEvalFunction("Aggregate", "Aggregate"))
+		l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoPassthroughEvalFunction("Aggregate", "Aggregate", l.stage))
 	}
 
 	if l.hasProjectFilter {
-		l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoEval("Project", "Egress", l.goCode.ProjectFilter.Definitions, l.goCode.ProjectFilter.Condition))
+		l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoEval("Project", "Egress", l.stage, l.goCode.ProjectFilter.Definitions, l.goCode.ProjectFilter.Condition))
 	} else {
-		l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoPassthroughEvalFunction("Project", "Egress"))
+		l.goCode.ProjectFilter.Functions = append(l.goCode.ProjectFilter.Functions, codegen.GoPassthroughEvalFunction("Project", "Egress", l.stage))
 	}
 
-	var fields capnp.StructList[grizzly.Field]
+	l.goCode.IngressFilter.Functions = append(l.goCode.IngressFilter.Functions, codegen.GoEvalExpressions("Ingress", "Ingress", l.stage, l.goCode.IngressExpressions))
+	l.goCode.AggregateFilter.Functions = append(l.goCode.AggregateFilter.Functions, codegen.GoEvalExpressions("Aggregate", "Aggregate", l.stage, l.goCode.AggregateExpressions))
+
+	for i, sink := range l.sinks {
+		filterName := "Sink" + strconv.Itoa(i)
+		sinkFilter := &l.goCode.SinkFilters[i]
+		if sink.hasFilter {
+			sinkFilter.Functions = append(sinkFilter.Functions, codegen.GoEval(filterName, "Egress", l.stage, sinkFilter.Definitions, sinkFilter.Condition))
+		} else {
+			sinkFilter.Functions = append(sinkFilter.Functions, codegen.GoPassthroughEvalFunction(filterName, "Egress", l.stage))
+		}
+	}
+
+	var fields, groupFields capnp.StructList[grizzly.Field]
 	var err error
 	if fields, err = l.ingressNode().Fields(); err != nil {
 		panic(err)
 	}
-	l.capnpCode.Body += codegen.CapnpStructGroup(&l.queryPlan.root, fields, l.groupFieldNames)
-	l.capnpCode.Body += codegen.CapnpStructIngressRow(&l.queryPlan.root, fields)
+	if groupFields, err = l.ingressNode().GroupFields(); err != nil {
+		panic(err)
+	}
+	l.capnpStage.GroupFields = codegen.CapnpFields(groupFields)
+	l.capnpStage.IngressFields = codegen.CapnpFields(fields)
+	l.capnpCode.Stages = append(l.capnpCode.Stages, l.capnpStage)
+
+	// Later queries can read from the "to" tables of this query.
+	for _, sink := range l.sinks {
+		if _, found := l.tables[sink.name]; found {
+			panic(fmt.Errorf("table %s is written by more than one query", sink.name))
+		}
+		l.tables[sink.name] = &intermediateTable{
+			stage:    l.stage,
+			egress:   *l.egressNode(),
+			location: sink.location,
+		}
+	}
+	l.stages = append(l.stages, stage{
+		goCode: l.goCode,
+		egress: *l.egressNode(),
+		sinks:  l.sinks,
+	})
+}
+
+// Generates the code for all queries after the last one has been compiled.
+func (l *queryListener) ExitStart(ctx *parser.StartContext) {
+	// The plan is a DAG that ends in the last query, i.e., the output of each other query must be
+	// read by at least one later query.
+	for i, stage := range l.stages[:len(l.stages)-1] {
+		if stage.readBy == 0 {
+			panic(fmt.Errorf("query %d writes %s, which no later query reads; only the last query may have no readers", i+1, stage.sinkNames()))
+		}
+	}
 
-	codegen.GoCodeCreateFile(l.goCode)
+	registerOutputTables(l.stages)
+
+	var numSinks []int
+	for _, stage := range l.stages {
+		numSinks = append(numSinks, len(stage.sinks))
+	}
+	var dispatch codegen.GoCode
+	dispatch.IngressFilter.Functions = append(dispatch.IngressFilter.Functions, codegen.GoFilter("Ingress", "Ingress", len(l.stages)))
+	dispatch.IngressFilter.Functions = append(dispatch.IngressFilter.Functions, codegen.GoFilter("SessionOpen", "Ingress", len(l.stages)))
+	dispatch.IngressFilter.Functions = append(dispatch.IngressFilter.Functions, codegen.GoFilter("SessionClose", "Ingress", len(l.stages)))
+	dispatch.AggregateFilter.Functions = append(dispatch.AggregateFilter.Functions, codegen.GoFilter("Aggregate", "Aggregate", len(l.stages)))
+	dispatch.IngressFilter.Functions = append(dispatch.IngressFilter.Functions, codegen.GoExpressionDispatch("Ingress", "Ingress", len(l.stages)))
+	dispatch.AggregateFilter.Functions = append(dispatch.AggregateFilter.Functions, codegen.GoExpressionDispatch("Aggregate", "Aggregate", len(l.stages)))
+	dispatch.ProjectFilter.Functions = append(dispatch.ProjectFilter.Functions, codegen.GoFilter("Project", "Egress", len(l.stages)))
+	dispatch.ProjectFilter.Functions = append(dispatch.ProjectFilter.Functions, codegen.GoSinkFilter(numSinks))
+
+	var codes []codegen.GoCode
+	codes = append(codes, dispatch)
+	for _, stage := range l.stages {
+		codes = append(codes, stage.goCode)
+	}
+
+	codegen.GoCodeCreateFile(codes...)
 	codegen.CapnpCreateDataFile(l.capnpCode)
 }
 
+// Adds the "to" tables with full names like "system.database.schema.table" to the catalog, or
+// checks that the existing tables have the same fields, if RegisterTables is set.  The fields of a
+// table are the output fields of the query followed by its group fields, in the same order as the
+// engine writes them.  It logs each table that it registers or skips.
+func registerOutputTables(stages []stage) {
+	var names []string
+	var tables []catalog.Table
+	for _, stage := range stages {
+		for _, sink := range stage.sinks {
+			if strings.Count(sink.name, ".") != 3 {
+				// Not a catalog table, e.g., the input of a later query in the same file
+				log.Info().Msgf("skipping output table %s; only full names like system.database.schema.table are registered", sink.name)
+				continue
+			}
+			names = append(names, sink.name)
+			tables = append(tables, outputTable(&stage.egress))
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	if !RegisterTables {
+		log.Info().Msgf("skipping output tables %s; grizzlyc -register adds them to the catalog", strings.Join(names, ", "))
+		return
+	}
+
+	var content []byte
+	var err error
+	if content, err = os.ReadFile(CatalogJsonFilePath); errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("cannot register the output tables; catalog %s does not exist", CatalogJsonFilePath)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	var jsonCatalog, capnpCatalog bytes.Buffer
+	c := catalog.NewCatalog(bytes.NewReader(content), &jsonCatalog)
+	c.ReadJson()
+	for i, name := range names {
+		if err = c.RegisterTable(name, tables[i]); err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("registered output table %s in %s", name, CatalogJsonFilePath)
+	}
+
+	c.WriteJson()
+	if err = os.WriteFile(CatalogJsonFilePath, jsonCatalog.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+
+	// The compiler looks up tables in the binary catalog.
+	c = catalog.NewCatalog(bytes.NewReader(jsonCatalog.Bytes()), &capnpCatalog)
+	c.ReadJson()
+	c.WriteCapnp(CsvTemplatesDirPath)
+	if err = os.WriteFile(CatalogFilePath, capnpCatalog.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+}
+
+func outputTable(egress *grizzly.Node) (table catalog.Table) {
+	var fields, groupFields capnp.StructList[grizzly.Field]
+	var err error
+	if fields, err = egress.Fields(); err != nil {
+		panic(err)
+	}
+	if groupFields, err = egress.GroupFields(); err != nil {
+		panic(err)
+	}
+	for _, list := range []capnp.StructList[grizzly.Field]{fields, groupFields} {
+		for i := 0; i < list.Len(); i++ {
+			var f catalog.Field
+			f.Id = int64(len(table.Fields))
+			if f.Name, err = list.At(i).Name(); err != nil {
+				panic(err)
+			}
+			f.Type = list.At(i).Type().String()
+			f.Usage = list.At(i).Usage().String()
+			table.Fields = append(table.Fields, f)
+		}
+	}
+	return
+}
+
 func (l *queryListener) ingressNode() *grizzly.Node {
 	return findNode(l, grizzly.OperatorType_ingress)
 }
@@ -339,11 +615,15 @@ func findNode(l *queryListener, typ grizzly.OperatorType) (node *grizzly.Node) {
 }
 
 type QueryPlan struct {
-	msg  *capnp.Message
-	seg  *capnp.Segment
-	root grizzly.Node
+	msg   *capnp.Message
+	seg   *capnp.Segment
+	root  grizzly.Node
+	stage int // The query in the UQL file whose nodes are created next
 }
 
+// Number of nodes of each query
+const numOperators = 8
+
 func Init() {
 	//zerolog.SetGlobalLevel(zerolog.Disabled)
 	//zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -352,11 +632,12 @@ func Init() {
 	utility.Init()
 }
 
-func Compile() {
+// Compile reads a UQL query and writes the binary query plan.
+func Compile(reader io.Reader, writer io.Writer) {
 	var query string
 	var bytes []byte
 	var err error
-	if bytes, err = io.ReadAll(os.Stdin); err != nil {
+	if bytes, err = io.ReadAll(reader); err != nil {
 		panic(err)
 	}
 	query = string(bytes)
@@ -372,20 +653,21 @@ func Compile() {
 
 	_ = parseQuery(msg, seg, query)
 
-	utility.WriteBinary(msg, os.Stdout)
+	utility.WriteBinary(msg, writer)
 }
 
 func parseQuery(msg *capnp.Message, seg *capnp.Segment, query string) grizzly.Node {
+	catalogIndex, err := catalog.LoadIndex(CatalogFilePath)
+	if err != nil {
+		panic(err)
+	}
 	listener := queryListener{
 		queryPlan: QueryPlan{
 			msg: msg,
 			seg: seg,
 		},
-	}
-	var err error
-	if listener.queryPlan.root, err = grizzly.NewRootNode(seg); err != nil {
-		log.Error().Err(err)
-		panic(err)
+		catalogIndex: catalogIndex,
+		tables:       make(map[string]*intermediateTable),
 	}
 
 	is := antlr.NewInputStream(query)
@@ -394,7 +676,7 @@ func parseQuery(msg *capnp.Message, seg *capnp.Segment, query string) grizzly.No
 
 	parser := parser.NewUQLParser(tokenStream)
 
-	NewQueryPlanTemplate(seg, msg, &listener.queryPlan)
+	// Each query creates its own plan template; the last one becomes the root.
 	antlr.ParseTreeWalkerDefault.Walk(&listener, parser.Start_())
 
 	return listener.queryPlan.root
@@ -434,27 +716,131 @@ func (l *queryListener) ExitEquation(c *parser.EquationContext) {
 	right, left := l.pop(), l.pop()
 
 	var code string
-	var kind codegen.Kind
-	if left.Kind == codegen.Timestamp || right.Kind == codegen.Timestamp {
+	switch {
+	case left.Kind == codegen.Timestamp && right.Kind == codegen.Timestamp:
 		code = timeCompare(c.GetOp(), left.Code, right.Code)
-		kind = codegen.Timestamp
-	} else {
+	case left.Kind == codegen.Boolean && right.Kind == codegen.Boolean:
+		if op := c.GetOp().GetTokenType(); op != parser.UQLParserEQ && op != parser.UQLParserNOT_EQ {
+			panic(fmt.Errorf("%s: cannot order booleans", c.GetText()))
+		}
 		code = defaultCompare(c.GetOp(), left.Code, right.Code)
-		kind = left.Kind
+	default:
+		leftCode, rightCode, _ := unifyKinds(c.GetText(), "compare", left, right)
+		code = defaultCompare(c.GetOp(), leftCode, rightCode)
 	}
 
 	t := codegen.GoExpression{
 		Code: code,
-		Kind: kind,
+		Kind: codegen.Boolean,
 	}
 	l.push(t)
 }
 
+func (l *queryListener) ExitLike(c *parser.LikeContext) {
+	l.pushMatch(c.GetText(), codegen.LikeToRegexp(unquote(c.GetPattern().GetText())), c.NOT() != nil)
+}
+
+func (l *queryListener) ExitRegexMatch(c *parser.RegexMatchContext) {
+	l.pushMatch(c.GetText(), unquote(c.GetPattern().GetText()), c.GetOp().GetTokenType() == parser.UQLParserNOT_MATCH)
+}
+
+// pushMatch replaces the text on the stack with a match against a regular expression that the
+// generated code compiles once at package level.
+func (l *queryListener) pushMatch(text string, pattern string, negate bool) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		panic(fmt.Errorf("%s: %w", text, err))
+	}
+	term := l.pop()
+	if term.Kind != codegen.String {
+		panic(fmt.Errorf("%s: cannot match a %v against a pattern", text, term.Kind))
+	}
+
+	variable := fmt.Sprintf("pattern%d_%d", l.stage, l.goCode.VariableCounter)
+	l.goCode.VariableCounter++
+	l.goCode.Globals = append(l.goCode.Globals, codegen.GoRegexp(variable, pattern))
+
+	code := variable + ".MatchString(" + term.Code + ")"
+	if negate {
+		code = "!" + code
+	}
+	l.push(codegen.GoExpression{Code: code, Kind: codegen.Boolean})
+}
+
+// ExitIn compares the term with each value of the list, e.g., "status in (500, 503)" becomes
+// "(p.status == 500 || p.status == 503)".
+func (l *queryListener) ExitIn(c *parser.InContext) {
+	values := make([]codegen.GoExpression, len(c.AllTerm())-1)
+	for i := len(values) - 1; i >= 0; i-- {
+		values[i] = l.pop()
+	}
+	term := l.pop()
+
+	var comparisons []string
+	for _, value := range values {
+		comparisons = append(comparisons, compareKinds(c.GetText(), term, value, "=="))
+	}
+	code := "(" + strings.Join(comparisons, " || ") + ")"
+	if c.NOT() != nil {
+		code = "!" + code
+	}
+	l.push(codegen.GoExpression{Code: code, Kind: codegen.Boolean})
+}
+
+// ExitBetween includes both bounds like SQL: "x between a and b" is "x >= a and x <= b".
+func (l *queryListener) ExitBetween(c *parser.BetweenContext) {
+	high, low, term := l.pop(), l.pop(), l.pop()
+	code := "(" + compareKinds(c.GetText(), term, low, ">=") + " && " + compareKinds(c.GetText(), term, high, "<=") + ")"
+	if c.NOT() != nil {
+		code = "!" + code
+	}
+	l.push(codegen.GoExpression{Code: code, Kind: codegen.Boolean})
+}
+
+// compareKinds type checks a comparison of two terms and returns its Go code.  An integer value
+// can be compared with a float term, but not the other way around.
+func compareKinds(text string, term codegen.GoExpression, value codegen.GoExpression, op string) string {
+	switch {
+	case term.Kind == codegen.Timestamp && value.Kind == codegen.Timestamp:
+		return term.Code + ".Compare(" + value.Code + ") " + op + " 0"
+	case term.Kind == value.Kind:
+		return term.Code + " " + op + " " + value.Code
+	case term.Kind == codegen.Float && value.Kind == codegen.Integer:
+		return term.Code + " " + op + " float64(" + value.Code + ")"
+	default:
+		panic(fmt.Errorf("%s: cannot compare a %v with a %v", text, term.Kind, value.Kind))
+	}
+}
+
+// unifyKinds type checks the operands of an arithmetic operator or a comparison and returns their Go
+// code.  The operands must have the same kind, except that an integer operand becomes a float if
+// the other one is a float.
+func unifyKinds(text string, verb string, left codegen.GoExpression, right codegen.GoExpression) (string, string, codegen.Kind) {
+	switch {
+	case left.Kind == right.Kind && left.Kind != codegen.Variable:
+		return left.Code, right.Code, left.Kind
+	case left.Kind == codegen.Float && right.Kind == codegen.Integer:
+		return left.Code, "float64(" + right.Code + ")", codegen.Float
+	case left.Kind == codegen.Integer && right.Kind == codegen.Float:
+		return "float64(" + left.Code + ")", right.Code, codegen.Float
+	default:
+		panic(fmt.Errorf("%s: cannot %s a %v and a %v", text, verb, left.Kind, right.Kind))
+	}
+}
+
+func unquote(s string) string {
+	unquoted, err := strconv.Unquote(s)
+	if err != nil {
+		panic(fmt.Errorf("cannot unquote %s: %w", s, err))
+	}
+	return unquoted
+}
+
 func (l *queryListener) ExitConnection(c *parser.ConnectionContext) {
 	right, left := l.pop(), l.pop()
-	var t codegen.GoExpression
-
-	t.Kind = right.Kind
+	if left.Kind != codegen.Boolean || right.Kind != codegen.Boolean {
+		panic(fmt.Errorf("%s: cannot connect a %v and a %v", c.GetText(), left.Kind, right.Kind))
+	}
+	t := codegen.GoExpression{Kind: codegen.Boolean}
 
 	switch c.GetOp().GetTokenType() {
 	case parser.UQLParserAND:
@@ -479,55 +865,74 @@ func (l *queryListener) ExitParenthesis(c *parser.ParenthesisContext) {
 
 func (l *queryListener) ExitNegation(c *parser.NegationContext) {
 	term := l.pop()
+	if term.Kind != codegen.Boolean {
+		panic(fmt.Errorf("%s: cannot negate a %v", c.GetText(), term.Kind))
+	}
 	tuple := codegen.GoExpression{
 		Code: "!(" + term.Code + ")",
-		Kind: term.Kind,
+		Kind: codegen.Boolean,
 	}
 	l.push(tuple)
 }
 
 func (l *queryListener) ExitMulDivMod(c *parser.MulDivModContext) {
 	right, left := l.pop(), l.pop()
+	leftCode, rightCode, kind := unifyKinds(c.GetText(), "compute with", left, right)
+	if kind != codegen.Integer && kind != codegen.Float {
+		panic(fmt.Errorf("%s: cannot compute with a %v", c.GetText(), kind))
+	}
 
 	var code string
 	switch c.GetOp().GetTokenType() {
 	case parser.UQLParserMUL:
-		code = left.Code + " * " + right.Code
+		code = leftCode + " * " + rightCode
 	case parser.UQLParserDIV:
-		code = left.Code + " / " + right.Code
+		code = leftCode + " / " + rightCode
 	case parser.UQLParserMOD:
-		code = left.Code + " % " + right.Code
+		if kind != codegen.Integer {
+			panic(fmt.Errorf("%s: the remainder needs integers", c.GetText()))
+		}
+		code = leftCode + " % " + rightCode
 	default:
 		panic(fmt.Sprintf("unexpected op: %s", c.GetOp().GetText()))
 	}
 
 	t := codegen.GoExpression{
 		Code: code,
-		Kind: right.Kind,
+		Kind: kind,
 	}
 	l.push(t)
 }
 
+// ExitAddSub adds numbers and durations, moves a timestamp by a duration, and concatenates texts.
 func (l *queryListener) ExitAddSub(c *parser.AddSubContext) {
 	right, left := l.pop(), l.pop()
+	op := c.GetOp().GetTokenType()
 
 	var code string
 	var kind codegen.Kind
 
-	if left.Kind != codegen.Duration && right.Kind == codegen.Duration {
+	if left.Kind == codegen.Timestamp && right.Kind == codegen.Duration {
 		kind = codegen.Timestamp
 		code = timeAddSub(c.GetOp(), left.Code, right.Code)
-	} else if left.Kind == codegen.Duration && right.Kind != codegen.Duration {
+	} else if left.Kind == codegen.Duration && right.Kind == codegen.Timestamp && op == parser.UQLParserADD {
 		kind = codegen.Timestamp
 		code = timeAddSub(c.GetOp(), right.Code, left.Code)
 	} else {
-		kind = right.Kind
+		var leftCode, rightCode string
+		leftCode, rightCode, kind = unifyKinds(c.GetText(), "compute with", left, right)
+		switch {
+		case kind == codegen.Integer, kind == codegen.Float, kind == codegen.Duration:
+		case kind == codegen.String && op == parser.UQLParserADD:
+		default:
+			panic(fmt.Errorf("%s: cannot compute with a %v", c.GetText(), kind))
+		}
 
-		switch c.GetOp().GetTokenType() {
+		switch op {
 		case parser.UQLParserADD:
-			code = left.Code + " + " + right.Code
+			code = leftCode + " + " + rightCode
 		case parser.UQLParserSUB:
-			code = left.Code + " - " + right.Code
+			code = leftCode + " - " + rightCode
 		default:
 			panic(fmt.Sprintf("unexpected op: %s", c.GetOp().GetText()))
 		}
@@ -540,19 +945,16 @@ func (l *queryListener) ExitAddSub(c *parser.AddSubContext) {
 	l.push(t)
 }
 
+// timeAddSub moves a timestamp by a duration; time.Time.Sub would take another timestamp.
 func timeAddSub(token antlr.Token, timestamp string, duration string) (code string) {
-	var method string
-
 	switch token.GetTokenType() {
 	case parser.UQLParserADD:
-		method = "Add"
+		code = timestamp + ".Add(" + duration + ")"
 	case parser.UQLParserSUB:
-		method = "Sub"
+		code = timestamp + ".Add(-" + duration + ")"
 	default:
 		panic(fmt.Sprintf("unexpected op: %s", token.GetText()))
 	}
-
-	code = timestamp + "." + method + "(" + duration + ")"
 	return
 }
 
@@ -635,6 +1037,8 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 		node = l.aggregateNode()
 	case codegen.ProjectFilterType:
 		node = l.projectNode()
+	case codegen.SinkFilterType:
+		node = l.egressNode()
 	default:
 		panic(fmt.Errorf("unknown filter type: %v", l.filterType))
 	}
@@ -646,7 +1050,7 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 	}
 
 	foundVariable := false
-	isTimeType := false
+	var kind codegen.Kind
 	variableName := c.GetText()
 	for i := 0; i < fields.Len(); i++ {
 		field := fields.At(i)
@@ -656,9 +1060,7 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 		}
 		if name == variableName {
 			foundVariable = true
-			if field.Usage() == grizzly.FieldUsage_time {
-				isTimeType = true
-			}
+			kind = fieldKind(field)
 			break
 		}
 	}
@@ -670,13 +1072,6 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 		panic(fmt.Errorf("could not find variable name %v in node %v", variableName, label))
 	}
 
-	var kind codegen.Kind
-	if isTimeType {
-		kind = codegen.Timestamp
-	} else {
-		kind = codegen.Variable // any other type
-	}
-
 	tuple := codegen.GoExpression{
 		Code: codegen.GoCodeVariablePrefix + "." + c.GetText(),
 		Kind: kind,
@@ -684,6 +1079,89 @@ func (l *queryListener) ExitVariable(c *parser.VariableContext) {
 	l.push(tuple)
 }
 
+// fieldKind is the kind of the Go type that the internal payloads use for the field.
+func fieldKind(field grizzly.Field) codegen.Kind {
+	if field.Usage() == grizzly.FieldUsage_time {
+		return codegen.Timestamp
+	}
+	switch field.Type() {
+	case grizzly.FieldType_boolean:
+		return codegen.Boolean
+	case grizzly.FieldType_float64:
+		return codegen.Float
+	case grizzly.FieldType_integer64:
+		return codegen.Integer
+	case grizzly.FieldType_text:
+		return codegen.String
+	default:
+		return codegen.Variable
+	}
+}
+
+func (l *queryListener) ExitTrue(c *parser.TrueContext) {
+	l.push(codegen.GoExpression{Code: "true", Kind: codegen.Boolean})
+}
+
+func (l *queryListener) ExitFalse(c *parser.FalseContext) {
+	l.push(codegen.GoExpression{Code: "false", Kind: codegen.Boolean})
+}
+
+// ExitCaseWhen turns "case when c1 then a when c2 then b else d end" into a function literal that
+// returns the value of the first true condition.
+func (l *queryListener) ExitCaseWhen(c *parser.CaseWhenContext) {
+	var otherwise *codegen.GoExpression
+	if c.GetOtherwise() != nil {
+		value := l.pop()
+		otherwise = &value
+	}
+	n := len(c.AllExpression())
+	conditions := make([]string, n)
+	values := make([]codegen.GoExpression, n)
+	for i := n - 1; i >= 0; i-- {
+		values[i] = l.pop()
+		conditions[i] = l.pop().Code
+	}
+	l.pushConditional(c.GetText(), conditions, values, otherwise)
+}
+
+// ExitIf is a short form of "case when c then a else b end".
+func (l *queryListener) ExitIf(c *parser.IfContext) {
+	otherwise, value, condition := l.pop(), l.pop(), l.pop()
+	l.pushConditional(c.GetText(), []string{condition.Code}, []codegen.GoExpression{value}, &otherwise)
+}
+
+func (l *queryListener) pushConditional(text string, conditions []string, values []codegen.GoExpression, otherwise *codegen.GoExpression) {
+	conditional, err := codegen.GoConditional(conditions, values, otherwise)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", text, err))
+	}
+	l.push(conditional)
+}
+
+// ExitFunctionCall replaces the arguments on the stack with the call of a scalar function, e.g.,
+// "lower(name)" becomes "scalar.Lower(p.name)".
+func (l *queryListener) ExitFunctionCall(c *parser.FunctionCallContext) {
+	args := make([]codegen.GoExpression, len(c.AllTerm()))
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = l.pop()
+	}
+	call, usesScalar, err := codegen.GoScalarCall(c.GetFn().GetText(), args)
+	if err != nil {
+		panic(err)
+	}
+	l.goCode.UsesScalar = l.goCode.UsesScalar || usesScalar
+	l.push(call)
+}
+
+// ExitPredicate lets a boolean term be a condition by itself, e.g., "where contains(url, \"/api\")".
+func (l *queryListener) ExitPredicate(c *parser.PredicateContext) {
+	term := l.pop()
+	if term.Kind != codegen.Boolean {
+		panic(fmt.Errorf("%s is a %v, not a condition", c.GetText(), term.Kind))
+	}
+	l.push(term)
+}
+
 func (l *queryListener) ExitTimestamp(c *parser.TimestampContext) {
 	variable := "timestamp" + strconv.Itoa(l.goCode.VariableCounter)
 	l.goCode.VariableCounter++
@@ -738,24 +1216,50 @@ func (l *queryListener) ExitDuration(ctx *parser.DurationContext) {
 func (l *queryListener) ExitFromClause(ctx *parser.FromClauseContext) {
 	node := l.ingressNode()
 
-	// Look up fields from catalog
-	l.inputTableFullName = ctx.TableName().GetText()
-	var msg *capnp.Message
-	var table grizzly.Table
-	var err error
-	if msg, table, err = catalog.FindTable(CatalogFilePath, l.inputTableFullName); err != nil {
-		panic(err)
+	// Look up fields from catalog or from an earlier query
+	allTables := ctx.AllTableName()
+	l.inputTableFullName = l.catalogTableName(allTables[0].GetText())
+	// The engine's inputs and the "source" field use the full names, however the query spells them.
+	for _, tableName := range allTables {
+		l.sourceTableNames = append(l.sourceTableNames, l.catalogTableName(tableName.GetText()))
 	}
-	// FIXME: Why do I need to read msg?
-	log.Info().Msgf("ExitFromClause: msg: %v", msg)
+	fields := l.tableFields(l.inputTableFullName)
 
-	var fields capnp.StructList[grizzly.Field]
-	if fields, err = table.Fields(); err != nil {
-		panic(err)
+	var err error
+	if len(allTables) == 1 {
+		if err = node.SetFields(fields); err != nil {
+			panic(err)
+		}
+	} else {
+		// "from a, b" or "from a union b": All tables must have the same fields.  The rows are tagged
+		// with the virtual field "source" that holds the name of the table the row was read from.
+		for _, sourceTableName := range l.sourceTableNames[1:] {
+			otherFields := l.tableFields(sourceTableName)
+			if err = checkCompatibleFields(fields, otherFields); err != nil {
+				panic(fmt.Errorf("cannot union table %s with table %s: %v", sourceTableName, l.inputTableFullName, err))
+			}
+		}
+		setFieldsWithSource(node, fields)
+	}
+	var tableVersions []string
+	for _, tableName := range l.sourceTableNames {
+		tableVersions = append(tableVersions, l.tableVersion(tableName))
 	}
+	setIngressProperties(node, l.sourceTableNames, tableVersions, l.stage)
 
-	if err = node.SetFields(fields); err != nil {
-		panic(err)
+	if len(l.upstreams) > 0 {
+		var children capnp.StructList[grizzly.Node]
+		if children, err = node.NewChildren(int32(len(l.upstreams))); err != nil {
+			panic(err)
+		}
+		for i, upstream := range l.upstreams {
+			if err = children.Set(i, upstream); err != nil {
+				panic(err)
+			}
+		}
+		if err = node.SetChildren(children); err != nil {
+			panic(err)
+		}
 	}
 
 	//
@@ -766,98 +1270,266 @@ func (l *queryListener) ExitFromClause(ctx *parser.FromClauseContext) {
 	l.filterType = codegen.IngressFilterType
 }
 
-func (l *queryListener) ExitGroupClause(ctx *parser.GroupClauseContext) {
-	allGroups := ctx.Groups().AllGroupName()
-	for i := 0; i < len(allGroups); i++ {
-		group := allGroups[i]
-		fieldName := group.GetText()
-		l.groupFieldNames = append(l.groupFieldNames, fieldName)
-	}
-
-	node := l.ingressNode()
-
-	var fields capnp.StructList[grizzly.Field]
-	var err error
-	if fields, err = node.Fields(); err != nil {
-		panic(err)
+// Returns the full name of a table in the catalog, or the name itself if an earlier query writes
+// to the table.
+func (l *queryListener) catalogTableName(tableName string) string {
+	if _, found := l.tables[tableName]; found {
+		return tableName
 	}
-
-	var groupFields capnp.StructList[grizzly.Field]
-	if groupFields, err = node.NewGroupFields(int32(len(l.groupFieldNames))); err != nil {
+	fullTableName, err := l.catalogIndex.Resolve(tableName, Namespace)
+	if err != nil {
 		panic(err)
 	}
+	return fullTableName
+}
 
-	for g, groupFieldName := range l.groupFieldNames {
-		for i := 0; i < fields.Len(); i++ {
-			field := fields.At(i)
-			var name string
-			if name, err = field.Name(); err != nil {
-				panic(err)
-			}
-			if name == groupFieldName {
-				if err = groupFields.Set(g, field); err != nil {
-					panic(err)
-				}
-			}
-		}
+// Returns the full name and version of a catalog table, e.g., "sys.db.schema.foo@2", that the
+// engine checks against the catalog at startup, or "" if an earlier query writes to the table.
+func (l *queryListener) tableVersion(tableName string) string {
+	if _, found := l.tables[tableName]; found {
+		return ""
 	}
-
-	if err = node.SetGroupFields(groupFields); err != nil {
+	fullTableName := l.catalogTableName(tableName)
+	table, err := l.catalogIndex.Table(fullTableName)
+	if err != nil {
 		panic(err)
 	}
+	return fullTableName + "@" + strconv.FormatInt(table.Version(), 10)
 }
 
-func (l *queryListener) ExitAggregations(ctx *parser.AggregationsContext) {
-	aggregations := ctx.AllAggregation()
-	n := len(aggregations)
-
+// Returns the fields of a table from the catalog or, if an earlier query writes to the table, the
+// output fields of that query followed by its group fields.
+func (l *queryListener) tableFields(tableName string) (fields capnp.StructList[grizzly.Field]) {
 	var err error
-	if n != len(l.calls) {
-		err = errors.New("number of aggregations are inconsistent")
-		panic(err)
+	table, found := l.tables[tableName]
+	if !found {
+		var catalogTable grizzly.Table
+		if catalogTable, err = l.catalogIndex.Table(l.catalogTableName(tableName)); err != nil {
+			panic(err)
+		}
+		if fields, err = catalogTable.Fields(); err != nil {
+			panic(err)
+		}
+		return
 	}
 
-	node := l.aggregateNode()
-
-	var calls capnp.StructList[grizzly.Call]
-	if calls, err = node.NewCalls(int32(n)); err != nil {
-		panic(err)
+	if table.location != "" {
+		panic(fmt.Errorf("table %s is read by a later query and cannot have a location", tableName))
 	}
-	for i, v := range l.calls {
-		if err = calls.Set(i, v); err != nil {
-			panic(err)
-		}
+	if !slices.Contains(l.upstreamStages, table.stage) {
+		l.stages[table.stage].readBy++
+		l.upstreams = append(l.upstreams, table.egress)
+		l.upstreamStages = append(l.upstreamStages, table.stage)
 	}
-	if err = node.SetCalls(calls); err != nil {
+
+	var outputFields, groupFields capnp.StructList[grizzly.Field]
+	if outputFields, err = table.egress.Fields(); err != nil {
 		panic(err)
 	}
-
-	// Copy each outfield and add it to the fields of this node
-	var fields capnp.StructList[grizzly.Field]
-	if fields, err = node.NewFields(int32(calls.Len())); err != nil {
+	if groupFields, err = table.egress.GroupFields(); err != nil {
 		panic(err)
 	}
-
-	if calls, err = node.Calls(); err != nil {
+	if fields, err = grizzly.NewField_List(l.queryPlan.seg, int32(outputFields.Len()+groupFields.Len())); err != nil {
 		panic(err)
 	}
-	for i := 0; i < calls.Len(); i++ {
-		call := calls.At(i)
-		var field grizzly.Field
-		if field, err = call.OutputField(); err != nil {
+	for i := 0; i < outputFields.Len(); i++ {
+		if err = fields.Set(i, outputFields.At(i)); err != nil {
 			panic(err)
 		}
-		if err = fields.Set(i, field); err != nil {
+	}
+	for i := 0; i < groupFields.Len(); i++ {
+		if err = fields.Set(outputFields.Len()+i, groupFields.At(i)); err != nil {
 			panic(err)
 		}
 	}
-
-	if node.SetFields(fields); err != nil {
-		panic(err)
-	}
-
-	l.capnpCode.Body += codegen.CapnpStructAggregateRow(fields)
-	l.capnpCode.Body += codegen.CapnpStructEgressRow(fields)
+	return
+}
+
+// Two tables are compatible if they have the same field names and types in the same order.
+func checkCompatibleFields(fields capnp.StructList[grizzly.Field], otherFields capnp.StructList[grizzly.Field]) (err error) {
+	if fields.Len() != otherFields.Len() {
+		return fmt.Errorf("different number of fields: %d vs. %d", fields.Len(), otherFields.Len())
+	}
+	for i := 0; i < fields.Len(); i++ {
+		var name, otherName string
+		if name, err = fields.At(i).Name(); err != nil {
+			return
+		}
+		if otherName, err = otherFields.At(i).Name(); err != nil {
+			return
+		}
+		if name != otherName {
+			return fmt.Errorf("field %d has different names: %s vs. %s", i, name, otherName)
+		}
+		if fields.At(i).Type() != otherFields.At(i).Type() {
+			return fmt.Errorf("field %s has different types: %v vs. %v", name, fields.At(i).Type(), otherFields.At(i).Type())
+		}
+	}
+	return
+}
+
+// Copies the table fields to the ingress node and appends the virtual "source" field.
+func setFieldsWithSource(node *grizzly.Node, fields capnp.StructList[grizzly.Field]) {
+	var err error
+	var newFields capnp.StructList[grizzly.Field]
+	if newFields, err = node.NewFields(int32(fields.Len() + 1)); err != nil {
+		panic(err)
+	}
+	copyFieldsHelper(&fields, &newFields)
+
+	for i := 0; i < fields.Len(); i++ {
+		var name string
+		if name, err = fields.At(i).Name(); err != nil {
+			panic(err)
+		}
+		if name == SourceFieldName {
+			panic(fmt.Errorf("field name %s is reserved for the name of the source table", SourceFieldName))
+		}
+	}
+
+	source := newFields.At(fields.Len())
+	if err = source.SetName(SourceFieldName); err != nil {
+		panic(err)
+	}
+	if err = source.SetDescription("name of the table the row was read from"); err != nil {
+		panic(err)
+	}
+	source.SetType(grizzly.FieldType_text)
+	source.SetUsage(grizzly.FieldUsage_data)
+
+	if err = node.SetFields(newFields); err != nil {
+		panic(err)
+	}
+}
+
+func setIngressProperties(node *grizzly.Node, tableNames []string, tableVersions []string, stage int) {
+	keyValues := [][2]string{
+		{SourceTables, strings.Join(tableNames, ",")},
+		{TableVersions, strings.Join(tableVersions, ",")},
+		{Stage, strconv.Itoa(stage)},
+	}
+	var properties capnp.StructList[grizzly.OperatorProperty]
+	var err error
+	if properties, err = node.NewProperties(int32(len(keyValues))); err != nil {
+		panic(err)
+	}
+	for i, kv := range keyValues {
+		property := properties.At(i)
+		if err = property.SetKey(kv[0]); err != nil {
+			panic(err)
+		}
+		if err = property.SetValue(kv[1]); err != nil {
+			panic(err)
+		}
+	}
+	if err = node.SetProperties(properties); err != nil {
+		panic(err)
+	}
+}
+
+// ExitGroupKey adds a key of the group clause: an ingress field like "host", or a term with an alias
+// like "lower(host) as h" that the engine computes for each row.
+func (l *queryListener) ExitGroupKey(ctx *parser.GroupKeyContext) {
+	var err error
+	name := ctx.GroupName().GetText()
+	for _, field := range l.groupFields {
+		var fieldName string
+		if fieldName, err = field.Name(); err != nil {
+			panic(err)
+		}
+		if fieldName == name {
+			panic(fmt.Errorf("duplicate group key %s", name))
+		}
+	}
+
+	if ctx.Term() == nil {
+		field, found := findField(l.ingressNode(), name)
+		if !found {
+			panic(fmt.Errorf("cannot find group field %s", name))
+		}
+		l.groupFields = append(l.groupFields, field)
+		return
+	}
+
+	if err = catalog.CheckFieldName(name); err != nil {
+		panic(fmt.Errorf("group key %s: %w", ctx.GetText(), err))
+	}
+	field := l.expressionInput(ctx.Term().GetText(), l.pop())
+	if err = field.SetName(name); err != nil {
+		panic(err)
+	}
+	l.groupFields = append(l.groupFields, field)
+}
+
+func (l *queryListener) ExitGroupClause(ctx *parser.GroupClauseContext) {
+	node := l.ingressNode()
+
+	var groupFields capnp.StructList[grizzly.Field]
+	var err error
+	if groupFields, err = node.NewGroupFields(int32(len(l.groupFields))); err != nil {
+		panic(err)
+	}
+	for g, field := range l.groupFields {
+		if err = groupFields.Set(g, field); err != nil {
+			panic(err)
+		}
+	}
+
+	if err = node.SetGroupFields(groupFields); err != nil {
+		panic(err)
+	}
+}
+
+func (l *queryListener) ExitAggregations(ctx *parser.AggregationsContext) {
+	aggregations := ctx.AllAggregation()
+	n := len(aggregations)
+
+	var err error
+	if n+l.flagCalls != len(l.calls) {
+		err = errors.New("number of aggregations are inconsistent")
+		panic(err)
+	}
+
+	node := l.aggregateNode()
+
+	var calls capnp.StructList[grizzly.Call]
+	if calls, err = node.NewCalls(int32(len(l.calls))); err != nil {
+		panic(err)
+	}
+	for i, v := range l.calls {
+		if err = calls.Set(i, v); err != nil {
+			panic(err)
+		}
+	}
+	if err = node.SetCalls(calls); err != nil {
+		panic(err)
+	}
+
+	// Copy each outfield and add it to the fields of this node
+	var fields capnp.StructList[grizzly.Field]
+	if fields, err = node.NewFields(int32(calls.Len())); err != nil {
+		panic(err)
+	}
+
+	if calls, err = node.Calls(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < calls.Len(); i++ {
+		call := calls.At(i)
+		var field grizzly.Field
+		if field, err = call.OutputField(); err != nil {
+			panic(err)
+		}
+		if err = fields.Set(i, field); err != nil {
+			panic(err)
+		}
+	}
+
+	if node.SetFields(fields); err != nil {
+		panic(err)
+	}
+
+	l.capnpStage.AggregateFields = codegen.CapnpFields(fields)
 }
 
 func (l *queryListener) EnterAggregateClause(ctx *parser.AggregateClauseContext) {
@@ -870,29 +1542,228 @@ func (l *queryListener) ExitAggregateClause(ctx *parser.AggregateClauseContext)
 
 func (l *queryListener) EnterAggregation(ctx *parser.AggregationContext) {
 	l.aggregateAliasFieldName = ctx.FieldName().GetText()
+	l.aggregationCall = len(l.calls)
+	if err := catalog.CheckFieldName(l.aggregateAliasFieldName); err != nil {
+		panic(fmt.Errorf("aggregate %s: %w", l.aggregateAliasFieldName, err))
+	}
+}
+
+// ExitAggregation adds the filter of a call like "count() filter (where status >= 500) as errors".
+// The aggregate function only sees the rows for which the condition is true, and so does its flag,
+// e.g., of "distinctcount(x, limit)".
+func (l *queryListener) ExitAggregation(ctx *parser.AggregationContext) {
+	if ctx.Expression() == nil {
+		return
+	}
+	condition := l.pop()
+	if condition.Kind != codegen.Boolean {
+		panic(fmt.Errorf("the filter of %s is not a condition: %s", l.aggregateAliasFieldName, ctx.Expression().GetText()))
+	}
+	filter := l.expressionInput(ctx.Expression().GetText(), condition)
+	for _, call := range l.calls[l.aggregationCall:] {
+		if err := call.SetFilter(filter); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func (l *queryListener) ExitAggregateAverage(ctx *parser.AggregateAverageContext) {
 	outputType := grizzly.FieldType_float64
-	l.addAggregateFunction("average", ctx.FieldName().GetText(), &outputType)
+	l.addAggregateFunction("average", l.aggregateInput("average", ctx.Term()), &outputType)
+}
+
+func (l *queryListener) ExitAggregateMean(ctx *parser.AggregateMeanContext) {
+	outputType := grizzly.FieldType_float64
+	l.addAggregateFunction("average", l.aggregateInput("average", ctx.Term()), &outputType)
 }
 
+// ExitAggregateCount counts every row, e.g., "count(host)", but a boolean field is a condition, so
+// "count(ok)" counts the rows for which it is true like "count(ok == true)".
 func (l *queryListener) ExitAggregateCount(ctx *parser.AggregateCountContext) {
 	outputType := grizzly.FieldType_integer64
-	//l.addAggregateFunction("count", ctx.FieldName().GetText(), &outputType)
-	l.addAggregateFunction("count", "N/A -- count(*)", &outputType)
+	name := ctx.FieldName().GetText()
+	if field, found := findField(l.ingressNode(), name); found && fieldKind(field) == codegen.Boolean {
+		condition := codegen.GoExpression{Code: codegen.GoCodeVariablePrefix + "." + name, Kind: codegen.Boolean}
+		l.addAggregateFunction("count", l.expressionInput(name, condition), &outputType)
+		return
+	}
+	l.addAggregateFunction("count", l.aggregateInputField("count", "N/A -- count(*)"), &outputType)
+}
+
+func (l *queryListener) ExitAggregateCountWithoutAsterisk(ctx *parser.AggregateCountWithoutAsteriskContext) {
+	outputType := grizzly.FieldType_integer64
+	l.addAggregateFunction("count", l.aggregateInputField("count", "N/A -- count(*)"), &outputType)
+}
+
+// ExitAggregateCountIf counts the rows for which a condition is true, e.g., "count(status >= 500)".
+func (l *queryListener) ExitAggregateCountIf(ctx *parser.AggregateCountIfContext) {
+	condition := l.pop()
+	if condition.Kind != codegen.Boolean {
+		panic(fmt.Errorf("cannot count %s: it is a %v, not a condition", ctx.Expression().GetText(), condition.Kind))
+	}
+	outputType := grizzly.FieldType_integer64
+	l.addAggregateFunction("count", l.expressionInput(ctx.Expression().GetText(), condition), &outputType)
+}
+
+func (l *queryListener) ExitAggregateMedian(ctx *parser.AggregateMedianContext) {
+	l.addQuantileFunction("percentile", l.aggregateInput("median", ctx.Term()), []string{"0.5"}, ctx.GetCompression())
+}
+
+func (l *queryListener) ExitAggregatePercentile(ctx *parser.AggregatePercentileContext) {
+	quantiles := []string{ctx.GetQuantile().GetText()}
+	l.addQuantileFunction("percentile", l.aggregateInput("percentile", ctx.Term()), quantiles, ctx.GetCompression())
+}
+
+func (l *queryListener) ExitAggregateQuantiles(ctx *parser.AggregateQuantilesContext) {
+	var quantiles []string
+	for _, quantile := range ctx.AllFLOAT() {
+		quantiles = append(quantiles, quantile.GetText())
+	}
+	l.addQuantileFunction("quantiles", l.aggregateInput("quantiles", ctx.Term()), quantiles, ctx.GetCompression())
+}
+
+func (l *queryListener) ExitAggregateVariance(ctx *parser.AggregateVarianceContext) {
+	l.addStatisticsFunction("variance", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateVariancePopulation(ctx *parser.AggregateVariancePopulationContext) {
+	l.addStatisticsFunction("var_pop", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateStandardDeviation(ctx *parser.AggregateStandardDeviationContext) {
+	l.addStatisticsFunction("stddev", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateStandardDeviationPopulation(ctx *parser.AggregateStandardDeviationPopulationContext) {
+	l.addStatisticsFunction("stddev_pop", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateSkewness(ctx *parser.AggregateSkewnessContext) {
+	l.addStatisticsFunction("skewness", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateKurtosis(ctx *parser.AggregateKurtosisContext) {
+	l.addStatisticsFunction("kurtosis", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateCovariance(ctx *parser.AggregateCovarianceContext) {
+	l.addStatisticsFunction("covariance", ctx.Term(0), ctx.Term(1))
+}
+
+func (l *queryListener) ExitAggregateCovariancePopulation(ctx *parser.AggregateCovariancePopulationContext) {
+	l.addStatisticsFunction("covar_pop", ctx.Term(0), ctx.Term(1))
+}
+
+func (l *queryListener) ExitAggregateCorrelation(ctx *parser.AggregateCorrelationContext) {
+	l.addStatisticsFunction("corr", ctx.Term(0), ctx.Term(1))
+}
+
+func (l *queryListener) ExitAggregateIncrease(ctx *parser.AggregateIncreaseContext) {
+	l.addChangeFunction("increase", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateRate(ctx *parser.AggregateRateContext) {
+	l.addChangeFunction("rate", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateDelta(ctx *parser.AggregateDeltaContext) {
+	l.addChangeFunction("delta", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateDerivative(ctx *parser.AggregateDerivativeContext) {
+	l.addChangeFunction("deriv", ctx.Term())
+}
+
+func (l *queryListener) ExitAggregateCountMinSketch(ctx *parser.AggregateCountMinSketchContext) {
+	l.addSketchFunction("cms", l.aggregateInput("cms", ctx.Term()), nil, ctx.GetEpsilon(), ctx.GetDelta())
+}
+
+func (l *queryListener) ExitAggregateTopK(ctx *parser.AggregateTopKContext) {
+	l.addSketchFunction("topk", l.aggregateInput("topk", ctx.Term()), ctx.GetK(), ctx.GetEpsilon(), ctx.GetDelta())
+}
+
+// ExitAggregateDistinctCount counts the distinct values exactly.  With a limit, e.g.,
+// "distinctcount(user, 100000) as users", it estimates the count beyond that many values with a
+// HyperLogLog of an optional precision, and the output gets a flag "usersApproximate" that tells if
+// it did.
+func (l *queryListener) ExitAggregateDistinctCount(ctx *parser.AggregateDistinctCountContext) {
+	field := l.aggregateInput("distinctcount", ctx.Term())
+	outputType := grizzly.FieldType_integer64
+	if ctx.GetLimit() == nil {
+		l.addAggregateFunction("distinctcount", field, &outputType)
+		return
+	}
+	keyValues := [][2]string{{LimitProperty, checkLimit("distinctcount", ctx.GetLimit())}}
+	if ctx.GetPrecision() != nil {
+		keyValues = append(keyValues, [2]string{PrecisionProperty, checkPrecision("distinctcount", ctx.GetPrecision())})
+	}
+	l.addAggregateCall(l.newBuiltInFunction("distinctcount", keyValues...), []grizzly.Field{field}, &outputType)
+
+	alias := l.aggregateAliasFieldName
+	l.aggregateAliasFieldName = alias + "Approximate"
+	flagType := grizzly.FieldType_boolean
+	l.addAggregateCall(l.newBuiltInFunction("approximate"), []grizzly.Field{field}, &flagType)
+	l.aggregateAliasFieldName = alias
+	l.flagCalls++
+}
+
+func (l *queryListener) ExitAggregateCollectSet(ctx *parser.AggregateCollectSetContext) {
+	outputType := grizzly.FieldType_text
+	l.addAggregateFunction("collect_set", l.aggregateInput("collect_set", ctx.Term()), &outputType)
+}
+
+func (l *queryListener) ExitAggregateCollectList(ctx *parser.AggregateCollectListContext) {
+	field := l.aggregateInput("collect_list", ctx.Term())
+	limit := checkLimit("collect_list", ctx.GetLimit())
+	outputType := grizzly.FieldType_text
+	l.addAggregateCall(l.newBuiltInFunction("collect_list", [2]string{LimitProperty, limit}), []grizzly.Field{field}, &outputType)
+}
+
+func (l *queryListener) ExitAggregateUnique(ctx *parser.AggregateUniqueContext) {
+	l.addUniqueFunction("unique", l.aggregateInput("unique", ctx.Term()), ctx.GetPrecision())
+}
+
+func (l *queryListener) ExitAggregateHyperLogLog(ctx *parser.AggregateHyperLogLogContext) {
+	l.addUniqueFunction("hll", l.aggregateInput("hll", ctx.Term()), ctx.GetPrecision())
+}
+
+// ExitAggregateUniqueMerge estimates the number of distinct values from the sketches of "hll" of an
+// earlier query, e.g., per-minute sketches of users merged into the number of users of an hour.
+func (l *queryListener) ExitAggregateUniqueMerge(ctx *parser.AggregateUniqueMergeContext) {
+	field := l.aggregateInput("uniq_merge", ctx.Term())
+	if field.Type() != grizzly.FieldType_text {
+		name, err := field.Name()
+		if err != nil {
+			panic(err)
+		}
+		panic(fmt.Errorf("uniq_merge takes a sketch of hll, but %s is a %v", name, field.Type()))
+	}
+	outputType := grizzly.FieldType_integer64
+	l.addAggregateFunction("uniq_merge", field, &outputType)
+}
+
+func (l *queryListener) ExitAggregateMaximum(ctx *parser.AggregateMaximumContext) {
+	l.addAggregateFunction("maximum", l.aggregateInput("maximum", ctx.Term()), nil)
+}
+
+func (l *queryListener) ExitAggregateMinimum(ctx *parser.AggregateMinimumContext) {
+	l.addAggregateFunction("minimum", l.aggregateInput("minimum", ctx.Term()), nil)
 }
 
 func (l *queryListener) ExitAggregateSum(ctx *parser.AggregateSumContext) {
-	l.addAggregateFunction("sum", ctx.FieldName().GetText(), nil)
+	l.addAggregateFunction("sum", l.aggregateInput("sum", ctx.Term()), nil)
 }
 
 func (l *queryListener) ExitAggregateFirst(ctx *parser.AggregateFirstContext) {
-	l.addAggregateFunction("first", ctx.FieldName().GetText(), nil)
+	l.addAggregateFunction("first", l.aggregateInput("first", ctx.Term()), nil)
 }
 
 func (l *queryListener) ExitAggregateLast(ctx *parser.AggregateLastContext) {
-	l.addAggregateFunction("last", ctx.FieldName().GetText(), nil)
+	l.addAggregateFunction("last", l.aggregateInput("last", ctx.Term()), nil)
+}
+
+func (l *queryListener) ExitAggregateUserDefined(ctx *parser.AggregateUserDefinedContext) {
+	l.addUserDefinedFunction(ctx.NAME().GetText(), l.aggregateInput(ctx.NAME().GetText(), ctx.Term()))
 }
 
 func (l *queryListener) ExitSequenceFieldClause(ctx *parser.SequenceFieldClauseContext) {
@@ -906,6 +1777,8 @@ func (l *queryListener) ExitSessionOpen(ctx *parser.SessionOpenContext) {
 
 	code := l.sessionOpenTuple.Code
 	l.goCode.SessionOpen.Condition = code
+	l.goCode.SessionOpen.Definitions = l.goCode.Definitions
+	l.goCode.Definitions = []string{} // flush the list
 	//SetWindowNodeProperties(l.windowNode(), "session", "N/A", "N/A", "N/A")
 }
 
@@ -914,6 +1787,8 @@ func (l *queryListener) ExitSessionClose(ctx *parser.SessionCloseContext) {
 
 	code := l.sessionCloseTuple.Code
 	l.goCode.SessionClose.Condition = code
+	l.goCode.SessionClose.Definitions = l.goCode.Definitions
+	l.goCode.Definitions = []string{} // flush the list
 
 	var sessionCloseInclusive string
 	switch ctx.GetClusivity().GetTokenType() {
@@ -1035,58 +1910,137 @@ func SetWindowNodeProperties(
 	}
 }
 
-func (l *queryListener) EnterAppendClause(ctx *parser.AppendClauseContext) {
-	allProjections := ctx.Projections().AllProjectionName()
+func (l *queryListener) ExitProjection(ctx *parser.ProjectionContext) {
+	name := ctx.ProjectionName().GetText()
+	for _, p := range l.projections {
+		if p.name == name {
+			panic(fmt.Errorf("append clause has %s twice", name))
+		}
+	}
+
+	if ctx.Term() == nil {
+		field, found := findField(l.aggregateFilterNode(), name)
+		if !found {
+			panic(fmt.Errorf("cannot append %s, it is not a field of the aggregate clause", name))
+		}
+		l.projections = append(l.projections, projection{name: name, fieldType: field.Type(), usage: field.Usage(), expression: -1})
+		return
+	}
+
+	// A computed column like "append bytes / duration as rate"
+	if err := catalog.CheckFieldName(name); err != nil {
+		panic(fmt.Errorf("cannot append %s: %w", ctx.GetText(), err))
+	}
+	value := l.pop()
+	fieldType, usage, err := value.Kind.FieldType()
+	if err != nil {
+		panic(fmt.Errorf("cannot append %s: %w", ctx.GetText(), err))
+	}
+	l.projections = append(l.projections, projection{name: name, fieldType: fieldType, usage: usage, expression: len(l.goCode.AggregateExpressions)})
+	code, usesScalar := codegen.GoValue(value)
+	l.goCode.UsesScalar = l.goCode.UsesScalar || usesScalar
+	l.goCode.AggregateExpressions = append(l.goCode.AggregateExpressions, codegen.GoCodeExpression{
+		Definitions: l.goCode.Definitions,
+		Value:       code,
+	})
+	l.goCode.Definitions = []string{} // flush the list
+}
 
+func (l *queryListener) ExitAppendClause(ctx *parser.AppendClauseContext) {
 	node := l.projectNode()
 	var fields capnp.StructList[grizzly.Field]
 	var err error
-	if fields, err = node.NewFields(int32(len(allProjections))); err != nil {
+	if fields, err = node.NewFields(int32(len(l.projections))); err != nil {
 		panic(err)
 	}
 
-	for i := 0; i < len(allProjections); i++ {
-		projection := allProjections[i]
-		fieldName := projection.GetText()
-
-		var otherFields capnp.StructList[grizzly.Field]
-		if otherFields, err = l.aggregateFilterNode().Fields(); err != nil {
+	// Sinks write the group fields after the output fields, under the same names.
+	for _, groupField := range l.groupFields {
+		var name string
+		if name, err = groupField.Name(); err != nil {
 			panic(err)
 		}
-		for j := 0; j < otherFields.Len(); j++ {
-			otherField := otherFields.At(j)
-			newField := fields.At(i)
-
-			var name string
-			if name, err = otherField.Name(); err != nil {
-				panic(err)
+		for _, p := range l.projections {
+			if p.name == name {
+				panic(fmt.Errorf("%s: %s is also a group field; give it another name with \"as\"", ctx.GetText(), name))
 			}
+		}
+	}
 
-			if name == fieldName {
-				if err = newField.SetName(name); err != nil {
-					panic(err)
-				}
-				newField.SetType(otherField.Type())
-
-				if err = fields.Set(i, newField); err != nil {
-					panic(err)
-				}
-			}
+	for i, p := range l.projections {
+		field := fields.At(i)
+		if err = field.SetName(p.name); err != nil {
+			panic(err)
+		}
+		field.SetType(p.fieldType)
+		field.SetUsage(p.usage)
+		if p.expression >= 0 {
+			setExpressionProperty(field, p.expression)
 		}
 	}
 
 	if err = node.SetFields(fields); err != nil {
 		panic(err)
 	}
-}
 
-func (l *queryListener) ExitAppendClause(ctx *parser.AppendClauseContext) {
+	l.capnpStage.EgressFields = codegen.CapnpFields(fields)
+
 	copyFields(l.projectNode(), l.projectFilterNode())
 	l.filterType = codegen.ProjectFilterType
 }
 
 func (l *queryListener) EnterToClause(ctx *parser.ToClauseContext) {
 	copyFields(l.projectFilterNode(), l.egressNode())
+	l.filterType = codegen.SinkFilterType
+}
+
+func (l *queryListener) EnterSink(ctx *parser.SinkContext) {
+	s := sink{
+		name:   ctx.TableName().GetText(),
+		format: SinkFormatCsv,
+	}
+	if ctx.GetFormat() != nil {
+		s.format = ctx.GetFormat().GetText()
+		if s.format != SinkFormatCsv && s.format != SinkFormatJson {
+			panic(fmt.Errorf("unknown format %s of sink %s; must be %s or %s", s.format, s.name, SinkFormatCsv, SinkFormatJson))
+		}
+	}
+	if ctx.GetLocation() != nil {
+		var err error
+		if s.location, err = strconv.Unquote(ctx.GetLocation().GetText()); err != nil {
+			panic(err)
+		}
+	}
+	l.sinks = append(l.sinks, s)
+	l.goCode.SinkFilters = append(l.goCode.SinkFilters, codegen.GoCodeItem{})
+}
+
+func (l *queryListener) ExitSinkWhereClause(ctx *parser.SinkWhereClauseContext) {
+	l.sinks[len(l.sinks)-1].hasFilter = true
+}
+
+func (l *queryListener) ExitToClause(ctx *parser.ToClauseContext) {
+	node := l.egressNode()
+
+	var properties capnp.StructList[grizzly.OperatorProperty]
+	var err error
+	if properties, err = node.NewProperties(int32(3 * len(l.sinks))); err != nil {
+		panic(err)
+	}
+	for i, s := range l.sinks {
+		for j, kv := range [][2]string{{SinkName, s.name}, {SinkFormat, s.format}, {SinkLocation, s.location}} {
+			property := properties.At(3*i + j)
+			if err = property.SetKey(kv[0]); err != nil {
+				panic(err)
+			}
+			if err = property.SetValue(kv[1]); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err = node.SetProperties(properties); err != nil {
+		panic(err)
+	}
 }
 
 func (l *queryListener) ExitWhereClause(ctx *parser.WhereClauseContext) {
@@ -1095,17 +2049,30 @@ func (l *queryListener) ExitWhereClause(ctx *parser.WhereClauseContext) {
 	switch l.filterType {
 	case codegen.IngressFilterType:
 		l.goCode.IngressFilter.Condition = code //codegen.GoCondition("Ingress", l.list, code)
+		l.goCode.IngressFilter.Definitions = l.goCode.Definitions
 	case codegen.AggregateFilterType:
 		l.goCode.AggregateFilter.Condition = code //codegen.GoCondition("Aggregate", l.list, code)
+		l.goCode.AggregateFilter.Definitions = l.goCode.Definitions
 	case codegen.ProjectFilterType:
 		l.goCode.ProjectFilter.Condition = code //codegen.GoCondition("Project", l.list, code)
+		l.goCode.ProjectFilter.Definitions = l.goCode.Definitions
+	case codegen.SinkFilterType:
+		sinkFilter := &l.goCode.SinkFilters[len(l.goCode.SinkFilters)-1]
+		sinkFilter.Condition = code
+		sinkFilter.Definitions = l.goCode.Definitions
 	default:
 		panic(fmt.Errorf("unknown filter type: %v", l.filterType))
 	}
+	l.goCode.Definitions = []string{} // flush the list
 }
 
-func (l *queryListener) addAggregateFunction(functionName string, inputFieldName string, outputType *grizzly.FieldType) {
-	var function grizzly.Function
+func (l *queryListener) addAggregateFunction(functionName string, field grizzly.Field, outputType *grizzly.FieldType) {
+	l.addAggregateCall(l.newBuiltInFunction(functionName), []grizzly.Field{field}, outputType)
+}
+
+// newBuiltInFunction returns a built-in aggregate function with its parameters as properties, e.g.,
+// the quantiles of "quantiles(x, 0.5, 0.99)".
+func (l *queryListener) newBuiltInFunction(functionName string, keyValues ...[2]string) (function grizzly.Function) {
 	var err error
 	if function, err = grizzly.NewFunction(l.queryPlan.seg); err != nil {
 		log.Error().Err(err)
@@ -1115,14 +2082,276 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 	function.SetIsBuiltIn(true)
 	function.SetName(functionName)
 
-	var msg *capnp.Message
-	var field grizzly.Field
-	if msg, field, err = catalog.FindField(CatalogFilePath, l.inputTableFullName, inputFieldName); err != nil {
+	if len(keyValues) == 0 {
+		return
+	}
+	var properties capnp.StructList[grizzly.FunctionProperty]
+	if properties, err = function.NewProperties(int32(len(keyValues))); err != nil {
 		panic(err)
 	}
+	for i, kv := range keyValues {
+		if err = properties.At(i).SetKey(kv[0]); err != nil {
+			panic(err)
+		}
+		if err = properties.At(i).SetValue(kv[1]); err != nil {
+			panic(err)
+		}
+	}
+	return
+}
+
+// addQuantileFunction calls an aggregate that estimates quantiles of a numeric input with a t-digest.
+// "percentile" returns a float64, and "quantiles" a JSON list of its quantiles as text.
+func (l *queryListener) addQuantileFunction(functionName string, field grizzly.Field, quantiles []string, compression antlr.Token) {
+	var err error
+	checkNumeric(functionName, field)
+	for _, quantile := range quantiles {
+		var q float64
+		if q, err = strconv.ParseFloat(quantile, 64); err != nil {
+			panic(err)
+		}
+		if q < 0 || q > 1 {
+			panic(fmt.Errorf("quantile %s of %s is not between 0 and 1", quantile, functionName))
+		}
+	}
+	keyValues := [][2]string{{QuantilesProperty, strings.Join(quantiles, ",")}}
+	if compression != nil {
+		if strings.HasPrefix(compression.GetText(), "-") {
+			panic(fmt.Errorf("compression %s of %s is negative", compression.GetText(), functionName))
+		}
+		keyValues = append(keyValues, [2]string{CompressionProperty, compression.GetText()})
+	}
+
+	outputType := grizzly.FieldType_float64
+	if functionName == "quantiles" {
+		outputType = grizzly.FieldType_text
+	}
+	l.addAggregateCall(l.newBuiltInFunction(functionName, keyValues...), []grizzly.Field{field}, &outputType)
+}
+
+// addSketchFunction calls an aggregate that counts values with a Count-Min Sketch: "cms" returns
+// the encoded sketch, and "topk" the k most frequent values with their counts, both as text.
+func (l *queryListener) addSketchFunction(functionName string, field grizzly.Field, k antlr.Token, epsilon antlr.Token, delta antlr.Token) {
+	var keyValues [][2]string
+	if k != nil {
+		keyValues = append(keyValues, [2]string{TopKProperty, checkLimit(functionName, k)})
+	}
+	if epsilon != nil {
+		for _, token := range []antlr.Token{epsilon, delta} {
+			if x, err := strconv.ParseFloat(token.GetText(), 64); err != nil || x <= 0 || x >= 1 {
+				panic(fmt.Errorf("epsilon and delta of %s must be between 0 and 1, not %s", functionName, token.GetText()))
+			}
+		}
+		keyValues = append(keyValues, [2]string{EpsilonProperty, epsilon.GetText()}, [2]string{DeltaProperty, delta.GetText()})
+	}
+
+	outputType := grizzly.FieldType_text
+	l.addAggregateCall(l.newBuiltInFunction(functionName, keyValues...), []grizzly.Field{field}, &outputType)
+}
+
+// addUniqueFunction calls an aggregate that estimates the number of distinct values with a
+// HyperLogLog: "unique" returns the estimate, and "hll" the encoded sketch as text.
+func (l *queryListener) addUniqueFunction(functionName string, field grizzly.Field, precision antlr.Token) {
+	var keyValues [][2]string
+	if precision != nil {
+		keyValues = append(keyValues, [2]string{PrecisionProperty, checkPrecision(functionName, precision)})
+	}
+
+	outputType := grizzly.FieldType_integer64
+	if functionName == "hll" {
+		outputType = grizzly.FieldType_text
+	}
+	l.addAggregateCall(l.newBuiltInFunction(functionName, keyValues...), []grizzly.Field{field}, &outputType)
+}
+
+// addStatisticsFunction calls an aggregate that computes moments of one numeric input, e.g.,
+// "stddev(x)", or comoments of two, e.g., "corr(x, y)".
+func (l *queryListener) addStatisticsFunction(functionName string, terms ...parser.ITermContext) {
+	// The terms are on the stack in reverse order.
+	fields := make([]grizzly.Field, len(terms))
+	for i := len(terms) - 1; i >= 0; i-- {
+		fields[i] = l.aggregateInput(functionName, terms[i])
+		checkNumeric(functionName, fields[i])
+	}
+
+	outputType := grizzly.FieldType_float64
+	l.addAggregateCall(l.newBuiltInFunction(functionName), fields, &outputType)
+}
+
+// addChangeFunction calls an aggregate that computes how much a numeric input changes over the
+// timestamps of the window, e.g., "rate(bytes)".  The timestamps are the second input.
+func (l *queryListener) addChangeFunction(functionName string, term parser.ITermContext) {
+	field := l.aggregateInput(functionName, term)
+	checkNumeric(functionName, field)
+	if l.sequenceFieldName == "" {
+		panic(fmt.Errorf("%s needs the timestamps of the window: add \"based on\" a time field to the window", functionName))
+	}
+	timeField := l.aggregateInputField(functionName, l.sequenceFieldName)
+	if timeField.Usage() != grizzly.FieldUsage_time {
+		panic(fmt.Errorf("%s needs the timestamps of the window, but %s is not a time field", functionName, l.sequenceFieldName))
+	}
+
+	outputType := grizzly.FieldType_float64
+	l.addAggregateCall(l.newBuiltInFunction(functionName), []grizzly.Field{field, timeField}, &outputType)
+}
+
+func checkLimit(functionName string, limit antlr.Token) string {
+	if n, err := strconv.Atoi(limit.GetText()); err != nil || n <= 0 {
+		panic(fmt.Errorf("%s needs a positive number of values, not %s", functionName, limit.GetText()))
+	}
+	return limit.GetText()
+}
+
+// checkPrecision checks the precision of a HyperLogLog, the base 2 logarithm of its number of registers.
+func checkPrecision(functionName string, precision antlr.Token) string {
+	if p, err := strconv.Atoi(precision.GetText()); err != nil || p < functor.MinPrecision || p > functor.MaxPrecision {
+		panic(fmt.Errorf("precision of %s must be between %d and %d, not %s", functionName, functor.MinPrecision, functor.MaxPrecision, precision.GetText()))
+	}
+	return precision.GetText()
+}
+
+func checkNumeric(functionName string, field grizzly.Field) {
+	if (field.Type() == grizzly.FieldType_float64 || field.Type() == grizzly.FieldType_integer64) && field.Usage() != grizzly.FieldUsage_time {
+		return
+	}
+	name, err := field.Name()
+	if err != nil {
+		panic(err)
+	}
+	panic(fmt.Errorf("%s takes a number, but %s is a %v", functionName, name, field.Type()))
+}
+
+// addUserDefinedFunction calls an aggregate function that the catalog declares in the schema of the
+// input table or, for intermediate tables, in the namespace.  The engine loads it at startup.
+func (l *queryListener) addUserDefinedFunction(functionName string, field grizzly.Field) {
+	namespace := Namespace
+	if parts := strings.Split(l.inputTableFullName, "."); len(parts) == 4 {
+		namespace = strings.Join(parts[:3], ".")
+	}
+
+	var err error
+	var fullFunctionName string
+	if fullFunctionName, err = l.catalogIndex.ResolveFunction(functionName, namespace); err != nil {
+		panic(err)
+	}
+	var declared grizzly.Function
+	if declared, err = l.catalogIndex.Function(fullFunctionName); err != nil {
+		panic(err)
+	}
+	if !declared.IsAggregate() {
+		panic(fmt.Errorf("function %s is not an aggregate function", fullFunctionName))
+	}
+
+	var inputTypes capnp.EnumList[grizzly.FieldType]
+	if inputTypes, err = declared.InputTypes(); err != nil {
+		panic(err)
+	}
+	if inputTypes.Len() != 1 {
+		panic(fmt.Errorf("function %s takes %d inputs, not 1", fullFunctionName, inputTypes.Len()))
+	}
+	if inputTypes.At(0) != field.Type() {
+		var inputName string
+		if inputName, err = field.Name(); err != nil {
+			panic(err)
+		}
+		panic(fmt.Errorf("function %s takes a %v, but %s is a %v", fullFunctionName, inputTypes.At(0), inputName, field.Type()))
+	}
+
+	var function grizzly.Function
+	if function, err = grizzly.NewFunction(l.queryPlan.seg); err != nil {
+		panic(err)
+	}
+	function.SetIsAggregate(true)
+	function.SetIsBuiltIn(false)
+	// The full name tells the functions of different schemas apart in the engine.
+	if err = function.SetName(fullFunctionName); err != nil {
+		panic(err)
+	}
+	var libraryPath string
+	if libraryPath, err = declared.LibraryPath(); err != nil {
+		panic(err)
+	}
+	if err = function.SetLibraryPath(libraryPath); err != nil {
+		panic(err)
+	}
+
+	outputType := declared.OutputType()
+	l.addAggregateCall(function, []grizzly.Field{field}, &outputType)
+}
+
+// aggregateInput returns the input of an aggregate function: the field itself for a plain field
+// name like "sum(bytes)", or a field that the engine computes per row for a term like "sum(bytes * 8)".
+func (l *queryListener) aggregateInput(functionName string, term parser.ITermContext) grizzly.Field {
+	value := l.pop()
+	if value.Code == codegen.GoCodeVariablePrefix+"."+term.GetText() {
+		l.goCode.Definitions = []string{} // flush the list
+		return l.aggregateInputField(functionName, term.GetText())
+	}
+	return l.expressionInput(term.GetText(), value)
+}
+
+// expressionInput adds an expression over the ingress row and returns a field for its value.  The
+// field is named after the UQL text of the expression and refers to the generated code by index.
+func (l *queryListener) expressionInput(text string, value codegen.GoExpression) (field grizzly.Field) {
+	fieldType, usage, err := value.Kind.FieldType()
+	if err != nil {
+		panic(fmt.Errorf("cannot aggregate %s: %w", text, err))
+	}
+	if field, err = grizzly.NewField(l.queryPlan.seg); err != nil {
+		panic(err)
+	}
+	if err = field.SetName(text); err != nil {
+		panic(err)
+	}
+	field.SetType(fieldType)
+	field.SetUsage(usage)
+	setExpressionProperty(field, len(l.goCode.IngressExpressions))
+
+	code, usesScalar := codegen.GoValue(value)
+	l.goCode.UsesScalar = l.goCode.UsesScalar || usesScalar
+	l.goCode.IngressExpressions = append(l.goCode.IngressExpressions, codegen.GoCodeExpression{
+		Definitions: l.goCode.Definitions,
+		Value:       code,
+	})
+	l.goCode.Definitions = []string{} // flush the list
+	return
+}
+
+func setExpressionProperty(field grizzly.Field, index int) {
+	var err error
+	var properties capnp.StructList[grizzly.FieldProperty]
+	if properties, err = field.NewProperties(1); err != nil {
+		panic(err)
+	}
+	if err = properties.At(0).SetKey(ExpressionProperty); err != nil {
+		panic(err)
+	}
+	if err = properties.At(0).SetValue(strconv.Itoa(index)); err != nil {
+		panic(err)
+	}
+}
+
+func (l *queryListener) aggregateInputField(functionName string, inputFieldName string) (field grizzly.Field) {
+	var err error
+	if len(l.upstreams) > 0 || (inputFieldName == SourceFieldName && len(l.sourceTableNames) > 1) {
+		// The virtual source field and the fields of earlier queries are not in the catalog.
+		var found bool
+		if field, found = findField(l.ingressNode(), inputFieldName); !found && functionName != "count" {
+			panic(fmt.Errorf("cannot find field %s", inputFieldName))
+		}
+	} else if field, err = l.catalogIndex.Field(l.inputTableFullName, inputFieldName); err != nil {
+		var notFound *catalog.FieldNotFoundError
+		if !errors.As(err, &notFound) || functionName != "count" {
+			panic(err)
+		}
+	}
+	return
+}
+
+func (l *queryListener) addAggregateCall(function grizzly.Function, fields []grizzly.Field, outputType *grizzly.FieldType) {
+	var err error
+	field := fields[0]
 	inputFieldType := field.Type()
-	// FIXME: Why do I need to read msg?
-	log.Info().Msgf("ExitWhereClause: msg: %v", msg)
 
 	var outputFieldType grizzly.FieldType
 	if outputType != nil {
@@ -1140,19 +2369,20 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 	}
 
 	var inputFieldTypes capnp.EnumList[grizzly.FieldType]
-	if inputFieldTypes, err = grizzly.NewFieldType_List(l.queryPlan.seg, 1); err != nil {
-		panic(err)
-	}
-	inputFieldTypes.Set(0, inputFieldType)
-	if err = function.SetInputTypes(inputFieldTypes); err != nil {
+	if inputFieldTypes, err = grizzly.NewFieldType_List(l.queryPlan.seg, int32(len(fields))); err != nil {
 		panic(err)
 	}
-
 	var inputFields capnp.StructList[grizzly.Field]
-	if inputFields, err = grizzly.NewField_List(l.queryPlan.seg, 1); err != nil {
+	if inputFields, err = grizzly.NewField_List(l.queryPlan.seg, int32(len(fields))); err != nil {
 		panic(err)
 	}
-	if err = inputFields.Set(0, field); err != nil {
+	for i, f := range fields {
+		inputFieldTypes.Set(i, f.Type())
+		if err = inputFields.Set(i, f); err != nil {
+			panic(err)
+		}
+	}
+	if err = function.SetInputTypes(inputFieldTypes); err != nil {
 		panic(err)
 	}
 
@@ -1175,6 +2405,10 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 		panic(err)
 	}
 	outputField.SetType(outputFieldType)
+	if outputType == nil {
+		// E.g., "last(t)" is still a timestamp that a later query can use.
+		outputField.SetUsage(field.Usage())
+	}
 	if err = call.SetOutputField(outputField); err != nil {
 		panic(err)
 	}
@@ -1182,6 +2416,25 @@ func (l *queryListener) addAggregateFunction(functionName string, inputFieldName
 	l.calls = append(l.calls, call)
 }
 
+func findField(node *grizzly.Node, fieldName string) (field grizzly.Field, found bool) {
+	var fields capnp.StructList[grizzly.Field]
+	var err error
+	if fields, err = node.Fields(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < fields.Len(); i++ {
+		field = fields.At(i)
+		var name string
+		if name, err = field.Name(); err != nil {
+			panic(err)
+		}
+		if name == fieldName {
+			return field, true
+		}
+	}
+	return
+}
+
 func copyFields(from *grizzly.Node, to *grizzly.Node) {
 	if !from.HasFields() {
 		return
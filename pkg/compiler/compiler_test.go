@@ -0,0 +1,389 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xsnout/grizzly/capnp/grizzly"
+	"github.com/xsnout/grizzly/pkg/catalog"
+	"github.com/xsnout/grizzly/pkg/codegen"
+	"github.com/xsnout/grizzly/pkg/utility"
+)
+
+const testCatalog = `{
+  "name": "sys",
+  "databases": [{
+    "name": "db",
+    "schemas": [{
+      "name": "logs",
+      "tables": [{
+        "name": "web",
+        "format": "csv",
+        "fields": [
+          {"id": 0, "name": "t", "type": "timestamp", "usage": "time"},
+          {"id": 1, "name": "host", "type": "text", "usage": "data"},
+          {"id": 2, "name": "status", "type": "integer64", "usage": "data"},
+          {"id": 3, "name": "bytes", "type": "integer64", "usage": "data"},
+          {"id": 4, "name": "latencyMs", "type": "float64", "usage": "data"},
+          {"id": 5, "name": "cached", "type": "boolean", "usage": "data"}
+        ]
+      }, {
+        "name": "api",
+        "format": "csv",
+        "fields": [
+          {"id": 0, "name": "t", "type": "timestamp", "usage": "time"},
+          {"id": 1, "name": "host", "type": "text", "usage": "data"},
+          {"id": 2, "name": "status", "type": "integer64", "usage": "data"},
+          {"id": 3, "name": "bytes", "type": "integer64", "usage": "data"},
+          {"id": 4, "name": "latencyMs", "type": "float64", "usage": "data"},
+          {"id": 5, "name": "cached", "type": "boolean", "usage": "data"}
+        ]
+      }],
+      "functions": [{
+        "name": "spread", "isAggregate": true, "inputTypes": ["float64"], "outputType": "float64", "libraryPath": "logs.so"
+      }]
+    }, {
+      "name": "metrics",
+      "functions": [{
+        "name": "spread", "isAggregate": true, "inputTypes": ["float64"], "outputType": "float64", "libraryPath": "metrics.so"
+      }]
+    }]
+  }]
+}`
+
+// The package of the rows that capnp generates from data.capnp.
+const dataPackage = "github.com/xsnout/grizzly/capnp/data"
+
+func init() {
+	Init()
+}
+
+// compile compiles the query against the test catalog and returns the generated Go code.
+func compile(t *testing.T, query string) string {
+	t.Helper()
+	code, _ := compilePlan(t, query)
+	return code
+}
+
+// compilePlan also returns the root of the plan.
+func compilePlan(t *testing.T, query string) (string, grizzly.Node) {
+	t.Helper()
+	dir := t.TempDir()
+
+	var capnpCatalog bytes.Buffer
+	c := catalog.NewCatalog(strings.NewReader(testCatalog), &capnpCatalog)
+	c.ReadJson()
+	c.WriteCapnp("")
+	CatalogFilePath = filepath.Join(dir, "catalog.bin")
+	if err := os.WriteFile(CatalogFilePath, capnpCatalog.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	CatalogJsonFilePath = filepath.Join(dir, "catalog.json")
+	codegen.GoCodeFilePath = filepath.Join(dir, "functions.go")
+	codegen.CapnpCodeFilePath = filepath.Join(dir, "data.capnp")
+
+	var plan bytes.Buffer
+	Compile(strings.NewReader(query), &plan)
+
+	code, err := os.ReadFile(codegen.GoCodeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(code), utility.ReadBinaryPlan(&plan)
+}
+
+// compileError returns the error of a query that the compiler rejects.
+func compileError(t *testing.T, query string) (err error) {
+	t.Helper()
+	defer func() {
+		switch r := recover().(type) {
+		case nil:
+		case error:
+			err = r
+		default:
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	compile(t, query)
+	return nil
+}
+
+// withoutRows fails to import the rows, so that the type checker ignores their accessors.  They are
+// generated by capnp, which is not needed to check the generated expressions.
+type withoutRows struct {
+	types.Importer
+}
+
+func (i withoutRows) Import(path string) (*types.Package, error) {
+	if path == dataPackage {
+		return nil, errors.New("generated by capnp")
+	}
+	return i.Importer.Import(path)
+}
+
+// typeCheck reports the errors that the Go compiler would find in the generated code.
+func typeCheck(t *testing.T, code string) {
+	t.Helper()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "functions.go", code, 0)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, code)
+	}
+	var errs []string
+	conf := types.Config{
+		Importer: withoutRows{importer.ForCompiler(fset, "source", nil)},
+		Error: func(err error) {
+			if !strings.Contains(err.Error(), dataPackage) {
+				errs = append(errs, err.Error())
+			}
+		},
+	}
+	_, _ = conf.Check("functions", fset, []*ast.File{file}, nil)
+	if len(errs) > 0 {
+		t.Errorf("generated code does not compile:\n%s\n%s", strings.Join(errs, "\n"), code)
+	}
+}
+
+// The error rate example of the README: a call with its own filter.
+func TestAggregateFilter(t *testing.T) {
+	code := compile(t, `from sys.db.logs.web
+window slice 1 minutes based on t
+aggregate count() filter (where status >= 500) as errors, count() as total
+append total, errors
+to rates`)
+	typeCheck(t, code)
+}
+
+// The inputs of aggregates can be terms and conditions.
+func TestAggregateExpressions(t *testing.T) {
+	code := compile(t, `from sys.db.logs.web
+window slice 1 minutes based on t
+aggregate sum(bytes * 8) as bits, count(status >= 500) as errors
+append bits, errors
+to traffic`)
+	typeCheck(t, code)
+}
+
+// The compiler rejects terms with operands of the wrong kinds instead of generating Go code that
+// doesn't compile.
+func TestTypeErrors(t *testing.T) {
+	for _, condition := range []string{
+		`"a" < 3`,
+		`host + 1 > 0`,
+		`host - "a" == "b"`,
+		`latencyMs % 2 == 0`,
+		`true < false`,
+		`t > 3`,
+		`status and true`,
+	} {
+		query := "from sys.db.logs.web where " + condition + " window slice 1 minutes based on t aggregate count() as hits append hits to errors"
+		if err := compileError(t, query); err == nil {
+			t.Errorf("%s compiles", condition)
+		}
+	}
+}
+
+// Integers become floats in terms with floats, and texts can be concatenated.
+func TestTypeConversions(t *testing.T) {
+	code := compile(t, `from sys.db.logs.web
+where status * latencyMs > 1 and 2 < latencyMs and host + "/" == "scalar.example/" and t - 5 seconds < t
+window slice 1 minutes based on t
+aggregate count() as hits
+append hits
+to slow`)
+	typeCheck(t, code)
+}
+
+// Aliases become fields of the generated Cap'n Proto structs, whose names cannot have underscores.
+func TestAliasNames(t *testing.T) {
+	for _, query := range []string{
+		"from sys.db.logs.web group by status / 100 as status_class window slice 1 minutes based on t aggregate count() as hits append hits to errors",
+		"from sys.db.logs.web window slice 1 minutes based on t aggregate count() as all_hits append all_hits to errors",
+		"from sys.db.logs.web window slice 1 minutes based on t aggregate count() as hits append hits * 2 as Hits to errors",
+	} {
+		if err := compileError(t, query); err == nil {
+			t.Errorf("%s compiles", query)
+		}
+	}
+
+	typeCheck(t, compile(t, "from sys.db.logs.web group by status / 100 as statusClass window slice 1 minutes based on t aggregate count() as hits append hits to errors"))
+}
+
+// Each query has its own row structs, so a rollup can reuse a name with a different type.
+func TestRollup(t *testing.T) {
+	code := compile(t, `from sys.db.logs.web
+window slice 1 minutes based on t
+aggregate sum(bytes) as bytes, last(t) as t
+append bytes, t
+to minutely;
+
+from minutely
+window slice 60 minutes based on t
+aggregate avg(bytes) as bytes, last(t) as t
+append bytes, t
+to hourly`)
+	typeCheck(t, code)
+
+	schema, err := os.ReadFile(codegen.CapnpCodeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"struct AggregatePayload ", "struct AggregatePayload1 ", "payload1 @3 :IngressPayload1;"} {
+		if !strings.Contains(string(schema), name) {
+			t.Errorf("data.capnp has no %q:\n%s", name, schema)
+		}
+	}
+}
+
+// Rows have the output fields followed by the group fields, so their names cannot collide.
+func TestGroupFieldNames(t *testing.T) {
+	query := "from sys.db.logs.web group by host window slice 1 minutes based on t aggregate count() as hits append hits * 1 as host to hosts"
+	if err := compileError(t, query); err == nil {
+		t.Errorf("%s compiles", query)
+	}
+}
+
+// With a limit, "distinctcount" has a second output that tells if the count is an estimate.
+func TestDistinctCount(t *testing.T) {
+	for _, call := range []string{
+		"distinctcount(host, 100000)",
+		"distinctcount(host, 100000, 14)",
+		"distinctcount(host, 100000) filter (where status >= 500)",
+	} {
+		code := compile(t, "from sys.db.logs.web window slice 1 minutes based on t aggregate "+call+" as hosts, count() as hits append hosts, hostsApproximate, hits to hosts")
+		typeCheck(t, code)
+
+		schema, err := os.ReadFile(codegen.CapnpCodeFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(schema), "hostsApproximate @1 :Bool;") {
+			t.Errorf("%s: data.capnp has no flag:\n%s", call, schema)
+		}
+	}
+
+	if err := compileError(t, "from sys.db.logs.web window slice 1 minutes based on t aggregate distinctcount(host, 100000, 30) as hosts append hosts to hosts"); err == nil {
+		t.Errorf("compiles with precision 30")
+	}
+}
+
+// The names of aggregate functions are keywords only before "(", so they can name aliases.
+func TestFunctionNamesAsAliases(t *testing.T) {
+	typeCheck(t, compile(t, "from sys.db.logs.web window slice 1 minutes based on t aggregate count() as rate, sum(status) as sum append rate, sum * 2 as first to rates"))
+}
+
+// A boolean field is a condition, so "count(cached)" counts the rows of cached responses, while
+// "count(host)" counts every row.
+func TestCountBooleanField(t *testing.T) {
+	code, plan := compilePlan(t, "from sys.db.logs.web window slice 1 minutes based on t aggregate count(cached) as hits, count(host) as total append hits, total to hits")
+	typeCheck(t, code)
+	aggregate, found := utility.FindFirstNodeByType(&plan, grizzly.OperatorType_aggregate)
+	if !found {
+		t.Fatal("plan has no aggregate")
+	}
+	calls, err := aggregate.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []bool{true, false} {
+		inputs, err := calls.At(i).InputFields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if condition := hasProperty(t, inputs.At(0), ExpressionProperty); condition != expected {
+			t.Errorf("call %d has a condition: %v", i, condition)
+		}
+	}
+}
+
+func hasProperty(t *testing.T, field grizzly.Field, key string) bool {
+	t.Helper()
+	properties, err := field.Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < properties.Len(); i++ {
+		if k, _ := properties.At(i).Key(); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Several queries can read the output of one query, and a query can read several of its tables.
+func TestFanOut(t *testing.T) {
+	typeCheck(t, compile(t, `from sys.db.logs.web
+window slice 1 minutes based on t
+aggregate count() as hits, last(t) as t
+append hits, t
+to minutely;
+
+from minutely
+window slice 60 minutes based on t
+aggregate sum(hits) as hits, last(t) as t
+append hits, t
+to hourly;
+
+from minutely, hourly
+window slice 60 minutes based on t
+aggregate sum(hits) as hits
+append hits
+to totals`))
+
+	typeCheck(t, compile(t, `from sys.db.logs.web
+window slice 1 minutes based on t
+aggregate count() as hits, last(t) as t
+append hits, t
+to errors where hits > 10, warnings where hits <= 10;
+
+from errors, warnings
+window slice 60 minutes based on t
+aggregate sum(hits) as hits
+append hits
+to totals`))
+}
+
+// The engine's inputs and the "source" field use the full table names, however the query spells them.
+func TestSourceTableNames(t *testing.T) {
+	_, plan := compilePlan(t, "from web, logs.api window slice 1 minutes based on t aggregate count() as hits append hits to hits")
+	ingress, found := utility.FindFirstNodeByType(&plan, grizzly.OperatorType_ingress)
+	if !found {
+		t.Fatal("plan has no ingress")
+	}
+	if tables, _ := utility.FindProperty(ingress, SourceTables); tables != "sys.db.logs.web,sys.db.logs.api" {
+		t.Errorf("source tables are %s", tables)
+	}
+}
+
+// A user-defined function is called by its full name, so that functions of different schemas
+// with the same name don't collide in the engine.
+func TestUserDefinedFunction(t *testing.T) {
+	_, plan := compilePlan(t, "from sys.db.logs.web window slice 1 minutes based on t aggregate spread(latencyMs) as spread append spread to spreads")
+	aggregate, found := utility.FindFirstNodeByType(&plan, grizzly.OperatorType_aggregate)
+	if !found {
+		t.Fatal("plan has no aggregate")
+	}
+	calls, err := aggregate.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := calls.At(0).Function()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := function.Name()
+	path, _ := function.LibraryPath()
+	if name != "sys.db.logs.spread" || path != "logs.so" {
+		t.Errorf("calls %s in %s", name, path)
+	}
+}
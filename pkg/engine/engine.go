@@ -1,20 +1,20 @@
-// Package engine implements the actual query processor.  It runs exacly one query generated using the compiler package.
+// Package engine implements the actual query processor.  It runs the queries of a plan generated using the compiler
+// package; if a query reads from the output of an earlier query, both run as pipelines in the same engine.
 package engine
 
 import (
-	"encoding/csv"
 	"fmt"
 	"math"
 
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/xsnout/grizzly/capnp/data"
 	"github.com/xsnout/grizzly/capnp/grizzly"
 	"github.com/xsnout/grizzly/pkg/_out/functions"
-	"github.com/xsnout/grizzly/pkg/common"
 	"github.com/xsnout/grizzly/pkg/compiler"
 	"github.com/xsnout/grizzly/pkg/operator"
 	"github.com/xsnout/grizzly/pkg/utility"
@@ -46,8 +46,21 @@ type Engine struct {
 	exitAfterSeconds int
 	planRoot         grizzly.Node
 
-	reader io.Reader
-	writer io.Writer
+	reader  io.Reader
+	writer  io.Writer
+	sources map[string]io.Reader // Inputs of the source tables if the query reads from several tables
+	sinks   map[string]io.Writer // Outputs that override the locations of the sinks in the "to" clause
+	columns map[string]int       // Values to keep per record of a source table that gained fields since the plan
+
+	upstreams []*Engine                  // Earlier queries this query reads from
+	inputs    map[string]chan []string   // Records of the earlier queries by table name
+	outputs   map[string][]chan []string // Records for the later queries by sink name
+	started   bool
+
+	sinkMutex   sync.Mutex   // Guards the sinks against writes after they are closed
+	sinkWriters []sinkWriter // Set by the egress worker
+	sinkFiles   []io.Closer  // Outputs opened for the locations of the "to" clause
+	stopped     bool
 
 	ingress         operator.Ingress
 	ingressFilter   operator.Filter
@@ -74,65 +87,97 @@ func NewEngine(
 	exitAfterSeconds int,
 ) *Engine {
 	root := utility.ReadBinaryPlan(planReader)
+	return newEngine(&root, dataReader, dataWriter, exitAfterSeconds, make(map[string]io.Reader), make(map[string]io.Writer), make(map[int]*Engine))
+}
+
+// Creates the engine for the query whose egress node is the given root, and the engines for the
+// earlier queries it reads from.  All engines share the inputs and outputs of the tables.  A query
+// that several later queries read from appears in the plan once per reader but gets one engine,
+// which engines holds by stage.
+func newEngine(
+	root *grizzly.Node,
+	dataReader io.Reader,
+	dataWriter io.Writer,
+	exitAfterSeconds int,
+	sources map[string]io.Reader,
+	sinks map[string]io.Writer,
+	engines map[int]*Engine,
+) *Engine {
 	template := "could not find node for %s operator"
 
 	var found bool
 	var node *grizzly.Node
 
 	var window operator.Window
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_window); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_window); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_window.String()))
 	}
 	window.Init(node)
 
 	var egress operator.Egress
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_egress); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_egress); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_egress.String()))
 	}
 	egress.Init(node)
 
 	var ingress operator.Ingress
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_ingress); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_ingress); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_ingress.String()))
 	}
 	ingress.Init(node)
+	if e, found := engines[ingress.Stage]; found {
+		return e
+	}
+	ingress.Evaluator = &functions.Filter{Stage: ingress.Stage}
+	window.Stage = ingress.Stage
+	egress.Stage = ingress.Stage
+	ingressNode := node
 
 	var aggregate operator.Aggregate
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_aggregate); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_aggregate); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_aggregate.String()))
 	}
 	aggregate.Init(node)
+	aggregate.Stage = ingress.Stage
+	aggregate.Evaluator = &functions.Filter{Stage: ingress.Stage}
 
 	var project operator.Project
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_project); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_project); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_project.String()))
 	}
 	project.Init(node)
+	project.Stage = ingress.Stage
+	project.Evaluator = &functions.Filter{Stage: ingress.Stage}
 
 	var ingressFilter operator.Filter
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_ingressFilter); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_ingressFilter); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_ingressFilter.String()))
 	}
 	ingressFilter.Init(node)
 
 	var aggregateFilter operator.Filter
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_aggregateFilter); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_aggregateFilter); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_aggregateFilter.String()))
 	}
 	aggregateFilter.Init(node)
 
 	var projectFilter operator.Filter
-	if node, found = utility.FindFirstNodeByType(&root, grizzly.OperatorType_projectFilter); !found {
+	if node, found = utility.FindFirstNodeByType(root, grizzly.OperatorType_projectFilter); !found {
 		panic(fmt.Errorf(template, grizzly.OperatorType_projectFilter.String()))
 	}
 	projectFilter.Init(node)
 
-	return &Engine{
+	e := &Engine{
 		exitAfterSeconds: exitAfterSeconds,
-		planRoot:         root,
+		planRoot:         *root,
 
-		reader: dataReader,
-		writer: dataWriter,
+		reader:  dataReader,
+		writer:  dataWriter,
+		sources: sources,
+		sinks:   sinks,
+		columns: make(map[string]int),
+		inputs:  make(map[string]chan []string),
+		outputs: make(map[string][]chan []string),
 
 		ingress:         ingress,
 		ingressFilter:   ingressFilter,
@@ -151,9 +196,85 @@ func NewEngine(
 		projectToProjectFilterChannel:     make(chan *data.EgressRow, ChannelCapacity),
 		projectFilterToEgressChannel:      make(chan *data.EgressRow, ChannelCapacity),
 	}
+	engines[ingress.Stage] = e
+
+	// The children of the ingress node are the egress nodes of the earlier queries.
+	if ingressNode.HasChildren() {
+		var children capnp.StructList[grizzly.Node]
+		var err error
+		if children, err = ingressNode.Children(); err != nil {
+			panic(err)
+		}
+		for i := 0; i < children.Len(); i++ {
+			child := children.At(i)
+			upstream := newEngine(&child, dataReader, dataWriter, exitAfterSeconds, sources, sinks, engines)
+			e.connect(upstream)
+		}
+	}
+	return e
+}
+
+// Connects the sinks of an earlier query to the tables with the same names in the "from" clause,
+// e.g., both tables of "from a, b" if the earlier query writes to "a" and "b".
+func (e *Engine) connect(upstream *Engine) {
+	connected := false
+	for _, sink := range upstream.egress.Sinks {
+		for _, tableName := range e.ingress.SourceTables {
+			if sink.Name == tableName {
+				records := make(chan []string, ChannelCapacity)
+				upstream.outputs[sink.Name] = append(upstream.outputs[sink.Name], records)
+				e.inputs[tableName] = records
+				connected = true
+			}
+		}
+	}
+	if connected {
+		e.upstreams = append(e.upstreams, upstream)
+		return
+	}
+	panic(fmt.Errorf("query %d reads from %s, but query %d writes none of them", e.ingress.Stage+1, strings.Join(e.ingress.SourceTables, ", "), upstream.ingress.Stage+1))
 }
 
 func (e *Engine) Run() {
+	e.start()
+
+	time.Sleep(time.Duration(e.exitAfterSeconds) * time.Second)
+	e.stop()
+}
+
+// Flushes and closes the outputs of this query and the earlier ones.  Rows that arrive later are
+// dropped.
+func (e *Engine) stop() {
+	for _, upstream := range e.upstreams {
+		upstream.stop()
+	}
+
+	e.sinkMutex.Lock()
+	defer e.sinkMutex.Unlock()
+	e.stopped = true
+	for _, w := range e.sinkWriters {
+		if w.csvWriter != nil {
+			w.csvWriter.Flush()
+		}
+	}
+	for _, file := range e.sinkFiles {
+		if err := file.Close(); err != nil {
+			log.Error().Err(err).Msg("cannot close sink")
+		}
+	}
+	e.sinkFiles = nil
+}
+
+// Starts the workers of this query and the earlier ones, each once even if several queries read it.
+func (e *Engine) start() {
+	if e.started {
+		return
+	}
+	e.started = true
+	for _, upstream := range e.upstreams {
+		upstream.start()
+	}
+
 	go e.IngressWorker()
 	go e.IngressFilterWorker()
 	go e.WindowWorker()
@@ -162,8 +283,6 @@ func (e *Engine) Run() {
 	go e.ProjectWorker()
 	go e.ProjectFilterWorker()
 	go e.EgressWorker()
-
-	time.Sleep(time.Duration(e.exitAfterSeconds) * time.Second)
 }
 
 func (e *Engine) IngressWorker() {
@@ -172,18 +291,19 @@ func (e *Engine) IngressWorker() {
 		panic(err)
 	}
 
-	csvReader := csv.NewReader(e.reader)
-	csvReader.Comma = common.CsvSeparator
-	csvReader.Comment = CsvComment
+	var records chan []string
+	switch {
+	case len(e.ingress.SourceTables) > 1:
+		records = make(chan []string, ChannelCapacity)
+		go e.mergeSources(records)
+	case len(e.inputs) > 0: // reads from an earlier query
+		records = e.inputs[e.ingress.SourceTables[0]]
+	default:
+		records = make(chan []string, ChannelCapacity)
+		go readRecords(e.reader, "", e.columns[e.ingress.SourceTables[0]], records)
+	}
 
-	for {
-		record, err := csvReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
+	for record := range records {
 		ingressRow, err := data.NewIngressRow(seg)
 		if err != nil {
 			panic(err)
@@ -194,7 +314,7 @@ func (e *Engine) IngressWorker() {
 }
 
 func (e *Engine) IngressFilterWorker() {
-	var filter functions.Filter
+	filter := functions.Filter{Stage: e.ingress.Stage}
 	for {
 		ingressRow := <-e.ingressToIngressFilterChannel
 		//pass := e.ingressFilterOp.Filter(payload)
@@ -236,12 +356,12 @@ func (e *Engine) WindowWorker() {
 type Window []*data.IngressRow
 
 type WindowGroup struct {
-	groupFieldNames []string
-	windows         map[string]Window
+	window  *operator.Window
+	windows map[string]Window
 }
 
-func CreateWindowGroup(groupFieldNames []string) (wg WindowGroup) {
-	wg.groupFieldNames = groupFieldNames
+func CreateWindowGroup(window *operator.Window) (wg WindowGroup) {
+	wg.window = window
 	wg.windows = make(map[string]Window)
 	return
 }
@@ -274,14 +394,10 @@ func (wg *WindowGroup) Close(groupKey string) (window Window, ok bool) {
 }
 
 func (wg *WindowGroup) GroupKey(ingressRow *data.IngressRow) (key string) {
-	var group data.Group
-	var err error
-	if group, err = ingressRow.Group(); err != nil {
-		panic(err)
-	}
+	group := wg.window.Group(*ingressRow)
 
 	key = ""
-	for _, name := range wg.groupFieldNames {
+	for _, name := range wg.window.GroupFieldNames {
 		getMethodName := utility.UpcaseFirstLetter(name)
 		values := operator.InvokeWithoutParameters(group, getMethodName)
 		key += fmt.Sprintf("%v", values[0])
@@ -300,7 +416,7 @@ func (wg *WindowGroup) AllGroupKeys() (keys []string) {
 }
 
 func (e *Engine) SessionWindowWorker() {
-	var filter functions.Filter
+	filter := functions.Filter{Stage: e.ingress.Stage}
 
 	if len(e.window.GroupFieldNames) == 0 {
 		window := []*data.IngressRow{}
@@ -328,7 +444,7 @@ func (e *Engine) SessionWindowWorker() {
 			}
 		}
 	} else {
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
+		wg := CreateWindowGroup(&e.window)
 
 		for {
 			ingressRow := <-e.ingressFilterToWindowChannel
@@ -409,7 +525,7 @@ func (e *Engine) LiveTimeWindowWorker() {
 			}
 		}
 	} else {
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
+		wg := CreateWindowGroup(&e.window)
 		for {
 			go func() {
 				for {
@@ -454,7 +570,7 @@ func (e *Engine) ReplayTimeWindowWorker() {
 		window := Window{}
 		for {
 			ingressRow := <-e.ingressFilterToWindowChannel
-			t := operator.Timestamp(ingressRow, e.window.SequenceField)
+			t := e.window.Timestamp(ingressRow, e.window.SequenceField)
 
 			if hi.Before(t) { // hi < t
 				// Close the window and emit it, and add the current row to a new window.
@@ -470,11 +586,11 @@ func (e *Engine) ReplayTimeWindowWorker() {
 			}
 		}
 	} else { // with grouping
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
+		wg := CreateWindowGroup(&e.window)
 
 		for {
 			ingressRow := <-e.ingressFilterToWindowChannel
-			t := operator.Timestamp(ingressRow, e.window.SequenceField)
+			t := e.window.Timestamp(ingressRow, e.window.SequenceField)
 
 			if hi.Before(t) { // hi < t
 				// Close all windows and emit them.
@@ -500,7 +616,7 @@ func (e *Engine) ReplayDistanceWindowWorker() {
 		window := Window{}
 		for {
 			ingressRow := <-e.ingressFilterToWindowChannel
-			r := operator.Rowstamp(ingressRow, e.window.IntervalField)
+			r := e.window.Rowstamp(ingressRow, e.window.IntervalField)
 
 			if hi < r {
 				// Close the window and emit it, and add the current row to a new window.
@@ -516,11 +632,11 @@ func (e *Engine) ReplayDistanceWindowWorker() {
 			}
 		}
 	} else { // with grouping
-		wg := CreateWindowGroup(e.window.GroupFieldNames)
+		wg := CreateWindowGroup(&e.window)
 
 		for {
 			ingressRow := <-e.ingressFilterToWindowChannel
-			r := operator.Rowstamp(ingressRow, e.window.SequenceField)
+			r := e.window.Rowstamp(ingressRow, e.window.SequenceField)
 
 			if hi < r {
 				// Close all windows and emit them.
@@ -555,11 +671,7 @@ func (e *Engine) AggregateWorker() {
 		// 	log.Info().Msgf("AggregateWorker: row %d: %v", i, ingressRow)
 		// }
 
-		var group data.Group
-		ingressRow := window[0]
-		if group, err = ingressRow.Group(); err != nil {
-			panic(err)
-		}
+		group := e.aggregate.Group(*window[0])
 
 		for _, ingressRow := range window {
 			e.aggregate.Update(*ingressRow)
@@ -570,17 +682,14 @@ func (e *Engine) AggregateWorker() {
 			panic(err)
 		}
 		e.aggregate.Value(&aggregateRow)
-
-		if err = aggregateRow.SetGroup(group); err != nil {
-			panic(err)
-		}
+		e.aggregate.SetGroup(aggregateRow, group)
 
 		e.aggregateToAggregateFilterChannel <- &aggregateRow
 	}
 }
 
 func (e *Engine) AggregateFilterWorker() {
-	var filter functions.Filter
+	filter := functions.Filter{Stage: e.ingress.Stage}
 	for {
 		aggregateRow := <-e.aggregateToAggregateFilterChannel
 		pass := filter.EvalAggregateFilter(*aggregateRow)
@@ -608,7 +717,7 @@ func (e *Engine) ProjectWorker() {
 }
 
 func (e *Engine) ProjectFilterWorker() {
-	var filter functions.Filter
+	filter := functions.Filter{Stage: e.ingress.Stage}
 	for {
 		egressRow := <-e.projectToProjectFilterChannel
 		pass := filter.EvalProjectFilter(*egressRow)
@@ -619,43 +728,47 @@ func (e *Engine) ProjectFilterWorker() {
 }
 
 func (e *Engine) EgressWorker() {
-	csvWriter := csv.NewWriter(e.writer)
-	csvWriter.Comma = common.CsvSeparator
+	filter := functions.Filter{Stage: e.ingress.Stage}
+	e.sinkMutex.Lock()
+	e.sinkWriters = e.openSinks()
+	e.sinkMutex.Unlock()
+
+	var names []string
+	names = append(names, e.egress.OutputFieldNames...)
+	names = append(names, e.egress.GroupFieldNames...)
 
 	for {
 		egressRow := <-e.projectFilterToEgressChannel
 
-		var payload data.EgressPayload
-		var err error
-		if payload, err = egressRow.Payload(); err != nil {
-			panic(err)
-		}
-
-		var group data.Group
-		if group, err = egressRow.Group(); err != nil {
-			panic(err)
-		}
+		payload := e.egress.Payload(*egressRow)
+		group := e.egress.Group(*egressRow)
 
-		var record []string
+		var values []interface{}
 		for _, fieldName := range e.egress.OutputFieldNames {
 			getMethodName := utility.UpcaseFirstLetter(fieldName)
-			values := operator.InvokeWithoutParameters(payload, getMethodName)
-			value := values[0]
-			text := fmt.Sprintf("%v", value)
-			record = append(record, text)
+			results := operator.InvokeWithoutParameters(payload, getMethodName)
+			values = append(values, results[0].Interface())
 		}
 
 		// Append the group values
 		for _, fieldName := range e.egress.GroupFieldNames {
 			getMethodName := utility.UpcaseFirstLetter(fieldName)
-			values := operator.InvokeWithoutParameters(group, getMethodName)
-			value := values[0]
-			text := fmt.Sprintf("%v", value)
-			record = append(record, text)
+			results := operator.InvokeWithoutParameters(group, getMethodName)
+			values = append(values, results[0].Interface())
 		}
 
-		csvWriter.Write(record)
-		csvWriter.Flush()
+		// Each sink gets the rows that pass its own filter.
+		e.sinkMutex.Lock()
+		if e.stopped {
+			e.sinkMutex.Unlock()
+			return
+		}
+		for i := range e.sinkWriters {
+			if filter.EvalSinkFilter(e.sinkWriters[i].index, *egressRow) {
+				e.sinkWriters[i].write(names, values)
+			}
+		}
+		e.sinkMutex.Unlock()
 	}
 }
 
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/xsnout/grizzly/pkg/common"
+	"github.com/xsnout/grizzly/pkg/compiler"
+)
+
+// OpenSink opens the output of a sink.  The location is one of
+//
+//	/path/to/file.csv     a file (rows are appended) or a named pipe (FIFO)
+//	"-"                   stdout
+//	tcp://host:port       a TCP socket
+//	unix:///path/to/sock  a Unix domain socket
+func OpenSink(location string) (writer io.WriteCloser, err error) {
+	switch {
+	case location == "-":
+		return os.Stdout, nil
+	case strings.HasPrefix(location, "tcp://"):
+		return net.Dial("tcp", strings.TrimPrefix(location, "tcp://"))
+	case strings.HasPrefix(location, "unix://"):
+		return net.Dial("unix", strings.TrimPrefix(location, "unix://"))
+	default:
+		return os.OpenFile(location, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+}
+
+// AddSink overrides the location of a sink given in the "to" clause.
+func (e *Engine) AddSink(tableName string, writer io.Writer) {
+	e.sinks[tableName] = writer
+}
+
+type sinkWriter struct {
+	index       int
+	format      string
+	csvWriter   *csv.Writer
+	jsonEncoder *json.Encoder
+	records     []chan []string // Inputs of the later queries
+}
+
+// openSinks opens the outputs of the sinks.  The engine closes the ones that it opened when it stops.
+func (e *Engine) openSinks() (writers []sinkWriter) {
+	for i, sink := range e.egress.Sinks {
+		if records, ok := e.outputs[sink.Name]; ok {
+			writers = append(writers, sinkWriter{index: i, records: records})
+			continue
+		}
+
+		writer, ok := e.sinks[sink.Name]
+		if !ok {
+			if sink.Location == "" {
+				writer = e.writer
+			} else {
+				file, err := OpenSink(sink.Location)
+				if err != nil {
+					panic(err)
+				}
+				if sink.Location != "-" {
+					e.sinkFiles = append(e.sinkFiles, file)
+				}
+				writer = file
+			}
+		}
+
+		w := sinkWriter{
+			index:  i,
+			format: sink.Format,
+		}
+		switch sink.Format {
+		case compiler.SinkFormatJson:
+			w.jsonEncoder = json.NewEncoder(writer)
+		case compiler.SinkFormatCsv, "":
+			w.csvWriter = csv.NewWriter(writer)
+			w.csvWriter.Comma = common.CsvSeparator
+		default:
+			panic(fmt.Errorf("unknown format %s of sink %s", sink.Format, sink.Name))
+		}
+		writers = append(writers, w)
+	}
+	return
+}
+
+// Writes a single row, either as a CSV record or as a JSON object per line, or passes it on to a
+// later query.
+func (w *sinkWriter) write(names []string, values []interface{}) {
+	if w.jsonEncoder != nil {
+		object := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			object[name] = values[i]
+		}
+		if err := w.jsonEncoder.Encode(object); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	var record []string
+	for _, value := range values {
+		record = append(record, fmt.Sprintf("%v", value))
+	}
+	if w.records != nil {
+		for _, records := range w.records {
+			records <- record
+		}
+		return
+	}
+	if err := w.csvWriter.Write(record); err != nil {
+		panic(err)
+	}
+	w.csvWriter.Flush()
+}
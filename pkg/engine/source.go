@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"github.com/xsnout/grizzly/capnp/grizzly"
+	"github.com/xsnout/grizzly/pkg/catalog"
+	"github.com/xsnout/grizzly/pkg/common"
+	"github.com/xsnout/grizzly/pkg/utility"
+)
+
+// OpenSource opens the input of a source table.  The location is one of
+//
+//	/path/to/file.csv     a file or a named pipe (FIFO)
+//	"-"                   stdin
+//	tcp://host:port       a TCP socket
+//	unix:///path/to/sock  a Unix domain socket
+func OpenSource(location string) (reader io.ReadCloser, err error) {
+	switch {
+	case location == "-":
+		return os.Stdin, nil
+	case strings.HasPrefix(location, "tcp://"):
+		return net.Dial("tcp", strings.TrimPrefix(location, "tcp://"))
+	case strings.HasPrefix(location, "unix://"):
+		return net.Dial("unix", strings.TrimPrefix(location, "unix://"))
+	default:
+		return os.Open(location)
+	}
+}
+
+// AddSource registers the reader of a source table for queries like "from a, b".
+func (e *Engine) AddSource(tableName string, reader io.Reader) {
+	e.sources[tableName] = reader
+}
+
+// CheckCatalog compares the versions of the source tables that the plan was compiled for with the
+// catalog.  If a table only gained fields since then, the engine ignores their values; any other
+// change needs a new plan.
+func (e *Engine) CheckCatalog(index *catalog.Index) (err error) {
+	for _, upstream := range e.upstreams {
+		if err = upstream.CheckCatalog(index); err != nil {
+			return
+		}
+	}
+
+	node, _ := utility.FindFirstNodeByType(&e.planRoot, grizzly.OperatorType_ingress)
+	var fields capnp.StructList[grizzly.Field]
+	if fields, err = node.Fields(); err != nil {
+		return
+	}
+	planned := catalog.ReadFields(fields)
+	if len(e.ingress.SourceTables) > 1 {
+		planned = planned[:len(planned)-1] // The virtual source field
+	}
+
+	for i, tableVersion := range e.ingress.TableVersions {
+		if tableVersion.FullName == "" { // An earlier query
+			continue
+		}
+		var table grizzly.Table
+		if table, err = index.Table(tableVersion.FullName); err != nil {
+			return
+		}
+		if table.Version() == tableVersion.Version {
+			continue
+		}
+		if fields, err = table.Fields(); err != nil {
+			return
+		}
+		current := catalog.ReadFields(fields)
+		if table.Version() < tableVersion.Version || !catalog.IsAppendOnly(planned, current) {
+			return fmt.Errorf("table %s has version %d in the catalog but the plan was compiled for version %d; compile the query again",
+				tableVersion.FullName, table.Version(), tableVersion.Version)
+		}
+		log.Warn().Msgf("table %s has version %d in the catalog but the plan was compiled for version %d; ignoring its %d new fields",
+			tableVersion.FullName, table.Version(), tableVersion.Version, len(current)-len(planned))
+		e.columns[e.ingress.SourceTables[i]] = len(planned)
+	}
+	return
+}
+
+// Reads CSV records and sends them to the channel.  If columns is not zero, longer records are cut
+// to that many values.  If the source name is not empty, it is appended to each record as the value
+// of the virtual source field.
+func readRecords(reader io.Reader, source string, columns int, records chan<- []string) {
+	defer close(records)
+
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = common.CsvSeparator
+	csvReader.Comment = CsvComment
+
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if columns > 0 && len(record) > columns {
+			record = record[:columns]
+		}
+		if source != "" {
+			record = append(record, source)
+		}
+		records <- record
+	}
+}
+
+// Appends the source name to the records of an earlier query.
+func tagRecords(input <-chan []string, source string, records chan<- []string) {
+	defer close(records)
+	for record := range input {
+		records <- append(record, source)
+	}
+}
+
+// Reads all source tables and merges their records into a single channel.  If the query has a
+// "based on" clause, the records are merged by the values of that field, otherwise in the order
+// of their arrival.
+func (e *Engine) mergeSources(records chan<- []string) {
+	var inputs []chan []string
+	for _, tableName := range e.ingress.SourceTables {
+		input := make(chan []string, ChannelCapacity)
+		if records, ok := e.inputs[tableName]; ok { // output of an earlier query
+			go tagRecords(records, tableName, input)
+		} else if reader, ok := e.sources[tableName]; ok {
+			go readRecords(reader, tableName, e.columns[tableName], input)
+		} else {
+			panic(fmt.Errorf("no input for source table %s", tableName))
+		}
+		inputs = append(inputs, input)
+	}
+
+	if e.window.SequenceField == "" {
+		mergeByArrival(inputs, records)
+	} else {
+		mergeBySequence(inputs, records, e.sequenceLess(e.window.SequenceField))
+	}
+}
+
+func mergeByArrival(inputs []chan []string, output chan<- []string) {
+	var wg sync.WaitGroup
+	for _, input := range inputs {
+		wg.Add(1)
+		go func(input chan []string) {
+			defer wg.Done()
+			for record := range input {
+				output <- record
+			}
+		}(input)
+	}
+	wg.Wait()
+	close(output)
+}
+
+// K-way merge of the inputs, assuming that each input is sorted already.  We need to know the
+// next record of every open input before we can emit a record, i.e., a slow input holds back
+// the others.
+func mergeBySequence(inputs []chan []string, output chan<- []string, less func(a []string, b []string) bool) {
+	heads := make([][]string, len(inputs))
+	open := make([]bool, len(inputs))
+	for i, input := range inputs {
+		heads[i], open[i] = <-input
+	}
+
+	for {
+		next := -1
+		for i := range inputs {
+			if open[i] && (next < 0 || less(heads[i], heads[next])) {
+				next = i
+			}
+		}
+		if next < 0 { // all inputs are exhausted
+			close(output)
+			return
+		}
+		output <- heads[next]
+		heads[next], open[next] = <-inputs[next]
+	}
+}
+
+func (e *Engine) sequenceLess(fieldName string) func(a []string, b []string) bool {
+	index := -1
+	for i, name := range e.ingress.OutputFieldNames {
+		if name == fieldName {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		panic(fmt.Errorf("cannot find sequence field %s", fieldName))
+	}
+
+	switch typ := e.ingress.OutputFieldTypes[index]; typ {
+	case grizzly.FieldType_text: // timestamp
+		return func(a []string, b []string) bool {
+			return parseTimestamp(a[index]).Before(parseTimestamp(b[index]))
+		}
+	case grizzly.FieldType_integer64:
+		return func(a []string, b []string) bool {
+			return parseInteger(a[index]) < parseInteger(b[index])
+		}
+	case grizzly.FieldType_float64:
+		return func(a []string, b []string) bool {
+			return parseFloat(a[index]) < parseFloat(b[index])
+		}
+	default:
+		panic(fmt.Errorf("cannot merge sources based on field %s of type %v", fieldName, typ))
+	}
+}
+
+func parseTimestamp(s string) (t time.Time) {
+	var err error
+	if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func parseInteger(s string) (i int64) {
+	var err error
+	if i, err = strconv.ParseInt(s, 10, 64); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func parseFloat(s string) (f float64) {
+	var err error
+	if f, err = strconv.ParseFloat(s, 64); err != nil {
+		panic(err)
+	}
+	return
+}
@@ -0,0 +1,243 @@
+package functor
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/xsnout/grizzly/capnp/grizzly"
+)
+
+const (
+	// DefaultEpsilon and DefaultDelta give a Count-Min Sketch of 2719 x 5 counters: with
+	// probability 1 - delta, an estimated count is at most epsilon * (number of values) too high.
+	DefaultEpsilon = 0.001
+	DefaultDelta   = 0.01
+)
+
+// CountMinSketch estimates how often each value occurs in a stream in fixed memory.  Estimates are
+// never too low; hash collisions can make them too high.  Sketches of the same size can be merged.
+type CountMinSketch struct {
+	Width  uint32
+	Depth  uint32
+	Counts []uint64 // Depth rows of Width counters
+}
+
+// NewCountMinSketch returns a sketch whose estimates are at most epsilon * (number of values) too
+// high with probability 1 - delta.
+func NewCountMinSketch(epsilon float64, delta float64) *CountMinSketch {
+	width := uint32(math.Ceil(math.E / epsilon))
+	depth := uint32(math.Ceil(math.Log(1 / delta)))
+	return &CountMinSketch{Width: width, Depth: depth, Counts: make([]uint64, width*depth)}
+}
+
+// Reset zeroes the counters but keeps their memory.
+func (s *CountMinSketch) Reset() {
+	clear(s.Counts)
+}
+
+// Add counts the value and returns its new estimated count.
+func (s *CountMinSketch) Add(value interface{}) uint64 {
+	estimate := uint64(math.MaxUint64)
+	h1, h2 := hashes(value)
+	for i := uint32(0); i < s.Depth; i++ {
+		c := &s.Counts[i*s.Width+s.column(h1, h2, i)]
+		*c++
+		estimate = min(estimate, *c)
+	}
+	return estimate
+}
+
+func (s *CountMinSketch) Estimate(value interface{}) uint64 {
+	estimate := uint64(math.MaxUint64)
+	h1, h2 := hashes(value)
+	for i := uint32(0); i < s.Depth; i++ {
+		estimate = min(estimate, s.Counts[i*s.Width+s.column(h1, h2, i)])
+	}
+	return estimate
+}
+
+// column derives the hash of row i from two hashes (Kirsch & Mitzenmacher).
+func (s *CountMinSketch) column(h1 uint32, h2 uint32, i uint32) uint32 {
+	return (h1 + i*h2) % s.Width
+}
+
+func (s *CountMinSketch) Merge(other *CountMinSketch) error {
+	if s.Width != other.Width || s.Depth != other.Depth {
+		return fmt.Errorf("cannot merge a %d x %d sketch into a %d x %d sketch", other.Width, other.Depth, s.Width, s.Depth)
+	}
+	for i, c := range other.Counts {
+		s.Counts[i] += c
+	}
+	return nil
+}
+
+// Encode returns the sketch as base64 text: the width and depth, and then the counters, all
+// little-endian.
+func (s *CountMinSketch) Encode() string {
+	buf := make([]byte, 8+8*len(s.Counts))
+	binary.LittleEndian.PutUint32(buf[0:], s.Width)
+	binary.LittleEndian.PutUint32(buf[4:], s.Depth)
+	for i, c := range s.Counts {
+		binary.LittleEndian.PutUint64(buf[8+8*i:], c)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func DecodeCountMinSketch(text string) (s *CountMinSketch, err error) {
+	var buf []byte
+	if buf, err = base64.StdEncoding.DecodeString(text); err != nil {
+		return nil, err
+	}
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("count-min sketch is too short")
+	}
+	s = &CountMinSketch{Width: binary.LittleEndian.Uint32(buf[0:]), Depth: binary.LittleEndian.Uint32(buf[4:])}
+	if uint64(len(buf)) != 8+8*uint64(s.Width)*uint64(s.Depth) {
+		return nil, fmt.Errorf("count-min sketch of %d x %d counters has %d bytes", s.Width, s.Depth, len(buf))
+	}
+	s.Counts = make([]uint64, s.Width*s.Depth)
+	for i := range s.Counts {
+		s.Counts[i] = binary.LittleEndian.Uint64(buf[8+8*i:])
+	}
+	return s, nil
+}
+
+// hashes returns the two halves of the 64-bit hash of a value.
+func hashes(value interface{}) (uint32, uint32) {
+	sum := hash64(value)
+	return uint32(sum), uint32(sum>>32) | 1 // Never 0, so that the rows use different columns
+}
+
+// Sketcher is the functor of "cms(x)".  Its value is the encoded sketch of the window, which a
+// later job can decode with DecodeCountMinSketch, merge, and query.
+type Sketcher struct {
+	Sketch *CountMinSketch
+}
+
+func NewSketcher(epsilon float64, delta float64) *Sketcher {
+	return &Sketcher{Sketch: NewCountMinSketch(epsilon, delta)}
+}
+
+func (f *Sketcher) Init(typ *grizzly.FieldType) {
+	if f.Sketch == nil {
+		f.Sketch = NewCountMinSketch(DefaultEpsilon, DefaultDelta)
+	}
+	f.Reset()
+}
+
+func (f *Sketcher) Reset() {
+	f.Sketch.Reset()
+}
+
+func (f *Sketcher) Update(value interface{}) {
+	f.Sketch.Add(value)
+}
+
+func (f *Sketcher) Value() interface{} {
+	return f.Sketch.Encode()
+}
+
+// TopK finds the k most frequent values of a window, e.g., "topk(url, 10)", with a Count-Min Sketch
+// for the counts and a min-heap of the k values with the highest counts so far.  Its value is a
+// JSON list of values and estimated counts, most frequent first, e.g., `[["/",95],["/api",40]]`.
+type TopK struct {
+	K          int
+	Sketch     *CountMinSketch
+	candidates candidates
+}
+
+func NewTopK(k int, epsilon float64, delta float64) *TopK {
+	return &TopK{K: k, Sketch: NewCountMinSketch(epsilon, delta)}
+}
+
+func (f *TopK) Init(typ *grizzly.FieldType) {
+	if f.Sketch == nil {
+		f.Sketch = NewCountMinSketch(DefaultEpsilon, DefaultDelta)
+	}
+	f.Reset()
+}
+
+func (f *TopK) Reset() {
+	f.Sketch.Reset()
+	f.candidates.items = f.candidates.items[:0]
+	if f.candidates.index == nil {
+		f.candidates.index = make(map[interface{}]int, f.K)
+	}
+	clear(f.candidates.index)
+}
+
+func (f *TopK) Update(value interface{}) {
+	count := f.Sketch.Add(value)
+	if x, ok := value.(float64); ok && math.IsNaN(x) {
+		value = nil // JSON has no NaN, and nil is equal to itself
+	}
+	c := &f.candidates
+	if i, found := c.index[value]; found {
+		c.items[i].count = count
+		heap.Fix(c, i)
+	} else if len(c.items) < f.K {
+		heap.Push(c, candidate{value: value, count: count})
+	} else if len(c.items) > 0 && count > c.items[0].count {
+		delete(c.index, c.items[0].value)
+		c.items[0] = candidate{value: value, count: count}
+		c.index[value] = 0
+		heap.Fix(c, 0)
+	}
+}
+
+func (f *TopK) Value() interface{} {
+	items := append([]candidate(nil), f.candidates.items...)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].count != items[j].count {
+			return items[i].count > items[j].count
+		}
+		return fmt.Sprint(items[i].value) < fmt.Sprint(items[j].value)
+	})
+	pairs := make([][2]interface{}, len(items))
+	for i, item := range items {
+		pairs[i] = [2]interface{}{item.value, item.count}
+	}
+	text, err := json.Marshal(pairs)
+	if err != nil {
+		panic(err)
+	}
+	return string(text)
+}
+
+type candidate struct {
+	value interface{}
+	count uint64
+}
+
+// candidates is a min-heap by count that knows where each value is.
+type candidates struct {
+	items []candidate
+	index map[interface{}]int
+}
+
+func (c *candidates) Len() int           { return len(c.items) }
+func (c *candidates) Less(i, j int) bool { return c.items[i].count < c.items[j].count }
+
+func (c *candidates) Swap(i, j int) {
+	c.items[i], c.items[j] = c.items[j], c.items[i]
+	c.index[c.items[i].value] = i
+	c.index[c.items[j].value] = j
+}
+
+func (c *candidates) Push(x any) {
+	item := x.(candidate)
+	c.index[item.value] = len(c.items)
+	c.items = append(c.items, item)
+}
+
+func (c *candidates) Pop() any {
+	item := c.items[len(c.items)-1]
+	c.items = c.items[:len(c.items)-1]
+	delete(c.index, item.value)
+	return item
+}
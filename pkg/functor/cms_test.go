@@ -0,0 +1,110 @@
+package functor
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// zipf returns a stream of n values where a few are frequent and most are rare, like URLs.
+func zipf(n int) []int64 {
+	random := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(random, 1.2, 1, 9999)
+	values := make([]int64, n)
+	for i := range values {
+		values[i] = int64(z.Uint64())
+	}
+	return values
+}
+
+func TestCountMinSketchErrorBounds(t *testing.T) {
+	const epsilon, delta = 0.001, 0.01
+	values := zipf(100000)
+	s := NewCountMinSketch(epsilon, delta)
+	if s.Width != 2719 || s.Depth != 5 {
+		t.Errorf("sketch has %d x %d counters", s.Width, s.Depth)
+	}
+	counts := make(map[int64]uint64)
+	for _, v := range values {
+		counts[v]++
+		if estimate := s.Add(v); estimate < counts[v] {
+			t.Fatalf("estimate of %d is %d, less than the count %d", v, estimate, counts[v])
+		}
+	}
+
+	bound := uint64(epsilon * float64(len(values)))
+	exceeded := 0
+	for v, count := range counts {
+		estimate := s.Estimate(v)
+		if estimate < count {
+			t.Errorf("estimate of %d is %d, less than the count %d", v, estimate, count)
+		}
+		if estimate-count > bound {
+			exceeded++
+		}
+	}
+	if fraction := float64(exceeded) / float64(len(counts)); fraction > delta {
+		t.Errorf("%.2f%% of the estimates are more than %d too high", 100*fraction, bound)
+	}
+}
+
+// Merging the sketches of two windows gives the sketch of both, e.g., for hourly counts.
+func TestCountMinSketchMerge(t *testing.T) {
+	values := zipf(20000)
+	first := NewCountMinSketch(0.01, 0.01)
+	second := NewCountMinSketch(0.01, 0.01)
+	both := NewCountMinSketch(0.01, 0.01)
+	for i, v := range values {
+		if i%2 == 0 {
+			first.Add(v)
+		} else {
+			second.Add(v)
+		}
+		both.Add(v)
+	}
+
+	decoded, err := DecodeCountMinSketch(second.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = first.Merge(decoded); err != nil {
+		t.Fatal(err)
+	}
+	for i := range both.Counts {
+		if first.Counts[i] != both.Counts[i] {
+			t.Fatalf("counter %d is %d after merging, expected %d", i, first.Counts[i], both.Counts[i])
+		}
+	}
+
+	if err = first.Merge(NewCountMinSketch(0.001, 0.01)); err == nil {
+		t.Errorf("merged sketches of different sizes")
+	}
+	for _, text := range []string{"not base64!", "AAAA", first.Encode()[:20]} {
+		if _, err = DecodeCountMinSketch(text); err == nil {
+			t.Errorf("decoded %q", text)
+		}
+	}
+}
+
+func TestTopK(t *testing.T) {
+	f := NewTopK(2, DefaultEpsilon, DefaultDelta)
+	f.Init(nil)
+	for i := 0; i < 100; i++ {
+		f.Update(int64(i)) // Rare values
+		f.Update("/")
+		if i%2 == 0 {
+			f.Update("/api")
+		}
+	}
+	if actual := f.Value().(string); actual != `[["/",100],["/api",50]]` {
+		t.Errorf("top 2 are %s", actual)
+	}
+
+	f.Reset()
+	f.Update(math.NaN())
+	f.Update(math.NaN())
+	f.Update(1.5)
+	if actual := f.Value().(string); actual != `[[null,2],[1.5,1]]` {
+		t.Errorf("top 2 with NaN are %s", actual)
+	}
+}
@@ -2,11 +2,11 @@ package functor
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"math"
-
-	hll "github.com/DataDog/hyperloglog"
+	"time"
 
 	"github.com/xsnout/grizzly/capnp/grizzly"
 )
@@ -16,6 +16,8 @@ import (
 // 2. updated by using information from a row
 // 3. read by calling `Value`
 // 4. Reset at the window boundary to be ready to aggregate the next values from the upcoming window.
+//
+// A functor with several inputs, like "corr(x, y)", gets a []interface{} with one value per input.
 type Functor interface {
 	Init(typ *grizzly.FieldType)
 	Reset()
@@ -79,7 +81,11 @@ func (f *Counter) Reset() {
 	f.Count = 0
 }
 
-func (f *Counter) Update(ignoreMe interface{}) {
+// Update counts every row, except for a false condition, e.g., in "count(status >= 500)".
+func (f *Counter) Update(value interface{}) {
+	if condition, ok := value.(bool); ok && !condition {
+		return
+	}
 	f.Count++
 }
 
@@ -316,91 +322,527 @@ func (f *Summer) Value() interface{} {
 	return f.Sum
 }
 
+// DistinctCounter counts the distinct values of a window exactly, keyed by the values themselves.
+// With a Limit, e.g., for "distinctcount(user, 100000)", it keeps at most that many values and then
+// falls back to estimating the count with a HyperLogLog, which Approximate tells.
 type DistinctCounter struct {
-	TheType     grizzly.FieldType
-	Counts      map[uint32]int
-	NumDistinct int
+	Limit       int   // Maximum number of values to keep, or 0 for no limit
+	Precision   uint8 // Of the HyperLogLog, or 0 for DefaultPrecision
+	Values      map[interface{}]struct{}
+	HLL         *HyperLogLog // Counts once the window has more than Limit distinct values
+	approximate bool
 }
 
 func (f *DistinctCounter) Init(typ *grizzly.FieldType) {
-	f.TheType = *typ
+	f.Values = make(map[interface{}]struct{})
 	f.Reset()
 }
 
 func (f *DistinctCounter) Reset() {
-	f.Counts = make(map[uint32]int)
-	f.NumDistinct = 0
+	clear(f.Values)
+	f.approximate = false
 }
 
 func (f *DistinctCounter) Update(value interface{}) {
-	key := getHash(f.TheType, value)
-	if _, ok := f.Counts[key]; ok {
-		f.Counts[key]++
-	} else {
-		f.Counts[key] = 1
-		f.NumDistinct++
+	if f.approximate {
+		f.HLL.Add(value)
+		return
+	}
+	if x, ok := value.(float64); ok && math.IsNaN(x) {
+		value = nan{} // NaN isn't equal to itself and would be a new key every time
+	}
+	f.Values[value] = struct{}{}
+	if f.Limit > 0 && len(f.Values) > f.Limit {
+		if f.HLL == nil {
+			if f.Precision == 0 {
+				f.Precision = DefaultPrecision
+			}
+			f.HLL = NewHyperLogLog(f.Precision)
+		}
+		f.HLL.Reset()
+		f.approximate = true
+		for v := range f.Values {
+			if _, ok := v.(nan); ok {
+				v = math.NaN()
+			}
+			f.HLL.Add(v)
+		}
+		clear(f.Values)
 	}
 }
 
 func (f *DistinctCounter) Value() interface{} {
-	return f.NumDistinct
+	if f.approximate {
+		return int64(f.HLL.Count())
+	}
+	return int64(len(f.Values))
+}
+
+// Approximate tells if the window had more than Limit distinct values, so that Value is an estimate.
+func (f *DistinctCounter) Approximate() bool {
+	return f.approximate
+}
+
+type nan struct{}
+
+// Approximation is the flag of "distinctcount(x, limit)" that tells if its count is an estimate.
+// It reads the state of the DistinctCounter and doesn't take values of its own.
+type Approximation struct {
+	Of *DistinctCounter
+}
+
+func (f *Approximation) Init(typ *grizzly.FieldType) {
+}
+
+func (f *Approximation) Reset() {
+}
+
+func (f *Approximation) Update(value interface{}) {
+}
+
+func (f *Approximation) Value() interface{} {
+	return f.Of.Approximate()
+}
+
+// Collector returns the values of a window as a JSON list: with Distinct, e.g., for
+// "collect_set(x)", each value once in the order they first occur; otherwise, e.g., for
+// "collect_list(x, 100)", the first Limit values.
+type Collector struct {
+	Distinct bool
+	Limit    int // Maximum number of values, or 0 for no limit
+	values   []interface{}
+	seen     map[interface{}]struct{}
+}
+
+func (f *Collector) Init(typ *grizzly.FieldType) {
+	f.seen = make(map[interface{}]struct{})
+	f.Reset()
+}
+
+func (f *Collector) Reset() {
+	f.values = f.values[:0]
+	clear(f.seen)
+}
+
+func (f *Collector) Update(value interface{}) {
+	if f.Limit > 0 && len(f.values) >= f.Limit {
+		return
+	}
+	if x, ok := value.(float64); ok && math.IsNaN(x) {
+		value = nil // JSON has no NaN, and nil is equal to itself
+	}
+	if f.Distinct {
+		if _, found := f.seen[value]; found {
+			return
+		}
+		f.seen[value] = struct{}{}
+	}
+	f.values = append(f.values, value)
+}
+
+func (f *Collector) Value() interface{} {
+	values := f.values
+	if values == nil {
+		values = []interface{}{} // "[]" rather than "null"
+	}
+	text, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	return string(text)
 }
 
+// Uniquer estimates the number of distinct values of a window with a HyperLogLog, e.g., for
+// "uniq(user, 14)".  With Encoded, e.g., for "hll(user, 14)", its value is the encoded sketch
+// instead, which a later query can merge with UniqueMerger.
 type Uniquer struct {
-	TheType grizzly.FieldType
-	HLL     *hll.HyperLogLog
+	Precision uint8
+	Encoded   bool
+	HLL       *HyperLogLog
 }
 
 func (f *Uniquer) Init(typ *grizzly.FieldType) {
-	f.TheType = *typ
-	f.Reset()
+	switch {
+	case f.Precision != 0:
+	case f.Encoded:
+		f.Precision = DefaultEncodedPrecision
+	default:
+		f.Precision = DefaultPrecision
+	}
+	f.HLL = NewHyperLogLog(f.Precision)
 }
 
 func (f *Uniquer) Reset() {
-	const i int = 17
-	m := uint(math.Pow(2, float64(i)))
-	if h, err := hll.New(m); err != nil {
-		panic(fmt.Errorf("cannot make New(%d): %v", m, err))
-	} else {
-		f.HLL = h
-	}
+	f.HLL.Reset()
 }
 
 func (f *Uniquer) Update(value interface{}) {
-	f.HLL.Add(getHash(f.TheType, value))
+	f.HLL.Add(value)
 }
 
 func (f *Uniquer) Value() interface{} {
+	if f.Encoded {
+		return f.HLL.Encode()
+	}
+	return f.HLL.Count()
+}
+
+// UniqueMerger merges the encoded HyperLogLogs of earlier windows, e.g., for "uniq_merge(users)"
+// over per-minute sketches, and estimates the number of distinct values of all of them.
+type UniqueMerger struct {
+	HLL *HyperLogLog // Nil until the first sketch tells the precision
+}
+
+func (f *UniqueMerger) Init(typ *grizzly.FieldType) {
+	f.Reset()
+}
+
+func (f *UniqueMerger) Reset() {
+	if f.HLL != nil {
+		f.HLL.Reset()
+	}
+}
+
+func (f *UniqueMerger) Update(value interface{}) {
+	var err error
+	text := value.(string)
+	if f.HLL == nil {
+		if f.HLL, err = DecodeHyperLogLog(text); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if err = f.HLL.MergeEncoded(text); err != nil {
+		panic(err)
+	}
+}
+
+func (f *UniqueMerger) Value() interface{} {
+	if f.HLL == nil {
+		return uint64(0)
+	}
 	return f.HLL.Count()
 }
 
-func getHash(typ grizzly.FieldType, value interface{}) (result uint32) {
-	hash := fnv.New32()
+// Percentile estimates a quantile of the values in a window, e.g., the 0.99 quantile for
+// "percentile(latency, 0.99)", with a t-digest.
+type Percentile struct {
+	TheType   grizzly.FieldType
+	Quantiles []float64
+	Digest    *TDigest
+}
+
+func NewPercentile(quantiles []float64, compression float64) *Percentile {
+	return &Percentile{Quantiles: quantiles, Digest: NewTDigest(compression)}
+}
+
+func (f *Percentile) Init(typ *grizzly.FieldType) {
+	f.TheType = *typ
+	if f.Digest == nil {
+		f.Digest = NewTDigest(DefaultCompression)
+	}
+	f.Reset()
+}
+
+func (f *Percentile) Reset() {
+	f.Digest.Reset()
+}
 
-	switch typ {
+func (f *Percentile) Update(value interface{}) {
+	switch f.TheType {
 	case grizzly.FieldType_float64:
-		hash.Write([]byte(float64ToBytes(value.(float64))))
+		f.Digest.Add(value.(float64))
 	case grizzly.FieldType_integer64:
-		hash.Write([]byte(int64ToBytes(int64(value.(int64)))))
-	case grizzly.FieldType_text:
-		hash.Write([]byte(value.(string)))
+		f.Digest.Add(float64(value.(int64)))
 	default:
-		panic(fmt.Errorf("unknown type %v", typ))
+		panic(fmt.Errorf("unknown type %v", f.TheType.String()))
 	}
+}
 
-	result = hash.Sum32()
-	hash.Reset()
-	return
+func (f *Percentile) Value() interface{} {
+	return f.Digest.Quantile(f.Quantiles[0])
 }
 
-func float64ToBytes(f float64) []byte {
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], math.Float64bits(f))
-	return buf[:]
+// Quantiles estimates several quantiles at once, e.g., "quantiles(latency, 0.5, 0.9, 0.99)".  The
+// value is a JSON list of the quantiles, e.g., "[12,40.5,98.25]", with null for those of an empty
+// window.
+type Quantiles struct {
+	Percentile
+}
+
+func NewQuantiles(quantiles []float64, compression float64) *Quantiles {
+	return &Quantiles{Percentile: *NewPercentile(quantiles, compression)}
+}
+
+func (f *Quantiles) Value() interface{} {
+	values := make([]interface{}, len(f.Quantiles))
+	for i, q := range f.Quantiles {
+		if x := f.Digest.Quantile(q); !math.IsNaN(x) {
+			values[i] = x // JSON has no NaN, so the others stay nil
+		}
+	}
+	text, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	return string(text)
+}
+
+// Statistic selects what Moments computes.
+type Statistic int
+
+const (
+	SampleVariance Statistic = iota
+	PopulationVariance
+	SampleStandardDeviation
+	PopulationStandardDeviation
+	Skewness
+	Kurtosis // Excess kurtosis, 0 for a normal distribution
+)
+
+// Moments computes the variance, standard deviation, skewness, or kurtosis of the values in a
+// window in one pass with Welford's algorithm, extended to the third and fourth moments.  Unlike
+// the textbook formulas with sums of squares, it doesn't lose precision for large values with a
+// small spread.
+type Moments struct {
+	Statistic Statistic
+	Count     float64
+	Mean      float64
+	M2        float64 // Sums of the powers of the differences from the mean
+	M3        float64
+	M4        float64
+}
+
+func (f *Moments) Init(typ *grizzly.FieldType) {
+	f.Reset()
+}
+
+func (f *Moments) Reset() {
+	f.Count = 0
+	f.Mean = 0
+	f.M2 = 0
+	f.M3 = 0
+	f.M4 = 0
+}
+
+func (f *Moments) Update(value interface{}) {
+	x := toFloat64(value)
+	n1 := f.Count
+	f.Count++
+	n := f.Count
+	delta := x - f.Mean
+	deltaN := delta / n
+	deltaN2 := deltaN * deltaN
+	term1 := delta * deltaN * n1
+	f.Mean += deltaN
+	f.M4 += term1*deltaN2*(n*n-3*n+3) + 6*deltaN2*f.M2 - 4*deltaN*f.M3
+	f.M3 += term1*deltaN*(n-2) - 3*deltaN*f.M2
+	f.M2 += term1
+}
+
+// Value is NaN if there are too few values, e.g., for the sample variance of a single value.
+func (f *Moments) Value() interface{} {
+	n := f.Count
+	switch f.Statistic {
+	case SampleVariance:
+		return f.M2 / (n - 1)
+	case PopulationVariance:
+		return f.M2 / n
+	case SampleStandardDeviation:
+		return math.Sqrt(f.M2 / (n - 1))
+	case PopulationStandardDeviation:
+		return math.Sqrt(f.M2 / n)
+	case Skewness:
+		return math.Sqrt(n) * f.M3 / math.Pow(f.M2, 1.5)
+	case Kurtosis:
+		return n*f.M4/(f.M2*f.M2) - 3
+	default:
+		panic(fmt.Errorf("unknown statistic %d", f.Statistic))
+	}
 }
 
-func int64ToBytes(i int64) []byte {
+// Comoments computes the covariance or the correlation of two inputs, e.g., "corr(x, y)", in one
+// pass like Moments.
+type Comoments struct {
+	Correlation bool // Pearson correlation instead of the covariance
+	Population  bool // Population instead of sample covariance
+	Count       float64
+	MeanX       float64
+	MeanY       float64
+	C           float64 // Sum of the products of the differences from the means
+	M2X         float64
+	M2Y         float64
+}
+
+func (f *Comoments) Init(typ *grizzly.FieldType) {
+	f.Reset()
+}
+
+func (f *Comoments) Reset() {
+	f.Count = 0
+	f.MeanX = 0
+	f.MeanY = 0
+	f.C = 0
+	f.M2X = 0
+	f.M2Y = 0
+}
+
+func (f *Comoments) Update(value interface{}) {
+	values := value.([]interface{})
+	x, y := toFloat64(values[0]), toFloat64(values[1])
+	f.Count++
+	dx := x - f.MeanX
+	dy := y - f.MeanY
+	f.MeanX += dx / f.Count
+	f.MeanY += dy / f.Count
+	f.C += dx * (y - f.MeanY)
+	f.M2X += dx * (x - f.MeanX)
+	f.M2Y += dy * (y - f.MeanY)
+}
+
+func (f *Comoments) Value() interface{} {
+	switch {
+	case f.Correlation:
+		return f.C / math.Sqrt(f.M2X*f.M2Y)
+	case f.Population:
+		return f.C / f.Count
+	default:
+		return f.C / (f.Count - 1)
+	}
+}
+
+// Change selects what Changes computes.
+type Change int
+
+const (
+	Increase   Change = iota // Increase of a counter, e.g., bytes sent
+	Rate                     // Increase of a counter per second
+	Delta                    // Difference between the last and the first value of a gauge
+	Derivative               // Slope of a gauge per second by linear regression
+)
+
+// Changes computes how much the values of a window change over time, e.g., "rate(bytes)".  It gets
+// each value with the timestamp of its row, and the rows must be in time order.  Like Prometheus,
+// Increase and Rate take a counter that drops as reset to 0, so that they add the value after the
+// drop.  They don't extrapolate to the bounds of the window, i.e., they measure the change between
+// the first and the last row.
+type Changes struct {
+	Change     Change
+	Count      int64
+	FirstTime  time.Time
+	LastTime   time.Time
+	First      float64
+	Last       float64
+	Increase   float64   // Sum of the increases, with resets
+	Regression Comoments // Of the seconds since the first row and the values
+}
+
+func (f *Changes) Init(typ *grizzly.FieldType) {
+	f.Reset()
+}
+
+func (f *Changes) Reset() {
+	f.Count = 0
+	f.Increase = 0
+	f.Regression.Reset()
+}
+
+func (f *Changes) Update(value interface{}) {
+	values := value.([]interface{})
+	x := toFloat64(values[0])
+	t := toTime(values[1])
+	switch {
+	case f.Count == 0:
+		f.First, f.FirstTime = x, t
+	case x >= f.Last:
+		f.Increase += x - f.Last
+	default: // The counter was reset
+		f.Increase += x
+	}
+	f.Last, f.LastTime = x, t
+	f.Count++
+	f.Regression.Update([]interface{}{t.Sub(f.FirstTime).Seconds(), x})
+}
+
+// Value is NaN for fewer than two rows, and Rate and Derivative are NaN if the rows have the same
+// timestamp.
+func (f *Changes) Value() interface{} {
+	if f.Count < 2 {
+		return math.NaN()
+	}
+	seconds := f.LastTime.Sub(f.FirstTime).Seconds()
+	switch f.Change {
+	case Increase:
+		return f.Increase
+	case Rate:
+		if seconds <= 0 {
+			return math.NaN()
+		}
+		return f.Increase / seconds
+	case Delta:
+		return f.Last - f.First
+	case Derivative:
+		return f.Regression.C / f.Regression.M2X
+	default:
+		panic(fmt.Errorf("unknown change %d", f.Change))
+	}
+}
+
+// toTime takes a timestamp as time.Time or as RFC 3339 text, which is how rows store them.
+func toTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	default:
+		panic(fmt.Errorf("unknown type %T of timestamp %v", value, value))
+	}
+}
+
+func toFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	default:
+		panic(fmt.Errorf("unknown type %T of value %v", value, value))
+	}
+}
+
+// hash64 returns a 64-bit hash of a value.
+func hash64(value interface{}) uint64 {
+	h := fnv.New64a()
 	var buf [8]byte
-	binary.LittleEndian.PutUint64(buf[:], uint64(i))
-	return buf[:]
+	switch v := value.(type) {
+	case string:
+		h.Write([]byte(v))
+	case int64:
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		h.Write(buf[:])
+	case float64:
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		h.Write(buf[:])
+	case bool:
+		if v {
+			buf[0] = 1
+		}
+		h.Write(buf[:1])
+	default:
+		panic(fmt.Errorf("unknown type %T of value %v", value, value))
+	}
+	// FNV mixes the last bytes poorly into the high bits, so finish with the finalizer of
+	// MurmurHash3.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
 }
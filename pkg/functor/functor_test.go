@@ -0,0 +1,173 @@
+package functor
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/xsnout/grizzly/capnp/grizzly"
+)
+
+// Rows have the values of int64, float64, text, and boolean fields; timestamps are RFC 3339 text.
+func TestDistinctCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []interface{}
+		expected int64
+	}{
+		{"integers", []interface{}{int64(1), int64(2), int64(1), int64(-1)}, 3},
+		{"floats", []interface{}{1.5, 2.5, 1.5, 0.0}, 3},
+		{"texts", []interface{}{"a", "b", "a", ""}, 3},
+		{"booleans", []interface{}{true, false, true, true}, 2},
+		{"NaN is one value", []interface{}{math.NaN(), 1.0, math.NaN()}, 2},
+	}
+	for _, test := range tests {
+		var f DistinctCounter
+		f.Init(nil)
+		for _, value := range test.values {
+			f.Update(value)
+		}
+		if actual := f.Value().(int64); actual != test.expected || f.Approximate() {
+			t.Errorf("%s: %d (approximate %v), expected %d", test.name, actual, f.Approximate(), test.expected)
+		}
+	}
+}
+
+// Beyond the limit, the count is an estimate of a HyperLogLog with the given precision.
+func TestDistinctCounterLimit(t *testing.T) {
+	f := DistinctCounter{Limit: 100, Precision: 12}
+	f.Init(nil)
+	for i := 0; i < 100; i++ {
+		f.Update(int64(i))
+		f.Update(int64(i))
+	}
+	if f.Approximate() || f.Value().(int64) != 100 {
+		t.Errorf("exact up to the limit: %d (approximate %v)", f.Value(), f.Approximate())
+	}
+
+	f.Update(math.NaN())
+	if !f.Approximate() {
+		t.Fatalf("not approximate beyond the limit")
+	}
+	if f.HLL.Precision != 12 {
+		t.Errorf("HyperLogLog has precision %d", f.HLL.Precision)
+	}
+	for i := 0; i < 10000; i++ {
+		f.Update(int64(i))
+		f.Update(math.NaN())
+	}
+	// The standard error with 2^12 registers is 1.6%.
+	if estimate := f.Value().(int64); math.Abs(float64(estimate)-10001)/10001 > 0.05 {
+		t.Errorf("estimate of 10001 distinct values is %d", estimate)
+	}
+
+	f.Reset()
+	f.Update(true)
+	if f.Approximate() || f.Value().(int64) != 1 {
+		t.Errorf("exact again after a reset: %d (approximate %v)", f.Value(), f.Approximate())
+	}
+	approximation := Approximation{Of: &f}
+	if approximation.Value().(bool) {
+		t.Errorf("approximation of an exact count")
+	}
+}
+
+func TestDistinctCounterDefaultPrecision(t *testing.T) {
+	f := DistinctCounter{Limit: 1}
+	f.Init(nil)
+	f.Update("a")
+	f.Update("b")
+	if f.HLL.Precision != DefaultPrecision {
+		t.Errorf("HyperLogLog has precision %d", f.HLL.Precision)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	tests := []struct {
+		name     string
+		f        Collector
+		values   []interface{}
+		expected string
+	}{
+		{"set", Collector{Distinct: true}, []interface{}{"b", "a", "b"}, `["b","a"]`},
+		{"set with a limit", Collector{Distinct: true, Limit: 2}, []interface{}{int64(1), int64(1), int64(2), int64(3)}, `[1,2]`},
+		{"set of booleans", Collector{Distinct: true}, []interface{}{false, false, true}, `[false,true]`},
+		{"set with NaN", Collector{Distinct: true}, []interface{}{math.NaN(), 1.5, math.NaN()}, `[null,1.5]`},
+		{"list", Collector{}, []interface{}{"b", "a", "b"}, `["b","a","b"]`},
+		{"list with a limit", Collector{Limit: 2}, []interface{}{1.5, 1.5, 2.5}, `[1.5,1.5]`},
+		{"empty list", Collector{}, nil, `[]`},
+	}
+	for _, test := range tests {
+		f := test.f
+		typ := grizzly.FieldType_text
+		f.Init(&typ)
+		f.Update("stale")
+		f.Reset()
+		for _, value := range test.values {
+			f.Update(value)
+		}
+		if actual := f.Value().(string); actual != test.expected {
+			t.Errorf("%s: %s, expected %s", test.name, actual, test.expected)
+		}
+	}
+}
+
+// update passes a value and the timestamp of its row, seconds after the start of the window.
+func update(f *Changes, value interface{}, seconds int) {
+	at := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC).Add(time.Duration(seconds) * time.Second)
+	f.Update([]interface{}{value, at.Format(time.RFC3339Nano)})
+}
+
+func TestChanges(t *testing.T) {
+	tests := []struct {
+		change   Change
+		expected float64
+	}{
+		{Increase, 13}, // 5, then 3 after the counter was reset, then 5
+		{Rate, 13.0 / 30},
+		{Delta, -2},
+		{Derivative, -0.18},
+	}
+	for _, test := range tests {
+		f := Changes{Change: test.change}
+		f.Init(nil)
+		update(&f, 99.0, 0)
+		f.Reset()
+
+		update(&f, int64(10), 0)
+		update(&f, int64(15), 10)
+		update(&f, int64(3), 20)
+		update(&f, 8.0, 30)
+		if actual := f.Value().(float64); math.Abs(actual-test.expected) > 1e-9 {
+			t.Errorf("change %d is %v, expected %v", test.change, actual, test.expected)
+		}
+	}
+}
+
+func TestChangesWithoutTime(t *testing.T) {
+	for _, change := range []Change{Increase, Rate, Delta, Derivative} {
+		f := Changes{Change: change}
+		f.Init(nil)
+		if actual := f.Value().(float64); !math.IsNaN(actual) {
+			t.Errorf("change %d of no rows is %v", change, actual)
+		}
+		update(&f, 1.0, 0)
+		if actual := f.Value().(float64); !math.IsNaN(actual) {
+			t.Errorf("change %d of a single row is %v", change, actual)
+		}
+
+		// The rows have the same timestamp, so there is no time to divide by.
+		update(&f, 3.0, 0)
+		actual := f.Value().(float64)
+		switch change {
+		case Rate, Derivative:
+			if !math.IsNaN(actual) {
+				t.Errorf("change %d without elapsed time is %v", change, actual)
+			}
+		default:
+			if actual != 2 {
+				t.Errorf("change %d without elapsed time is %v, expected 2", change, actual)
+			}
+		}
+	}
+}
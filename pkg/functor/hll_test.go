@@ -0,0 +1,162 @@
+package functor
+
+import (
+	"math"
+	"testing"
+)
+
+// relativeError of an estimate of n distinct values.
+func relativeError(estimate uint64, n int) float64 {
+	return math.Abs(float64(estimate)-float64(n)) / float64(n)
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	h := NewHyperLogLog(14)
+	if count := h.Count(); count != 0 {
+		t.Errorf("empty sketch counts %d", count)
+	}
+
+	// Linear counting is nearly exact for few values.
+	for i := 0; i < 100; i++ {
+		h.Add(int64(i))
+		h.Add(float64(i))
+	}
+	if count := h.Count(); count < 198 || count > 202 {
+		t.Errorf("200 distinct values count %d", count)
+	}
+
+	// The standard error with 2^14 registers is 0.8%.
+	h.Reset()
+	const n = 1 << 22
+	for i := 0; i < n; i++ {
+		h.Add(int64(i))
+	}
+	if e := relativeError(h.Count(), n); e > 0.025 {
+		t.Errorf("%d distinct values count %d", n, h.Count())
+	}
+
+	h.Reset()
+	h.Add(true)
+	h.Add(false)
+	h.Add(true)
+	h.Add("true")
+	if count := h.Count(); count != 3 {
+		t.Errorf("3 distinct values count %d", count)
+	}
+}
+
+// With 64-bit hashes, registers can hold ranks beyond 32 bits, and the estimate needs no large range
+// correction, which would break down near 2^32 distinct values.
+func TestHyperLogLogLargeCounts(t *testing.T) {
+	h := NewHyperLogLog(14)
+	for i := range h.Registers {
+		h.Registers[i] = 30
+	}
+	m := float64(len(h.Registers))
+	expected := 0.7213 / (1 + 1.079/m) * m * math.Ldexp(1, 30)
+	if e := math.Abs(float64(h.Count())-expected) / expected; e > 1e-9 {
+		t.Errorf("estimate is %d, expected %.0f", h.Count(), expected)
+	}
+}
+
+func TestHyperLogLogEncoding(t *testing.T) {
+	h := NewHyperLogLog(MinPrecision)
+	for i := 0; i < 1000; i++ {
+		h.Add(int64(i))
+	}
+	decoded, err := DecodeHyperLogLog(h.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Precision != h.Precision || string(decoded.Registers) != string(h.Registers) || decoded.Count() != h.Count() {
+		t.Errorf("decoded %+v, expected %+v", decoded, h)
+	}
+
+	for _, text := range []string{"", "not base64!", "AwAA", h.Encode()[:8]} {
+		if _, err = DecodeHyperLogLog(text); err == nil {
+			t.Errorf("decoded %q", text)
+		}
+	}
+}
+
+// Merging the sketches of two windows gives the sketch of both.
+func TestHyperLogLogMerge(t *testing.T) {
+	first := NewHyperLogLog(12)
+	second := NewHyperLogLog(12)
+	both := NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		if i%3 == 0 {
+			first.Add(int64(i))
+		} else {
+			second.Add(int64(i))
+		}
+		both.Add(int64(i))
+	}
+	merged := NewHyperLogLog(12)
+	if err := merged.Merge(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.MergeEncoded(second.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if string(merged.Registers) != string(both.Registers) {
+		t.Errorf("merged sketch differs from the sketch of both")
+	}
+
+	other := NewHyperLogLog(13)
+	if err := merged.Merge(other); err == nil {
+		t.Errorf("merged sketches of different precisions")
+	}
+	if err := merged.MergeEncoded(other.Encode()); err == nil {
+		t.Errorf("merged encoded sketches of different precisions")
+	}
+}
+
+// The sketches of "hll" are written to rows, so they are smaller by default than those of "uniq".
+func TestUniquerDefaultPrecision(t *testing.T) {
+	for _, test := range []struct {
+		encoded  bool
+		expected uint8
+	}{{false, DefaultPrecision}, {true, DefaultEncodedPrecision}} {
+		f := Uniquer{Encoded: test.encoded}
+		f.Init(nil)
+		if f.HLL.Precision != test.expected {
+			t.Errorf("encoded %v: precision %d, expected %d", test.encoded, f.HLL.Precision, test.expected)
+		}
+	}
+	f := Uniquer{Encoded: true}
+	f.Init(nil)
+	if size := len(f.Value().(string)); size > 22000 {
+		t.Errorf("sketch has %d bytes", size)
+	}
+}
+
+// "uniq_merge" over the sketches of "hll" counts the distinct values of all windows.
+func TestUniqueMerger(t *testing.T) {
+	sketcher := Uniquer{Precision: 12, Encoded: true}
+	sketcher.Init(nil)
+	var merger UniqueMerger
+	merger.Init(nil)
+	if count := merger.Value().(uint64); count != 0 {
+		t.Errorf("no sketches count %d", count)
+	}
+	for window := 0; window < 3; window++ {
+		sketcher.Reset()
+		for i := 0; i < 10000; i++ {
+			sketcher.Update(int64(window*5000 + i)) // Windows overlap by half
+		}
+		merger.Update(sketcher.Value())
+	}
+	if count := merger.Value().(uint64); relativeError(count, 20000) > 0.05 {
+		t.Errorf("20000 distinct values count %d", count)
+	}
+
+	other := Uniquer{Precision: 13, Encoded: true}
+	other.Init(nil)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("merged sketches of different precisions")
+		}
+	}()
+	merger.Update(other.Value())
+}
@@ -0,0 +1,56 @@
+package functor
+
+import (
+	"fmt"
+	"plugin"
+	"sync"
+)
+
+// PluginSymbol is the name of the constructor that a plugin for a user-defined aggregate must
+// export, e.g., `func New() functor.Functor { return &Spread{} }`.
+const PluginSymbol = "New"
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]func() Functor)
+)
+
+// Register makes a user-defined aggregate known under its full name in the catalog, e.g.,
+// "sys.db.sales.spread", so that functions of different schemas with the same name don't collide.
+// Engines built with the function call this from an init function; all others load it with New.
+func Register(name string, constructor func() Functor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, found := registry[name]; found {
+		panic(fmt.Errorf("function %s is registered already", name))
+	}
+	registry[name] = constructor
+}
+
+// New returns a fresh functor for a user-defined aggregate.  If the function isn't registered yet,
+// it opens the Go plugin at the library path and registers the plugin's constructor.
+func New(name string, libraryPath string) (Functor, error) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if constructor, found := registry[name]; found {
+		return constructor(), nil
+	}
+	if libraryPath == "" {
+		return nil, fmt.Errorf("function %s is neither registered nor has a library path", name)
+	}
+
+	p, err := plugin.Open(libraryPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load function %s: %w", name, err)
+	}
+	var symbol plugin.Symbol
+	if symbol, err = p.Lookup(PluginSymbol); err != nil {
+		return nil, fmt.Errorf("cannot load function %s: %w", name, err)
+	}
+	constructor, ok := symbol.(func() Functor)
+	if !ok {
+		return nil, fmt.Errorf("%s in %s is a %T, not a func() functor.Functor", PluginSymbol, libraryPath, symbol)
+	}
+	registry[name] = constructor
+	return constructor(), nil
+}
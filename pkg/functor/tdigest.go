@@ -0,0 +1,208 @@
+package functor
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// DefaultCompression bounds the number of centroids of a t-digest to about 2x this number.
+	// The error of a quantile is roughly proportional to q * (1 - q) / compression.
+	DefaultCompression = 100
+
+	// ExactLimit is the number of values up to which a t-digest keeps all values, so that the
+	// quantiles of small windows are exact.
+	ExactLimit = 1000
+)
+
+// TDigest is a merging t-digest (Dunning & Ertl) that estimates the quantiles of a stream of values
+// in little memory.  Digests can be merged, e.g., to combine per-minute digests into an hourly one.
+// Up to ExactLimit values, the digest keeps all values and computes the quantiles exactly; with a
+// compression of 0, it always does and merges approximate digests with DefaultCompression.
+type TDigest struct {
+	compression float64
+	exactLimit  int
+
+	exact     bool       // If values has all values
+	values    []float64  // All values while the digest is exact
+	sorted    bool       // If values are sorted
+	centroids []centroid // Sorted by mean, once the digest isn't exact anymore
+	buffer    []centroid // Unmerged centroids
+	count     float64
+	min       float64
+	max       float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+func NewTDigest(compression float64) *TDigest {
+	d := &TDigest{compression: compression, exactLimit: ExactLimit}
+	if compression == 0 {
+		d.compression = DefaultCompression
+		d.exactLimit = math.MaxInt
+	}
+	d.Reset()
+	return d
+}
+
+// Reset empties the digest but keeps its memory for the next window.
+func (d *TDigest) Reset() {
+	d.exact = true
+	d.values = d.values[:0]
+	d.sorted = true
+	d.centroids = d.centroids[:0]
+	d.buffer = d.buffer[:0]
+	d.count = 0
+	d.min = math.Inf(1)
+	d.max = math.Inf(-1)
+}
+
+func (d *TDigest) Count() float64 {
+	return d.count
+}
+
+// IsExact tells if the quantiles are exact, i.e., the digest still has all values.
+func (d *TDigest) IsExact() bool {
+	return d.exact
+}
+
+func (d *TDigest) Add(x float64) {
+	if d.exact && len(d.values) < d.exactLimit {
+		d.values = append(d.values, x)
+		d.sorted = false
+		d.count++
+		d.min = math.Min(d.min, x)
+		d.max = math.Max(d.max, x)
+		return
+	}
+	d.add(x, 1)
+}
+
+// Merge adds all values of the other digest.
+func (d *TDigest) Merge(other *TDigest) {
+	if other.IsExact() {
+		for _, x := range other.values {
+			d.Add(x)
+		}
+		return
+	}
+	other.compress()
+	for _, c := range other.centroids {
+		d.add(c.mean, c.weight)
+	}
+	d.min = math.Min(d.min, other.min)
+	d.max = math.Max(d.max, other.max)
+}
+
+func (d *TDigest) add(x float64, weight float64) {
+	if d.exact {
+		// Switch from exact to approximate
+		for _, v := range d.values {
+			d.buffer = append(d.buffer, centroid{mean: v, weight: 1})
+		}
+		d.values = d.values[:0]
+		d.exact = false
+	}
+	d.buffer = append(d.buffer, centroid{mean: x, weight: weight})
+	d.count += weight
+	d.min = math.Min(d.min, x)
+	d.max = math.Max(d.max, x)
+	if float64(len(d.buffer)) >= 5*d.compression {
+		d.compress()
+	}
+}
+
+// compress merges the buffer into the centroids.  Neighboring centroids are merged as long as the
+// merged centroid spans at most 1 on the scale k(q) = compression / 2π * asin(2q - 1), which keeps
+// the centroids near the tails small.
+func (d *TDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	d.buffer = append(d.buffer, d.centroids...)
+	sort.Slice(d.buffer, func(i, j int) bool { return d.buffer[i].mean < d.buffer[j].mean })
+
+	d.centroids = d.centroids[:0]
+	current := d.buffer[0]
+	weightSoFar := 0.0
+	for _, c := range d.buffer[1:] {
+		proposed := current.weight + c.weight
+		if d.k((weightSoFar+proposed)/d.count)-d.k(weightSoFar/d.count) <= 1 {
+			current.mean += (c.mean - current.mean) * c.weight / proposed
+			current.weight = proposed
+			continue
+		}
+		weightSoFar += current.weight
+		d.centroids = append(d.centroids, current)
+		current = c
+	}
+	d.centroids = append(d.centroids, current)
+	d.buffer = d.buffer[:0]
+}
+
+func (d *TDigest) k(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+// Quantile returns the value below which the fraction q of the values lie, e.g., the median for
+// q = 0.5, or NaN if the digest is empty.  Exact quantiles interpolate linearly between the two
+// closest ranks.
+func (d *TDigest) Quantile(q float64) float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if q >= 1 {
+		return d.max
+	}
+	if d.IsExact() {
+		return d.exactQuantile(q)
+	}
+
+	d.compress()
+	c := d.centroids
+	if len(c) == 1 {
+		return c[0].mean
+	}
+
+	// Each centroid covers the ranks around its mean; interpolate between the means of the two
+	// centroids around the rank, or between a mean and the minimum or maximum at the tails.
+	rank := q * d.count
+	if rank < c[0].weight/2 {
+		return d.min + rank/(c[0].weight/2)*(c[0].mean-d.min)
+	}
+	weightSoFar := c[0].weight / 2
+	for i := 0; i < len(c)-1; i++ {
+		dw := (c[i].weight + c[i+1].weight) / 2
+		if weightSoFar+dw > rank {
+			return c[i].mean + (rank-weightSoFar)/dw*(c[i+1].mean-c[i].mean)
+		}
+		weightSoFar += dw
+	}
+	last := c[len(c)-1]
+	return last.mean + math.Min((rank-weightSoFar)/(last.weight/2), 1)*(d.max-last.mean)
+}
+
+func (d *TDigest) exactQuantile(q float64) float64 {
+	if !d.sorted {
+		sort.Float64s(d.values)
+		d.sorted = true
+	}
+	return ExactQuantile(d.values, q)
+}
+
+// ExactQuantile returns the quantile q of sorted values, interpolating linearly between the two
+// closest ranks.
+func ExactQuantile(sorted []float64, q float64) float64 {
+	h := q * float64(len(sorted)-1)
+	lo := int(math.Floor(h))
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
@@ -0,0 +1,184 @@
+package functor
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/xsnout/grizzly/capnp/grizzly"
+)
+
+var testQuantiles = []float64{0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999}
+
+func sortedCopy(values []float64) []float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// rankError is how far the estimate is off in rank, as a fraction of all values.
+func rankError(sorted []float64, q float64, estimate float64) float64 {
+	lo := sort.SearchFloat64s(sorted, estimate)
+	hi := sort.Search(len(sorted), func(i int) bool { return sorted[i] > estimate })
+	rank := q * float64(len(sorted)-1)
+	switch {
+	case rank < float64(lo):
+		return (float64(lo) - rank) / float64(len(sorted))
+	case rank > float64(hi):
+		return (rank - float64(hi)) / float64(len(sorted))
+	}
+	return 0
+}
+
+func TestExactQuantile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4}
+	for q, expected := range map[float64]float64{0: 1, 0.25: 1.75, 0.5: 2.5, 1: 4} {
+		if actual := ExactQuantile(sorted, q); actual != expected {
+			t.Errorf("quantile %v of %v is %v, expected %v", q, sorted, actual, expected)
+		}
+	}
+}
+
+// Small windows get the same quantiles as sorting all values.
+func TestPercentileSmallWindowIsExact(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	typ := grizzly.FieldType_integer64
+	f := NewQuantiles(testQuantiles, DefaultCompression)
+	f.Init(&typ)
+
+	for window := 0; window < 3; window++ {
+		var values []float64
+		for i := 0; i < ExactLimit; i++ {
+			x := r.Int63n(1000)
+			values = append(values, float64(x))
+			f.Update(x)
+		}
+		if !f.Digest.IsExact() {
+			t.Fatalf("window %d with %d values isn't exact", window, len(values))
+		}
+		sorted := sortedCopy(values)
+		var quantiles []float64
+		if err := json.Unmarshal([]byte(f.Value().(string)), &quantiles); err != nil {
+			t.Fatal(err)
+		}
+		for i, actual := range quantiles {
+			if expected := ExactQuantile(sorted, testQuantiles[i]); actual != expected {
+				t.Errorf("window %d: quantile %v is %v, expected %v", window, testQuantiles[i], actual, expected)
+			}
+		}
+		f.Reset()
+	}
+}
+
+func TestTDigestAccuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	distributions := map[string]func() float64{
+		"uniform":     r.Float64,
+		"normal":      r.NormFloat64,
+		"exponential": r.ExpFloat64,
+		"latency":     func() float64 { return math.Exp(3 + r.NormFloat64()) }, // log-normal
+	}
+	for name, next := range distributions {
+		d := NewTDigest(DefaultCompression)
+		var values []float64
+		for i := 0; i < 100_000; i++ {
+			x := next()
+			values = append(values, x)
+			d.Add(x)
+		}
+		if d.IsExact() {
+			t.Fatalf("%s: digest of %d values is exact", name, len(values))
+		}
+		sorted := sortedCopy(values)
+		for _, q := range testQuantiles {
+			// The error is smallest near the tails.
+			tolerance := 0.001 + 0.005*q*(1-q)
+			if e := rankError(sorted, q, d.Quantile(q)); e > tolerance {
+				t.Errorf("%s: quantile %v is %v, expected %v; rank error %.5f > %.5f",
+					name, q, d.Quantile(q), ExactQuantile(sorted, q), e, tolerance)
+			}
+		}
+		if d.Quantile(0) != sorted[0] || d.Quantile(1) != sorted[len(sorted)-1] {
+			t.Errorf("%s: minimum and maximum are %v and %v, expected %v and %v",
+				name, d.Quantile(0), d.Quantile(1), sorted[0], sorted[len(sorted)-1])
+		}
+	}
+}
+
+// Merged per-minute digests give the quantiles of the hour.
+func TestTDigestMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	hour := NewTDigest(DefaultCompression)
+	var values []float64
+	for minute := 0; minute < 60; minute++ {
+		d := NewTDigest(DefaultCompression)
+		n := 100 + r.Intn(2*ExactLimit) // Some minutes are exact, some aren't
+		for i := 0; i < n; i++ {
+			x := r.ExpFloat64()
+			values = append(values, x)
+			d.Add(x)
+		}
+		hour.Merge(d)
+	}
+	if hour.Count() != float64(len(values)) {
+		t.Fatalf("merged count is %v, expected %d", hour.Count(), len(values))
+	}
+	sorted := sortedCopy(values)
+	for _, q := range testQuantiles {
+		tolerance := 0.001 + 0.005*q*(1-q)
+		if e := rankError(sorted, q, hour.Quantile(q)); e > tolerance {
+			t.Errorf("quantile %v is %v, expected %v; rank error %.5f > %.5f",
+				q, hour.Quantile(q), ExactQuantile(sorted, q), e, tolerance)
+		}
+	}
+}
+
+func TestTDigestReset(t *testing.T) {
+	d := NewTDigest(DefaultCompression)
+	for i := 0; i < 10*ExactLimit; i++ {
+		d.Add(float64(i))
+	}
+	d.Reset()
+	if !d.IsExact() || d.Count() != 0 || !math.IsNaN(d.Quantile(0.5)) {
+		t.Errorf("digest isn't empty after reset: exact %v, count %v, median %v", d.IsExact(), d.Count(), d.Quantile(0.5))
+	}
+	d.Add(7)
+	if d.Quantile(0.5) != 7 {
+		t.Errorf("median is %v, expected 7", d.Quantile(0.5))
+	}
+}
+
+// A compression of 0 keeps all values.
+func TestTDigestAlwaysExact(t *testing.T) {
+	d := NewTDigest(0)
+	var values []float64
+	for i := 0; i < 3*ExactLimit; i++ {
+		x := float64((i * 7919) % 3001)
+		values = append(values, x)
+		d.Add(x)
+	}
+	sorted := sortedCopy(values)
+	for _, q := range testQuantiles {
+		if actual, expected := d.Quantile(q), ExactQuantile(sorted, q); !d.IsExact() || actual != expected {
+			t.Errorf("quantile %v is %v, expected %v", q, actual, expected)
+		}
+	}
+}
+
+// The quantiles are a JSON list that other tools can read, with null for an empty window.
+func TestQuantilesValue(t *testing.T) {
+	typ := grizzly.FieldType_float64
+	f := NewQuantiles([]float64{0, 0.5, 1}, DefaultCompression)
+	f.Init(&typ)
+	if actual := f.Value().(string); actual != "[null,null,null]" {
+		t.Errorf("quantiles of an empty window are %s", actual)
+	}
+	for _, x := range []float64{12, 40.5, 98.25} {
+		f.Update(x)
+	}
+	if actual := f.Value().(string); actual != "[12,40.5,98.25]" {
+		t.Errorf("quantiles are %s", actual)
+	}
+}
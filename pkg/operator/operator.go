@@ -5,12 +5,14 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"capnproto.org/go/capnp/v3"
 	"github.com/rs/zerolog"
 	"github.com/xsnout/grizzly/capnp/data"
 	"github.com/xsnout/grizzly/capnp/grizzly"
+	"github.com/xsnout/grizzly/pkg/codegen"
 	"github.com/xsnout/grizzly/pkg/compiler"
 	"github.com/xsnout/grizzly/pkg/functor"
 	"github.com/xsnout/grizzly/pkg/utility"
@@ -33,6 +35,7 @@ type Operator struct {
 	GroupFieldNames         []string
 	GroupFieldTypes         []grizzly.FieldType
 	GroupFieldNamesToTypes  map[string]grizzly.FieldType
+	Stage                   int // Index of the query in the UQL file
 }
 
 func (s *Operator) Init(node *grizzly.Node) {
@@ -183,49 +186,95 @@ func (op *Window) Init(node *grizzly.Node) {
 
 type Ingress struct {
 	Operator
+
+	SourceTables  []string       // The tables in the "from" clause
+	TableVersions []TableVersion // The catalog tables behind SourceTables; zero for earlier queries
+	Evaluator     Evaluator
+
+	groupExpressions []int // Index of the expression that computes each group key, or -1 to copy the field
+}
+
+// TableVersion is the version of a catalog table that the plan was compiled for.
+type TableVersion struct {
+	FullName string
+	Version  int64
 }
 
 func (o *Ingress) Init(node *grizzly.Node) {
 	o.Operator.Init(node)
-}
 
-func (o *Ingress) Ingress(record []string, row *data.IngressRow) {
-	var err error
+	if value, found := utility.FindProperty(node, compiler.SourceTables); found {
+		o.SourceTables = strings.Split(value, ",")
+	}
+	if value, found := utility.FindProperty(node, compiler.TableVersions); found {
+		o.TableVersions = make([]TableVersion, len(o.SourceTables))
+		for i, fullNameAndVersion := range strings.Split(value, ",") {
+			if fullNameAndVersion == "" {
+				continue
+			}
+			at := strings.LastIndex(fullNameAndVersion, "@")
+			o.TableVersions[i].FullName = fullNameAndVersion[:at]
+			var err error
+			if o.TableVersions[i].Version, err = strconv.ParseInt(fullNameAndVersion[at+1:], 10, 64); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if value, found := utility.FindProperty(node, compiler.Stage); found {
+		var err error
+		if o.Stage, err = strconv.Atoi(value); err != nil {
+			panic(err)
+		}
+	}
 
-	var payload data.IngressPayload
-	if payload, err = row.NewPayload(); err != nil {
+	var err error
+	var groupFields capnp.StructList[grizzly.Field]
+	if groupFields, err = node.GroupFields(); err != nil {
 		panic(err)
 	}
-	var group data.Group
-	if group, err = row.NewGroup(); err != nil {
-		panic(err)
+	for i := 0; i < groupFields.Len(); i++ {
+		o.groupExpressions = append(o.groupExpressions, ExpressionIndex(groupFields.At(i)))
 	}
+}
+
+func (o *Ingress) Ingress(record []string, row *data.IngressRow) {
+	payload := o.NewPayload(*row)
+	group := o.NewGroup(*row)
 
 	for i := 0; i < len(record); i++ {
 		theType := stringToType(record[i], o.OutputFieldTypes[i])
 		InvokeWithParameters(payload, "Set"+utility.UpcaseFirstLetter(o.OutputFieldNames[i]), theType)
 
 		for g := 0; g < len(o.GroupFieldNames); g++ {
-			if o.GroupFieldNames[g] == o.OutputFieldNames[i] {
+			if o.GroupFieldNames[g] == o.OutputFieldNames[i] && o.groupExpressions[g] < 0 {
 				InvokeWithParameters(group, "Set"+utility.UpcaseFirstLetter(o.GroupFieldNames[g]), theType)
 				break
 			}
 		}
 	}
 
-	if err = row.SetPayload(payload); err != nil {
-		panic(err)
-	}
-	if err = row.SetGroup(group); err != nil {
-		panic(err)
+	// Computed keys like "group by lower(host) as h"
+	for g := 0; g < len(o.GroupFieldNames); g++ {
+		if o.groupExpressions[g] >= 0 {
+			value := o.Evaluator.EvalIngressExpression(o.groupExpressions[g], *row)
+			InvokeWithParameters(group, "Set"+utility.UpcaseFirstLetter(o.GroupFieldNames[g]), value)
+		}
 	}
 }
 
 type Aggregate struct {
 	Operator
-	inputNames []string
-	inputTypes []grizzly.FieldType
-	functors   []functor.Functor
+	Evaluator Evaluator
+	inputs    [][]aggregateInput // The inputs of each call, e.g., "x" and "y" for "corr(x, y)", or nil for none
+	filters   []int              // Index of the condition that filters the rows of each call, or -1 for all rows
+	functors  []functor.Functor
+}
+
+// aggregateInput is a field of the ingress rows, or an expression over them.
+type aggregateInput struct {
+	name       string
+	typ        grizzly.FieldType
+	expression int // Index of the expression that computes the input, or -1 to read the field
 }
 
 func (o *Aggregate) Init(node *grizzly.Node) {
@@ -253,14 +302,26 @@ func (o *Aggregate) Init(node *grizzly.Node) {
 			panic(err)
 		}
 
-		var inputName string
-		if inputName, err = inputFields.At(0).Name(); err != nil {
-			panic(err)
+		var inputs []aggregateInput
+		for j := 0; j < inputFields.Len(); j++ {
+			input := aggregateInput{typ: inputFields.At(j).Type(), expression: ExpressionIndex(inputFields.At(j))}
+			if input.name, err = inputFields.At(j).Name(); err != nil {
+				panic(err)
+			}
+			inputs = append(inputs, input)
 		}
-		o.inputNames = append(o.inputNames, inputName)
+		o.inputs = append(o.inputs, inputs)
+		inputType := inputs[0].typ
 
-		inputType := inputFields.At(0).Type()
-		o.inputTypes = append(o.inputTypes, inputType)
+		filter := -1
+		if calls.At(i).HasFilter() {
+			var field grizzly.Field
+			if field, err = calls.At(i).Filter(); err != nil {
+				panic(err)
+			}
+			filter = ExpressionIndex(field)
+		}
+		o.filters = append(o.filters, filter)
 
 		switch name {
 		case "average":
@@ -273,6 +334,32 @@ func (o *Aggregate) Init(node *grizzly.Node) {
 			o.functors = append(o.functors, &f)
 		case "distinctcount": // Similar to "unique" but precise
 			var f functor.DistinctCounter
+			if limit, found := functionProperties(function)[compiler.LimitProperty]; found {
+				if f.Limit, err = strconv.Atoi(limit); err != nil {
+					panic(err)
+				}
+			}
+			if precision, found := functionProperties(function)[compiler.PrecisionProperty]; found {
+				var p int
+				if p, err = strconv.Atoi(precision); err != nil {
+					panic(err)
+				}
+				f.Precision = uint8(p)
+			}
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+		case "approximate": // The flag of the "distinctcount(x, limit)" before it
+			f := functor.Approximation{Of: o.functors[len(o.functors)-1].(*functor.DistinctCounter)}
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+			o.inputs[len(o.inputs)-1] = nil // It reads the state of the distinctcount
+		case "collect_set", "collect_list":
+			f := functor.Collector{Distinct: name == "collect_set"}
+			if limit, found := functionProperties(function)[compiler.LimitProperty]; found {
+				if f.Limit, err = strconv.Atoi(limit); err != nil {
+					panic(err)
+				}
+			}
 			f.Init(&inputType)
 			o.functors = append(o.functors, &f)
 		case "maximum":
@@ -291,10 +378,62 @@ func (o *Aggregate) Init(node *grizzly.Node) {
 			var f functor.Summer
 			f.Init(&inputType)
 			o.functors = append(o.functors, &f)
-		case "unique": // Similar to "distinctcount" but approximate due to use of a sketch
-			var f functor.Uniquer
+		case "unique", "hll": // Similar to "distinctcount" but approximate due to use of a sketch
+			f := functor.Uniquer{Encoded: name == "hll"}
+			if precision, found := functionProperties(function)[compiler.PrecisionProperty]; found {
+				var p int
+				if p, err = strconv.Atoi(precision); err != nil {
+					panic(err)
+				}
+				f.Precision = uint8(p)
+			}
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+		case "uniq_merge":
+			var f functor.UniqueMerger
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+		case "percentile", "quantiles":
+			quantiles, compression := quantileParameters(function)
+			var f functor.Functor
+			if name == "percentile" {
+				f = functor.NewPercentile(quantiles, compression)
+			} else {
+				f = functor.NewQuantiles(quantiles, compression)
+			}
+			f.Init(&inputType)
+			o.functors = append(o.functors, f)
+		case "variance", "var_pop", "stddev", "stddev_pop", "skewness", "kurtosis":
+			f := functor.Moments{Statistic: statistics[name]}
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+		case "covariance", "covar_pop", "corr":
+			f := functor.Comoments{Correlation: name == "corr", Population: name == "covar_pop"}
 			f.Init(&inputType)
 			o.functors = append(o.functors, &f)
+		case "increase", "rate", "delta", "deriv":
+			f := functor.Changes{Change: changes[name]}
+			f.Init(&inputType)
+			o.functors = append(o.functors, &f)
+		case "cms", "topk":
+			properties := functionProperties(function)
+			epsilon, delta := functor.DefaultEpsilon, functor.DefaultDelta
+			if _, found := properties[compiler.EpsilonProperty]; found {
+				epsilon = parseFloat(properties[compiler.EpsilonProperty])
+				delta = parseFloat(properties[compiler.DeltaProperty])
+			}
+			var f functor.Functor
+			if name == "cms" {
+				f = functor.NewSketcher(epsilon, delta)
+			} else {
+				var k int
+				if k, err = strconv.Atoi(properties[compiler.TopKProperty]); err != nil {
+					panic(err)
+				}
+				f = functor.NewTopK(k, epsilon, delta)
+			}
+			f.Init(&inputType)
+			o.functors = append(o.functors, f)
 		case "first":
 			var f functor.First
 			f.Init(&inputType)
@@ -304,17 +443,28 @@ func (o *Aggregate) Init(node *grizzly.Node) {
 			f.Init(&inputType)
 			o.functors = append(o.functors, &f)
 		default:
-			panic(fmt.Errorf("unknown function name: %s", name))
+			if function.IsBuiltIn() {
+				panic(fmt.Errorf("unknown function name: %s", name))
+			}
+			// A user-defined aggregate from the catalog
+			var libraryPath string
+			if libraryPath, err = function.LibraryPath(); err != nil {
+				panic(err)
+			}
+			var f functor.Functor
+			if f, err = functor.New(name, libraryPath); err != nil {
+				panic(err)
+			}
+			f.Init(&inputType)
+			o.functors = append(o.functors, f)
+			log.Info().Msgf("loaded user-defined function %s", name)
 		}
 	}
 }
 
 func (o *Aggregate) Value(outRow *data.AggregateRow) {
 	var err error
-	var payload data.AggregatePayload
-	if payload, err = outRow.NewPayload(); err != nil {
-		panic(err)
-	}
+	payload := o.NewPayload(*outRow)
 
 	for i := 0; i < len(o.OutputFieldNames); i++ {
 		outputName := o.OutputFieldNames[i]
@@ -351,27 +501,104 @@ func (o *Aggregate) Value(outRow *data.AggregateRow) {
 			panic(fmt.Errorf("cannot find field type %v", outputType))
 		}
 	}
+}
 
-	if err = outRow.SetPayload(payload); err != nil {
-		panic(err)
+func (o *Aggregate) Update(inRow data.IngressRow) {
+	payload := o.Payload(inRow)
+
+	for i, inputs := range o.inputs {
+		// Example: For "avg(foo) as avgFoo", "foo" is the input and "avgFoo" is the output.
+		if inputs == nil { // E.g., the flag of "distinctcount(x, limit)", which has the filter of the count
+			continue
+		}
+		if o.filters[i] >= 0 && !o.Evaluator.EvalIngressExpression(o.filters[i], inRow).(bool) {
+			continue
+		}
+		switch {
+		case isCounter(o.functors[i]) && inputs[0].expression < 0: // count() and count(foo) count every row
+			o.functors[i].Update(nil)
+		case len(inputs) == 1:
+			o.functors[i].Update(o.inputValue(inputs[0], payload, inRow))
+		default: // E.g., "corr(x, y)" gets both values at once
+			values := make([]interface{}, len(inputs))
+			for j, input := range inputs {
+				values[j] = o.inputValue(input, payload, inRow)
+			}
+			o.functors[i].Update(values)
+		}
 	}
 }
 
-func (o *Aggregate) Update(inRow data.IngressRow) {
+func (o *Aggregate) inputValue(input aggregateInput, payload interface{}, inRow data.IngressRow) interface{} {
+	if input.expression >= 0 { // E.g., "sum(bytes * 8)"
+		return o.Evaluator.EvalIngressExpression(input.expression, inRow)
+	}
+	values := InvokeWithoutParameters(payload, utility.UpcaseFirstLetter(input.name))
+	return typeCast(values[0], input.typ)
+}
+
+var statistics = map[string]functor.Statistic{
+	"variance":   functor.SampleVariance,
+	"var_pop":    functor.PopulationVariance,
+	"stddev":     functor.SampleStandardDeviation,
+	"stddev_pop": functor.PopulationStandardDeviation,
+	"skewness":   functor.Skewness,
+	"kurtosis":   functor.Kurtosis,
+}
+
+var changes = map[string]functor.Change{
+	"increase": functor.Increase,
+	"rate":     functor.Rate,
+	"delta":    functor.Delta,
+	"deriv":    functor.Derivative,
+}
+
+// quantileParameters reads the quantiles and the compression of a t-digest function from its
+// properties.
+func quantileParameters(function grizzly.Function) (quantiles []float64, compression float64) {
+	properties := functionProperties(function)
+	for _, text := range strings.Split(properties[compiler.QuantilesProperty], ",") {
+		quantiles = append(quantiles, parseFloat(text))
+	}
+	compression = functor.DefaultCompression
+	if text, found := properties[compiler.CompressionProperty]; found {
+		compression = parseFloat(text)
+	}
+	return
+}
+
+// functionProperties returns the parameters of a function call, e.g., the k of "topk(x, 10)".
+func functionProperties(function grizzly.Function) map[string]string {
 	var err error
-	var payload data.IngressPayload
-	if payload, err = inRow.Payload(); err != nil {
+	var properties capnp.StructList[grizzly.FunctionProperty]
+	if properties, err = function.Properties(); err != nil {
 		panic(err)
 	}
+	keyValues := make(map[string]string)
+	for i := 0; i < properties.Len(); i++ {
+		var key, value string
+		if key, err = properties.At(i).Key(); err != nil {
+			panic(err)
+		}
+		if value, err = properties.At(i).Value(); err != nil {
+			panic(err)
+		}
+		keyValues[key] = value
+	}
+	return keyValues
+}
 
-	for i := 0; i < len(o.inputNames); i++ {
-		// Example: For "avg(foo) as avgFoo", "foo" is the inputName and "avgFoo" is the outputName.
-		inputName := o.inputNames[i]
-		getMethodName := utility.UpcaseFirstLetter(inputName)
-		values := InvokeWithoutParameters(payload, getMethodName)
-		value := typeCast(values[0], o.inputTypes[i])
-		o.functors[i].Update(value)
+func parseFloat(text string) float64 {
+	x, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		panic(err)
 	}
+	return x
+}
+
+func isCounter(f functor.Functor) bool {
+	_, ok := f.(*functor.Counter)
+	return ok
 }
 
 func (o *Aggregate) Reset() {
@@ -380,56 +607,118 @@ func (o *Aggregate) Reset() {
 	}
 }
 
+// Evaluator computes the expressions that the compiler generated code for, e.g., the filter of
+// package functions.
+type Evaluator interface {
+	EvalIngressExpression(index int, row data.IngressRow) (value interface{})
+	EvalAggregateExpression(index int, row data.AggregateRow) (value interface{})
+}
+
 type Project struct {
 	Operator
+	Evaluator   Evaluator
+	expressions []int // Index of the expression that computes each output field, or -1 to copy it
 }
 
 func (o *Project) Init(node *grizzly.Node) {
 	o.Operator.Init(node)
-}
 
-func (o *Project) Project(inRow *data.AggregateRow, outRow *data.EgressRow) {
-	var inPayload data.AggregatePayload
 	var err error
-	if inPayload, err = inRow.Payload(); err != nil {
+	var fields capnp.StructList[grizzly.Field]
+	if fields, err = node.Fields(); err != nil {
 		panic(err)
 	}
+	for i := 0; i < fields.Len(); i++ {
+		o.expressions = append(o.expressions, ExpressionIndex(fields.At(i)))
+	}
+}
 
-	var outPayload data.EgressPayload
-	if outPayload, err = outRow.NewPayload(); err != nil {
+// ExpressionIndex returns the index of the expression that computes the field, or -1 if the field
+// is a copy of an input field.
+func ExpressionIndex(field grizzly.Field) int {
+	var err error
+	var properties capnp.StructList[grizzly.FieldProperty]
+	if properties, err = field.Properties(); err != nil {
 		panic(err)
 	}
+	for i := 0; i < properties.Len(); i++ {
+		var key, value string
+		if key, err = properties.At(i).Key(); err != nil {
+			panic(err)
+		}
+		if key != compiler.ExpressionProperty {
+			continue
+		}
+		if value, err = properties.At(i).Value(); err != nil {
+			panic(err)
+		}
+		var index int
+		if index, err = strconv.Atoi(value); err != nil {
+			panic(err)
+		}
+		return index
+	}
+	return -1
+}
+
+func (o *Project) Project(inRow *data.AggregateRow, outRow *data.EgressRow) {
+	inPayload := o.Payload(*inRow)
+	outPayload := o.NewPayload(*outRow)
 
 	for i := 0; i < len(o.OutputFieldNames); i++ {
+		setMethodName := "Set" + utility.UpcaseFirstLetter(o.OutputFieldNames[i])
+		if o.expressions[i] >= 0 {
+			InvokeWithParameters(outPayload, setMethodName, o.Evaluator.EvalAggregateExpression(o.expressions[i], *inRow))
+			continue
+		}
 		getMethodName := o.OutputFieldNames[i]
 		values := InvokeWithoutParameters(inPayload, getMethodName)
 		value := values[0]
-		setMethodName := "Set" + utility.UpcaseFirstLetter(o.OutputFieldNames[i])
 		arg := typeCast(value, o.OutputFieldTypes[i])
 		InvokeWithParameters(outPayload, setMethodName, arg)
 	}
 
-	if err = outRow.SetPayload(outPayload); err != nil {
-		panic(err)
-	}
-
-	var group data.Group
-	if group, err = inRow.Group(); err != nil {
-		panic(err)
-	}
-	if err = outRow.SetGroup(group); err != nil {
-		panic(err)
-	}
+	o.SetGroup(*outRow, o.Group(*inRow))
 }
 
 type Egress struct {
 	Operator
+
+	Sinks []Sink
+}
+
+// A sink is one of the tables in the "to" clause.
+type Sink struct {
+	Name     string
+	Format   string
+	Location string // Empty means stdout
 }
 
 func (o *Egress) Init(node *grizzly.Node) {
 	o.Operator.Init(node)
 
-	//o.Operator.
+	var properties capnp.StructList[grizzly.OperatorProperty]
+	var err error
+	if properties, err = node.Properties(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < properties.Len(); i++ {
+		var key, value string
+		if key, err = properties.At(i).Key(); err != nil {
+			panic(err)
+		}
+		if value, err = properties.At(i).Value(); err != nil {
+			panic(err)
+		}
+		switch key {
+		case compiler.SinkName:
+			o.Sinks = append(o.Sinks, Sink{Name: value})
+		case compiler.SinkFormat:
+			o.Sinks[len(o.Sinks)-1].Format = value
+		case compiler.SinkLocation:
+			o.Sinks[len(o.Sinks)-1].Location = value
+		}
+	}
 }
 
 func stringToType(value string, t grizzly.FieldType) interface{} {
@@ -458,6 +747,47 @@ func stringToType(value string, t grizzly.FieldType) interface{} {
 	panic(fmt.Errorf("cannot cast string value \"%s\" to type %s", value, t.String()))
 }
 
+// The rows have a group and a payload for each query in the UQL file, e.g., "Group1" and "Payload1"
+// of the second one, so that the queries can use the same field names with different types.  The
+// operators access those of their own query.
+
+// Payload returns the payload of the operator's query in the row.
+func (s *Operator) Payload(row interface{}) interface{} {
+	return invokeGetter(row, "Payload"+codegen.StageSuffix(s.Stage))
+}
+
+// NewPayload adds an empty payload of the operator's query to the row and returns it.
+func (s *Operator) NewPayload(row interface{}) interface{} {
+	return invokeGetter(row, "NewPayload"+codegen.StageSuffix(s.Stage))
+}
+
+// Group returns the group of the operator's query in the row.
+func (s *Operator) Group(row interface{}) interface{} {
+	return invokeGetter(row, "Group"+codegen.StageSuffix(s.Stage))
+}
+
+// NewGroup adds an empty group of the operator's query to the row and returns it.
+func (s *Operator) NewGroup(row interface{}) interface{} {
+	return invokeGetter(row, "NewGroup"+codegen.StageSuffix(s.Stage))
+}
+
+// SetGroup copies a group of the operator's query into the row.
+func (s *Operator) SetGroup(row interface{}, group interface{}) {
+	results := InvokeWithParameters(row, "SetGroup"+codegen.StageSuffix(s.Stage), group)
+	if err, _ := results[0].Interface().(error); err != nil {
+		panic(err)
+	}
+}
+
+// invokeGetter calls a method of a row that returns a struct and an error, e.g., "Payload1".
+func invokeGetter(row interface{}, methodName string) interface{} {
+	results := InvokeWithoutParameters(row, methodName)
+	if err, _ := results[1].Interface().(error); err != nil {
+		panic(err)
+	}
+	return results[0].Interface()
+}
+
 func InvokeWithoutParameters(any interface{}, methodName string) []reflect.Value {
 	value := reflect.ValueOf(any)
 	upperCaseMethodName := utility.UpcaseFirstLetter(methodName)
@@ -498,12 +828,9 @@ func typeCast(value reflect.Value, t grizzly.FieldType) interface{} {
 	panic(fmt.Errorf("cannot find field type %v", t))
 }
 
-func Timestamp(ingressRow *data.IngressRow, timeFieldName string) (timestamp time.Time) {
-	var payload data.IngressPayload
+func (o *Window) Timestamp(ingressRow *data.IngressRow, timeFieldName string) (timestamp time.Time) {
 	var err error
-	if payload, err = ingressRow.Payload(); err != nil {
-		panic(err)
-	}
+	payload := o.Payload(*ingressRow)
 	getMethodName := utility.UpcaseFirstLetter(timeFieldName)
 	values := InvokeWithoutParameters(payload, getMethodName)
 	value := fmt.Sprintf("%v", values[0])
@@ -513,12 +840,9 @@ func Timestamp(ingressRow *data.IngressRow, timeFieldName string) (timestamp tim
 	return
 }
 
-func Rowstamp(ingressRow *data.IngressRow, rowFieldName string) (rowstamp int) {
-	var payload data.IngressPayload
+func (o *Window) Rowstamp(ingressRow *data.IngressRow, rowFieldName string) (rowstamp int) {
 	var err error
-	if payload, err = ingressRow.Payload(); err != nil {
-		panic(err)
-	}
+	payload := o.Payload(*ingressRow)
 	getMethodName := utility.UpcaseFirstLetter(rowFieldName)
 	values := InvokeWithoutParameters(payload, getMethodName)
 	value := fmt.Sprintf("%v", values[0])
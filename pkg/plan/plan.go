@@ -29,6 +29,7 @@ type PlanCall struct {
 	Function    PlanFunction `json:"function"`
 	InputFields []PlanField  `json:"infields"`
 	OutputField PlanField    `json:"outfield"`
+	Filter      string       `json:"filter,omitempty"`
 }
 
 type PlanFunction struct {
@@ -213,11 +214,23 @@ func GrizzlyNodeToPlan(node grizzly.Node) (p PlanNode) {
 				Type: outputField.Type().String(),
 			}
 
+			var filter string
+			if calls.At(i).HasFilter() {
+				var filterField grizzly.Field
+				if filterField, err = calls.At(i).Filter(); err != nil {
+					panic(err)
+				}
+				if filter, err = filterField.Name(); err != nil {
+					panic(err)
+				}
+			}
+
 			p.Calls = append(
 				p.Calls, PlanCall{
 					Function:    planFunction,
 					InputFields: inFields,
 					OutputField: outField,
+					Filter:      filter,
 				})
 		}
 	}
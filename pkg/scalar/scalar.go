@@ -0,0 +1,197 @@
+// Package scalar has the scalar functions that UQL expressions can call.  The generated filter code
+// calls them, so they take and return the Go types of the internal payloads: int64, float64,
+// string, bool, and time.Time.  Like the generated code, they panic on values they cannot convert.
+package scalar
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Strings
+
+func Lower(s string) string {
+	return strings.ToLower(s)
+}
+
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// Substr returns up to length characters starting at the 1-based position start, as in SQL.
+func Substr(s string, start int64, length int64) string {
+	runes := []rune(s)
+	begin := start - 1
+	if begin < 0 {
+		length += begin
+		begin = 0
+	}
+	if begin >= int64(len(runes)) || length <= 0 {
+		return ""
+	}
+	end := begin + length
+	if end > int64(len(runes)) {
+		end = int64(len(runes))
+	}
+	return string(runes[begin:end])
+}
+
+// Length counts characters, not bytes.
+func Length(s string) int64 {
+	return int64(utf8.RuneCountInString(s))
+}
+
+func Contains(s string, substr string) bool {
+	return strings.Contains(s, substr)
+}
+
+// SplitPart returns the 1-based nth part of s split at the delimiter, or "" if there are fewer parts.
+func SplitPart(s string, delimiter string, n int64) string {
+	parts := strings.Split(s, delimiter)
+	if n < 1 || n > int64(len(parts)) {
+		return ""
+	}
+	return parts[n-1]
+}
+
+func Concat(values ...string) string {
+	return strings.Join(values, "")
+}
+
+// Math
+
+func AbsInt(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func Abs(x float64) float64 {
+	return math.Abs(x)
+}
+
+func Round(x float64) float64 {
+	return math.Round(x)
+}
+
+func Floor(x float64) float64 {
+	return math.Floor(x)
+}
+
+func Ceil(x float64) float64 {
+	return math.Ceil(x)
+}
+
+func Sqrt(x float64) float64 {
+	return math.Sqrt(x)
+}
+
+// Log is the natural logarithm.
+func Log(x float64) float64 {
+	return math.Log(x)
+}
+
+func Pow(x float64, y float64) float64 {
+	return math.Pow(x, y)
+}
+
+// Time
+
+// Seconds returns the seconds since the Unix epoch.
+func Seconds(t time.Time) int64 {
+	return t.Unix()
+}
+
+// DurationSeconds returns a duration in seconds, e.g., 90 for "90 seconds".
+func DurationSeconds(d time.Duration) float64 {
+	return d.Seconds()
+}
+
+// Minutes returns the minutes since the Unix epoch.
+func Minutes(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func DurationMinutes(d time.Duration) float64 {
+	return d.Minutes()
+}
+
+// HourOfDay returns the hour in UTC, 0 to 23.
+func HourOfDay(t time.Time) int64 {
+	return int64(t.UTC().Hour())
+}
+
+// DayOfWeek returns the day in UTC, 0 for Sunday to 6 for Saturday.
+func DayOfWeek(t time.Time) int64 {
+	return int64(t.UTC().Weekday())
+}
+
+// Truncate rounds the time down to a multiple of the duration since the zero time, e.g., to the
+// minute for "1 minutes".
+func Truncate(t time.Time, d time.Duration) time.Time {
+	return t.Truncate(d)
+}
+
+// Format formats the time with a Go layout like "2006-01-02 15:04".
+func Format(t time.Time, layout string) string {
+	return t.Format(layout)
+}
+
+// Conversions
+
+func IntOfFloat(x float64) int64 {
+	return int64(x)
+}
+
+func IntOfString(s string) int64 {
+	i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+func IntOfBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func FloatOfInt(i int64) float64 {
+	return float64(i)
+}
+
+func FloatOfString(s string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func String(value any) string {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// Timestamp parses an RFC 3339 time like "2024-01-02T15:04:05Z".
+func Timestamp(s string) time.Time {
+	return TimestampWithLayout(s, time.RFC3339Nano)
+}
+
+// TimestampWithLayout parses a time with a Go layout like "02/Jan/2006:15:04:05 -0700".
+func TimestampWithLayout(s string, layout string) time.Time {
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,148 @@
+package scalar
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{"lower", Lower("GET /Index"), "get /index"},
+		{"upper", Upper("get"), "GET"},
+		{"substr", Substr("grizzly", 2, 3), "riz"},
+		{"substr of characters", Substr("bär", 2, 1), "ä"},
+		{"substr before the start", Substr("grizzly", 0, 3), "gr"},
+		{"substr after the end", Substr("grizzly", 6, 10), "ly"},
+		{"substr beyond the end", Substr("grizzly", 8, 1), ""},
+		{"substr without length", Substr("grizzly", 1, 0), ""},
+		{"split part", SplitPart("a/b/c", "/", 2), "b"},
+		{"split part beyond the parts", SplitPart("a/b/c", "/", 4), ""},
+		{"split part zero", SplitPart("a/b/c", "/", 0), ""},
+		{"concat", Concat("a", "b", "c"), "abc"},
+		{"concat nothing", Concat(), ""},
+		{"string of an integer", String(int64(42)), "42"},
+		{"string of a boolean", String(true), "true"},
+		{"string of a time", String(time.Date(2024, 1, 2, 15, 4, 5, 600, time.UTC)), "2024-01-02T15:04:05.0000006Z"},
+		{"format", Format(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), "2006-01-02 15:04"), "2024-01-02 15:04"},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: %q, expected %q", test.name, test.actual, test.expected)
+		}
+	}
+	if n := Length("bär"); n != 3 {
+		t.Errorf("length of bär is %d", n)
+	}
+	if !Contains("/api/users", "/api") || Contains("/web", "/api") {
+		t.Errorf("contains is wrong")
+	}
+}
+
+func TestMath(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   float64
+		expected float64
+	}{
+		{"abs", Abs(-1.5), 1.5},
+		{"round half away from zero", Round(-2.5), -3},
+		{"floor", Floor(-1.5), -2},
+		{"ceil", Ceil(1.2), 2},
+		{"sqrt", Sqrt(9), 3},
+		{"log", Log(math.E), 1},
+		{"pow", Pow(2, 10), 1024},
+		{"float of int", FloatOfInt(3), 3},
+		{"float of string", FloatOfString(" 2.5 "), 2.5},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: %v, expected %v", test.name, test.actual, test.expected)
+		}
+	}
+	if !math.IsNaN(Sqrt(-1)) {
+		t.Errorf("the square root of -1 is a number")
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   int64
+		expected int64
+	}{
+		{"abs", AbsInt(-3), 3},
+		{"abs of a positive number", AbsInt(3), 3},
+		{"int of float", IntOfFloat(-2.7), -2},
+		{"int of string", IntOfString(" 42 "), 42},
+		{"int of true", IntOfBool(true), 1},
+		{"int of false", IntOfBool(false), 0},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: %d, expected %d", test.name, test.actual, test.expected)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	// Saturday evening in UTC-7 is Sunday morning in UTC
+	at := time.Date(2024, 1, 6, 23, 30, 15, 0, time.FixedZone("", -7*60*60))
+
+	tests := []struct {
+		name     string
+		actual   int64
+		expected int64
+	}{
+		{"seconds", Seconds(at), at.Unix()},
+		{"minutes", Minutes(time.Unix(150, 0)), 2},
+		{"hour of day in UTC", HourOfDay(at), 6},
+		{"day of week in UTC", DayOfWeek(at), 0},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: %d, expected %d", test.name, test.actual, test.expected)
+		}
+	}
+
+	if seconds := DurationSeconds(90 * time.Second); seconds != 90 {
+		t.Errorf("90 seconds are %v seconds", seconds)
+	}
+	if minutes := DurationMinutes(90 * time.Second); minutes != 1.5 {
+		t.Errorf("90 seconds are %v minutes", minutes)
+	}
+	if truncated := Truncate(at, time.Minute); !truncated.Equal(at.Add(-15 * time.Second)) {
+		t.Errorf("truncated to %v", truncated)
+	}
+
+	expected := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if actual := Timestamp("2024-01-02T15:04:05Z"); !actual.Equal(expected) {
+		t.Errorf("timestamp is %v", actual)
+	}
+	if actual := TimestampWithLayout("02/Jan/2024:08:04:05 -0700", "02/Jan/2006:15:04:05 -0700"); !actual.Equal(expected) {
+		t.Errorf("timestamp with layout is %v", actual)
+	}
+}
+
+// Like the generated code, the conversions panic on values they cannot convert.
+func TestConversionPanics(t *testing.T) {
+	tests := map[string]func(){
+		"int of string":   func() { IntOfString("x") },
+		"float of string": func() { FloatOfString("") },
+		"timestamp":       func() { Timestamp("yesterday") },
+	}
+	for name, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s does not panic", name)
+				}
+			}()
+			test()
+		}()
+	}
+}
@@ -26,13 +26,13 @@ func Init() {
 	log.Info().Msg("Catalog says welcome!")
 }
 
-func ShowPlan() {
-	p := PlanString()
+func ShowPlan(reader io.Reader) {
+	p := PlanString(reader)
 	fmt.Printf("%v", p)
 }
 
-func PlanString() string {
-	root := ReadBinaryPlan(os.Stdin)
+func PlanString(reader io.Reader) string {
+	root := ReadBinaryPlan(reader)
 	var bytes []byte
 	var err error
 	if bytes, err = json.Marshal(plan.GrizzlyNodeToPlan(root)); err != nil {
@@ -107,6 +107,61 @@ func FindFirstNodeByType(node *grizzly.Node, opType grizzly.OperatorType) (targe
 	return nil, false
 }
 
+// Returns the value of the operator property with the given key.
+func FindProperty(node *grizzly.Node, key string) (value string, found bool) {
+	var properties capnp.StructList[grizzly.OperatorProperty]
+	var err error
+	if properties, err = node.Properties(); err != nil {
+		panic(err)
+	}
+	for i := 0; i < properties.Len(); i++ {
+		var k string
+		if k, err = properties.At(i).Key(); err != nil {
+			panic(err)
+		}
+		if k == key {
+			if value, err = properties.At(i).Value(); err != nil {
+				panic(err)
+			}
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Getenv returns the value of the environment variable, or the fallback if the variable is not set.
+// The commands use it for the defaults of their flags.
+func Getenv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// OpenInput opens a file for reading; "-" means stdin.
+func OpenInput(path string) io.ReadCloser {
+	if path == "-" {
+		return os.Stdin
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+// CreateOutput creates a file for writing; "-" means stdout.
+func CreateOutput(path string) io.WriteCloser {
+	if path == "-" {
+		return os.Stdout
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
 func WriteJsonFile(root *grizzly.Node, filePath string) {
 	CreateFile(WriteJson(root), filePath)
 }
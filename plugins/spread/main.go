@@ -0,0 +1,49 @@
+// Spread is an example of a user-defined aggregate function: the difference between the largest and
+// the smallest value of a float64 field.  Build it as a Go plugin with
+//
+//	go build -buildmode=plugin -o _out/plugins/spread.so plugins/spread/main.go
+//
+// and declare it in a schema of the catalog with that library path.
+package main
+
+import (
+	"math"
+
+	"github.com/xsnout/grizzly/capnp/grizzly"
+	"github.com/xsnout/grizzly/pkg/functor"
+)
+
+type Spread struct {
+	minimum float64
+	maximum float64
+}
+
+// New is the constructor that the engine looks up in the plugin.
+func New() functor.Functor {
+	return &Spread{}
+}
+
+func (f *Spread) Init(typ *grizzly.FieldType) {
+	f.Reset()
+}
+
+func (f *Spread) Reset() {
+	f.minimum = math.MaxFloat64
+	f.maximum = -math.MaxFloat64
+}
+
+func (f *Spread) Update(value interface{}) {
+	v := value.(float64)
+	f.minimum = math.Min(f.minimum, v)
+	f.maximum = math.Max(f.maximum, v)
+}
+
+func (f *Spread) Value() interface{} {
+	if f.minimum > f.maximum {
+		return float64(0) // No rows
+	}
+	return f.maximum - f.minimum
+}
+
+// main keeps "go build ./..." working; the engine never calls it.
+func main() {}